@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	"io"
@@ -31,6 +32,25 @@ import (
 	"gitlab.com/gpt4batch"
 )
 
+// ErrDownloadExpired is returned by Download when the server no longer serves
+// the requested file, usually because the signed download link has expired.
+var ErrDownloadExpired = errors.New("download link expired")
+
+// StatusError is returned when the server responds with a non-200 status code.
+type StatusError struct {
+	// Op is the failed operation. [upload file, chat, download file]
+	Op string
+	// StatusCode is the http status code of the response.
+	StatusCode int
+	// Status is the http status of the response.
+	Status string
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to %s: %s", e.Op, e.Status)
+}
+
 // client is a client that logs requests and responses.
 type client struct{}
 
@@ -44,6 +64,7 @@ func (c *client) Upload(ctx context.Context, req *gpt4batch.UploadRequest) (*gpt
 	resp, err := resty.New().
 		SetTimeout(30*time.Second).
 		R().
+		SetContext(ctx).
 		EnableTrace().
 		SetAuthToken(req.AccessToken).
 		SetHeader("Content-Type", "multipart/form-data").
@@ -59,7 +80,7 @@ func (c *client) Upload(ctx context.Context, req *gpt4batch.UploadRequest) (*gpt
 	}
 
 	if resp.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("failed to upload file: %s", resp.Status())
+		return nil, &StatusError{Op: "upload file", StatusCode: resp.StatusCode(), Status: resp.Status()}
 	}
 
 	var result gpt4batch.UploadResponse
@@ -74,6 +95,7 @@ func (c *client) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4bat
 	resp, err := resty.New().
 		SetTimeout(8*time.Minute).
 		R().
+		SetContext(ctx).
 		EnableTrace().
 		SetAuthToken(req.AccessToken).
 		SetHeader("Content-Type", "application/json").
@@ -83,7 +105,7 @@ func (c *client) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4bat
 		return nil, err
 	}
 	if resp.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("failed to chat: %s", resp.Status())
+		return nil, &StatusError{Op: "chat", StatusCode: resp.StatusCode(), Status: resp.Status()}
 	}
 
 	var result gpt4batch.ChatResponse
@@ -96,32 +118,43 @@ func (c *client) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4bat
 // Download downloads a file from the server.
 func (c *client) Download(ctx context.Context, req *gpt4batch.DownloadRequest) error {
 	resp, err := resty.New().
-		SetTimeout(5 * time.Second).
+		SetTimeout(2 * time.Minute).
 		R().
-		EnableTrace().
+		SetContext(ctx).
+		SetDoNotParseResponse(true).
 		Get(req.URL)
 	if err != nil {
 		return err
 	}
-
-	if resp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("failed to download file: %s", resp.Status())
+	body := resp.RawBody()
+	defer body.Close()
+
+	switch resp.StatusCode() {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return fmt.Errorf("%w: %s", ErrDownloadExpired, resp.Status())
+	default:
+		return &StatusError{Op: "download file", StatusCode: resp.StatusCode(), Status: resp.Status()}
 	}
 
-	// TODO: check if the file exists
 	localPath := filepath.Join(req.LocalDir, req.LocalFileName)
 
-	file, err := os.Create(localPath)
+	// write to a temporary file first so that an interrupted download
+	// never leaves a truncated file behind under the final name.
+	file, err := os.CreateTemp(req.LocalDir, "."+req.LocalFileName+".*")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer os.Remove(file.Name())
 
-	_, err = io.Copy(file, resp.RawBody())
-	if err != nil {
+	if _, err = io.Copy(file, body); err != nil {
+		file.Close()
 		return err
 	}
-	return nil
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), localPath)
 }
 
 // Close closes the client.
@@ -0,0 +1,253 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.com/gpt4batch"
+)
+
+// ErrCircuitOpen is returned when a request is refused because the circuit of its endpoint is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuit states.
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitBreaker is implemented by clients that stop sending requests to unhealthy endpoints.
+type CircuitBreaker interface {
+	// Wait blocks until the circuit of url accepts requests or the context is done.
+	Wait(ctx context.Context, url string) error
+}
+
+// Unavailable reports whether err signals that the upstream is overloaded or unreachable:
+// throttling, server errors, network errors and timeouts.
+func Unavailable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusTooManyRequests || se.StatusCode >= http.StatusInternalServerError
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// circuit is the circuit of a single endpoint.
+type circuit struct {
+	state    int
+	failures int
+	// openUntil is the end of the cooldown of an open circuit.
+	openUntil time.Time
+	// probing reports whether the half-open probe request is in flight.
+	probing bool
+	// changed is closed and replaced whenever the state changes.
+	changed chan struct{}
+}
+
+// clientBreaker is a client that opens a circuit per endpoint after consecutive failures.
+type clientBreaker struct {
+	logger gpt4batch.Logger
+	svc    gpt4batch.Client
+	// threshold is the number of consecutive failures that opens the circuit.
+	threshold int
+	// cooldown is how long the circuit stays open before a probe is allowed.
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// Upload uploads a file to the server.
+func (c *clientBreaker) Upload(ctx context.Context, req *gpt4batch.UploadRequest) (resp *gpt4batch.UploadResponse, err error) {
+	if err = c.allow(req.UploadURL); err != nil {
+		return nil, err
+	}
+	defer func() { c.record(req.UploadURL, err) }()
+	return c.svc.Upload(ctx, req)
+}
+
+// Chat sends a message to the server.
+func (c *clientBreaker) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (resp *gpt4batch.ChatResponse, err error) {
+	if err = c.allow(req.URL); err != nil {
+		return nil, err
+	}
+	defer func() { c.record(req.URL, err) }()
+	return c.svc.Chat(ctx, req)
+}
+
+// Download downloads a file from the server.
+func (c *clientBreaker) Download(ctx context.Context, req *gpt4batch.DownloadRequest) error {
+	return c.svc.Download(ctx, req)
+}
+
+// Close closes the client.
+func (c *clientBreaker) Close(ctx context.Context) error {
+	return c.svc.Close(ctx)
+}
+
+// Wait blocks until the circuit of url accepts requests or the context is done.
+func (c *clientBreaker) Wait(ctx context.Context, url string) error {
+	for {
+		c.mu.Lock()
+		cc := c.circuit(url)
+		if c.ready(url, cc) {
+			c.mu.Unlock()
+			return nil
+		}
+		changed, wait := cc.changed, time.Until(cc.openUntil)
+		c.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// allow reports ErrCircuitOpen if the request to url must not be sent.
+// a request allowed on a half-open circuit becomes its probe.
+func (c *clientBreaker) allow(url string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cc := c.circuit(url)
+	if !c.ready(url, cc) {
+		return ErrCircuitOpen
+	}
+	if cc.state == circuitHalfOpen {
+		cc.probing = true
+	}
+	return nil
+}
+
+// ready reports whether the circuit accepts a request, moving an open
+// circuit whose cooldown has elapsed to half-open. c.mu must be held.
+func (c *clientBreaker) ready(url string, cc *circuit) bool {
+	if cc.state == circuitOpen && !time.Now().Before(cc.openUntil) {
+		c.transition(url, cc, circuitHalfOpen)
+	}
+
+	switch cc.state {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		return !cc.probing
+	default:
+		return false
+	}
+}
+
+// record records the outcome of a request to url.
+func (c *clientBreaker) record(url string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cc := c.circuit(url)
+	probe := cc.state == circuitHalfOpen && cc.probing
+	if probe {
+		cc.probing = false
+	}
+
+	if !Unavailable(err) {
+		// errors such as bad requests say nothing about the endpoint health.
+		if err != nil && probe {
+			cc.changed = notify(cc.changed)
+			return
+		}
+		cc.failures = 0
+		if cc.state != circuitClosed {
+			c.transition(url, cc, circuitClosed)
+		}
+		return
+	}
+
+	cc.failures++
+	if probe || (cc.state == circuitClosed && cc.failures >= c.threshold) {
+		cc.openUntil = time.Now().Add(c.cooldown)
+		c.transition(url, cc, circuitOpen)
+	}
+}
+
+// transition moves the circuit to state and wakes up the waiters. c.mu must be held.
+func (c *clientBreaker) transition(url string, cc *circuit, state int) {
+	cc.state = state
+	cc.changed = notify(cc.changed)
+
+	logg := c.logger.
+		WithField("breaker", url).
+		WithField("failures", cc.failures)
+	switch state {
+	case circuitOpen:
+		logg.WithField("cooldown", c.cooldown).Warn("Open")
+	case circuitHalfOpen:
+		logg.Info("HalfOpen")
+	default:
+		logg.Info("Closed")
+	}
+}
+
+// circuit returns the circuit of url. c.mu must be held.
+func (c *clientBreaker) circuit(url string) *circuit {
+	cc, ok := c.circuits[url]
+	if !ok {
+		cc = &circuit{changed: make(chan struct{})}
+		c.circuits[url] = cc
+	}
+	return cc
+}
+
+// notify closes ch and returns a new channel.
+func notify(ch chan struct{}) chan struct{} {
+	close(ch)
+	return make(chan struct{})
+}
+
+// NewClientBreaker returns a new client that opens a circuit per endpoint url after
+// threshold consecutive failures and probes it again after cooldown.
+func NewClientBreaker(logger gpt4batch.Logger, threshold int, cooldown time.Duration, svc gpt4batch.Client) gpt4batch.Client {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &clientBreaker{
+		logger:    logger,
+		svc:       svc,
+		threshold: threshold,
+		cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+	}
+}
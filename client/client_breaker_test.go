@@ -0,0 +1,80 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/log"
+)
+
+// stubClient is a client that returns err from Chat.
+type stubClient struct {
+	noop
+	err error
+}
+
+func (s *stubClient) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &gpt4batch.ChatResponse{}, nil
+}
+
+func Test_clientBreaker_Chat(t *testing.T) {
+	stub := &stubClient{}
+	cc := NewClientBreaker(log.New(log.ErrorLevel), 2, 50*time.Millisecond, stub)
+	req := &gpt4batch.ChatRequest{Source: &gpt4batch.Source{URL: "chat"}}
+	ctx := context.Background()
+
+	// bad requests do not count as failures.
+	stub.err = &StatusError{Op: "chat", StatusCode: http.StatusBadRequest}
+	_, err := cc.Chat(ctx, req)
+	assert.Error(t, err)
+
+	stub.err = &StatusError{Op: "chat", StatusCode: http.StatusServiceUnavailable}
+	for i := 0; i < 2; i++ {
+		_, err = cc.Chat(ctx, req)
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	_, err = cc.Chat(ctx, req)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	// other endpoints are not affected.
+	_, err = cc.Chat(ctx, &gpt4batch.ChatRequest{Source: &gpt4batch.Source{URL: "other"}})
+	assert.NotErrorIs(t, err, ErrCircuitOpen)
+
+	// the failed probe opens the circuit again.
+	assert.NoError(t, cc.(CircuitBreaker).Wait(ctx, "chat"))
+	_, err = cc.Chat(ctx, req)
+	assert.NotErrorIs(t, err, ErrCircuitOpen)
+	_, err = cc.Chat(ctx, req)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	// the successful probe closes the circuit.
+	stub.err = nil
+	assert.NoError(t, cc.(CircuitBreaker).Wait(ctx, "chat"))
+	_, err = cc.Chat(ctx, req)
+	assert.NoError(t, err)
+	_, err = cc.Chat(ctx, req)
+	assert.NoError(t, err)
+}
@@ -80,8 +80,9 @@ func (c clientDownloader) Download(ctx context.Context, req *gpt4batch.DownloadR
 	return c.svc.Download(ctx, req)
 }
 
+// Close closes the client.
 func (c clientDownloader) Close(ctx context.Context) error {
-	return nil
+	return c.svc.Close(ctx)
 }
 
 // NewClientDownloader returns a new client that downloads files from the server.
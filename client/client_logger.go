@@ -31,8 +31,9 @@ type clientLogger struct {
 	svc    gpt4batch.Client
 }
 
+// Close closes the client.
 func (c clientLogger) Close(ctx context.Context) error {
-	return nil
+	return c.svc.Close(ctx)
 }
 
 // Upload uploads a file to the server.
@@ -19,6 +19,9 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"time"
+
 	"github.com/asaskevich/govalidator"
 	"gitlab.com/gpt4batch"
 	"gitlab.com/gpt4batch/nsq"
@@ -43,31 +46,52 @@ func (c clientNSQ) Upload(ctx context.Context, req *gpt4batch.UploadRequest) (*g
 
 // nsqChatMessage is a message that is sent to the server.
 type nsqChatMessage struct {
+	// ID is the id of the in.
+	ID string `json:"id"`
+	// AskID is the id of the ask.
+	AskID string `json:"ask_id"`
+	// Model is the model of the chat.
+	Model string `json:"model"`
 	// id is the id of the message.
 	Ask interface{} `json:"ask"`
 	// answer is the answer to the message.
 	Answer interface{} `json:"answer"`
 	// dir is the directory of the message.
 	Dir string `json:"dir"`
+	// Started is the unix time in milliseconds the chat started at.
+	Started int64 `json:"started"`
+	// Finished is the unix time in milliseconds the chat finished at.
+	Finished int64 `json:"finished"`
+	// Elapsed is the duration of the chat in milliseconds.
+	Elapsed int64 `json:"elapsed"`
 }
 
 // Chat sends a message to the server.
 func (c clientNSQ) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	started := time.Now()
 	resp, err := c.svc.Chat(ctx, req)
 	if err != nil {
 		return nil, err
 	}
+	finished := time.Now()
 
 	if c.async != nil {
 		obj := &nsqChatMessage{
-			Ask:    req.Message,
-			Answer: resp,
-			Dir:    req.Dir,
+			Model:    req.Model,
+			Ask:      req.Message,
+			Answer:   resp,
+			Dir:      req.Dir,
+			Started:  started.UnixMilli(),
+			Finished: finished.UnixMilli(),
+			Elapsed:  finished.Sub(started).Milliseconds(),
+		}
+		if req.Source != nil {
+			obj.ID, obj.AskID = req.ID, req.Pid
 		}
 
 		body, _ := json.Marshal(obj)
 		if err := c.async.WriteBatch(ctx, c.Topic, body); err != nil {
-			c.logger.Warn("NSQ: failed to write batch: %s", err)
+			c.logger.Warn("NSQ: failed to write batch: ", err)
 		}
 	}
 	return resp, nil
@@ -80,10 +104,11 @@ func (c clientNSQ) Download(ctx context.Context, req *gpt4batch.DownloadRequest)
 
 // Close closes the client.
 func (c clientNSQ) Close(ctx context.Context) error {
+	var err error
 	if c.async != nil {
-		return c.async.Close(ctx)
+		err = c.async.Close(ctx)
 	}
-	return nil
+	return errors.Join(err, c.svc.Close(ctx))
 }
 
 // NewClientNSQ returns a new client that uses NSQ.
@@ -0,0 +1,226 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+// Middleware decorates a client with the next client of the chain.
+type Middleware func(next gpt4batch.Client) gpt4batch.Client
+
+type (
+	// UploadFunc is the Upload method of a client.
+	UploadFunc func(ctx context.Context, req *gpt4batch.UploadRequest) (*gpt4batch.UploadResponse, error)
+	// ChatFunc is the Chat method of a client.
+	ChatFunc func(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error)
+	// DownloadFunc is the Download method of a client.
+	DownloadFunc func(ctx context.Context, req *gpt4batch.DownloadRequest) error
+	// CloseFunc is the Close method of a client.
+	CloseFunc func(ctx context.Context) error
+)
+
+// Interceptor intercepts the methods of the next client of the chain. each
+// interceptor calls next to continue the chain, nil interceptors pass through.
+type Interceptor struct {
+	// Upload intercepts Upload.
+	Upload func(ctx context.Context, req *gpt4batch.UploadRequest, next UploadFunc) (*gpt4batch.UploadResponse, error)
+	// Chat intercepts Chat.
+	Chat func(ctx context.Context, req *gpt4batch.ChatRequest, next ChatFunc) (*gpt4batch.ChatResponse, error)
+	// Download intercepts Download.
+	Download func(ctx context.Context, req *gpt4batch.DownloadRequest, next DownloadFunc) error
+	// Close intercepts Close.
+	Close func(ctx context.Context, next CloseFunc) error
+}
+
+// Intercept returns the middleware of the interceptor.
+func Intercept(i Interceptor) Middleware {
+	return func(next gpt4batch.Client) gpt4batch.Client {
+		return &intercepted{Interceptor: i, next: next}
+	}
+}
+
+// intercepted is a client intercepted by an Interceptor.
+type intercepted struct {
+	Interceptor
+	next gpt4batch.Client
+}
+
+// Upload implements gpt4batch.Client.
+func (c *intercepted) Upload(ctx context.Context, req *gpt4batch.UploadRequest) (*gpt4batch.UploadResponse, error) {
+	if c.Interceptor.Upload == nil {
+		return c.next.Upload(ctx, req)
+	}
+	return c.Interceptor.Upload(ctx, req, c.next.Upload)
+}
+
+// Chat implements gpt4batch.Client.
+func (c *intercepted) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	if c.Interceptor.Chat == nil {
+		return c.next.Chat(ctx, req)
+	}
+	return c.Interceptor.Chat(ctx, req, c.next.Chat)
+}
+
+// Download implements gpt4batch.Client.
+func (c *intercepted) Download(ctx context.Context, req *gpt4batch.DownloadRequest) error {
+	if c.Interceptor.Download == nil {
+		return c.next.Download(ctx, req)
+	}
+	return c.Interceptor.Download(ctx, req, c.next.Download)
+}
+
+// Close implements gpt4batch.Client.
+func (c *intercepted) Close(ctx context.Context) error {
+	if c.Interceptor.Close == nil {
+		return c.next.Close(ctx)
+	}
+	return c.Interceptor.Close(ctx, c.next.Close)
+}
+
+// Chain returns cc decorated by the middlewares, the first one being the
+// outermost. closing the chain closes every decorator and cc exactly once,
+// from the outermost to cc, even if a decorator does not close its next client.
+func Chain(cc gpt4batch.Client, mws ...Middleware) gpt4batch.Client {
+	layers := make([]*layer, len(mws)+1)
+	layers[len(mws)] = &layer{Client: cc}
+	for i := len(mws) - 1; i >= 0; i-- {
+		layers[i] = &layer{Client: mws[i](layers[i+1])}
+	}
+	return &chain{layer: layers[0], layers: layers}
+}
+
+// layer is a client of a chain closed at most once.
+type layer struct {
+	gpt4batch.Client
+
+	once   sync.Once
+	closed bool
+	err    error
+}
+
+// Close closes the client once and returns the error of the first Close.
+func (l *layer) Close(ctx context.Context) error {
+	l.once.Do(func() {
+		l.closed = true
+		l.err = l.Client.Close(ctx)
+	})
+	return l.err
+}
+
+// chain is a client decorated by middlewares.
+type chain struct {
+	*layer
+	// layers is the layers from the outermost to the client decorated.
+	layers []*layer
+
+	once sync.Once
+	err  error
+}
+
+// Close closes the layers that the outer layers did not close. it returns
+// the error of the first Close.
+func (c *chain) Close(ctx context.Context) error {
+	c.once.Do(func() {
+		var errs []error
+		for _, l := range c.layers {
+			// the layer has been closed by an outer layer, its error is returned by it.
+			if l.closed {
+				continue
+			}
+			if err := l.Close(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		c.err = errors.Join(errs...)
+	})
+	return c.err
+}
+
+// Unwrap returns the clients of the chain from the outermost.
+func (c *chain) Unwrap() []gpt4batch.Client {
+	clients := make([]gpt4batch.Client, 0, len(c.layers))
+	for _, l := range c.layers {
+		clients = append(clients, l.Client)
+	}
+	return clients
+}
+
+// As finds the first client of cc, or of the chains it is made of, that is
+// assignable to the value pointed to by target, and if one is found, sets
+// target to it and returns true. target must be a non-nil pointer to an
+// interface or to a type implementing gpt4batch.Client.
+func As(cc gpt4batch.Client, target interface{}) bool {
+	val := reflect.ValueOf(target)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		panic("client: target must be a non-nil pointer")
+	}
+	typ := val.Type().Elem()
+
+	if cc == nil {
+		return false
+	}
+	if reflect.TypeOf(cc).AssignableTo(typ) {
+		val.Elem().Set(reflect.ValueOf(cc))
+		return true
+	}
+
+	if u, ok := cc.(interface{ Unwrap() []gpt4batch.Client }); ok {
+		for _, c := range u.Unwrap() {
+			if As(c, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithLogger returns the middleware logging the requests and responses.
+func WithLogger(logger gpt4batch.Logger) Middleware {
+	return func(next gpt4batch.Client) gpt4batch.Client {
+		return NewClientLogger(logger, next)
+	}
+}
+
+// WithDownloader returns the middleware downloading the files of the answers when enabled.
+func WithDownloader(enable bool) Middleware {
+	return func(next gpt4batch.Client) gpt4batch.Client {
+		return NewClientDownloader(enable, next)
+	}
+}
+
+// WithBreaker returns the middleware opening a circuit per endpoint url after
+// threshold consecutive failures and probing it again after cooldown.
+func WithBreaker(logger gpt4batch.Logger, threshold int, cooldown time.Duration) Middleware {
+	return func(next gpt4batch.Client) gpt4batch.Client {
+		return NewClientBreaker(logger, threshold, cooldown, next)
+	}
+}
+
+// WithNSQ returns the middleware publishing the answers to the topic of async.
+func WithNSQ(logger gpt4batch.Logger, async nsq.Async, topic string) Middleware {
+	return func(next gpt4batch.Client) gpt4batch.Client {
+		return NewClientNSQ(logger, async, next, topic)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/log"
+)
+
+// closeClient counts the calls to Close and returns err.
+type closeClient struct {
+	stubClient
+	closed int
+	err    error
+}
+
+func (c *closeClient) Close(ctx context.Context) error {
+	c.closed++
+	return c.err
+}
+
+// trace returns the middleware appending name to calls around each chat.
+func trace(name string, calls *[]string) Middleware {
+	return Intercept(Interceptor{
+		Chat: func(ctx context.Context, req *gpt4batch.ChatRequest, next ChatFunc) (*gpt4batch.ChatResponse, error) {
+			*calls = append(*calls, name)
+			return next(ctx, req)
+		},
+	})
+}
+
+func Test_Chain(t *testing.T) {
+	var calls []string
+	inner := &closeClient{}
+	cc := Chain(inner, trace("a", &calls), trace("b", &calls))
+
+	// the first middleware is the outermost, the methods not intercepted pass through.
+	_, err := cc.Chat(context.Background(), &gpt4batch.ChatRequest{Source: &gpt4batch.Source{}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, calls)
+	assert.NoError(t, cc.Download(context.Background(), &gpt4batch.DownloadRequest{Source: &gpt4batch.Source{}}))
+
+	assert.NoError(t, cc.Close(context.Background()))
+	assert.Equal(t, 1, inner.closed)
+
+	// the decorators that drop Close do not leak the client, a decorator
+	// closed by its outer layer is not closed twice.
+	var dropped *closeClient
+	drop := func(next gpt4batch.Client) gpt4batch.Client {
+		dropped = &closeClient{}
+		return dropped
+	}
+	inner = &closeClient{err: errors.New("inner")}
+	cc = Chain(inner, WithLogger(log.New(log.ErrorLevel)), drop, WithDownloader(false))
+	assert.EqualError(t, cc.Close(context.Background()), "inner")
+	assert.Equal(t, 1, inner.closed)
+	assert.Equal(t, 1, dropped.closed)
+	assert.EqualError(t, cc.Close(context.Background()), "inner")
+	assert.Equal(t, 1, inner.closed)
+}
+
+func Test_As(t *testing.T) {
+	cc := Chain(NewNoop(), WithLogger(log.New(log.ErrorLevel)), WithBreaker(log.New(log.ErrorLevel), 1, time.Second))
+
+	var breaker CircuitBreaker
+	assert.True(t, As(cc, &breaker))
+	assert.NoError(t, breaker.Wait(context.Background(), "chat"))
+
+	var closer *closeClient
+	assert.False(t, As(cc, &closer))
+}
@@ -61,3 +61,14 @@ func DownloadUrlPath(req *downloadReq) string {
 	}
 	return ""
 }
+
+// DownloadFileName returns the local file name for a download URL of the ask pid in batch id.
+// It returns an empty string when the URL does not carry a filename.
+func DownloadFileName(id, pid, url, prefix string) string {
+	return DownloadUrlPath(&downloadReq{
+		Id:     id,
+		Pid:    pid,
+		URL:    url,
+		Prefix: prefix,
+	})
+}
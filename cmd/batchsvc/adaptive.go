@@ -0,0 +1,259 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+const (
+	// backoffRatio is the multiplicative decrease applied on congestion.
+	backoffRatio = 0.5
+	// latencyTolerance is how many times slower than the average latency a
+	// request may be before it is treated as a congestion signal.
+	latencyTolerance = 2.0
+	// latencySmoothing is the weight of a new sample in the average latency.
+	latencySmoothing = 0.1
+	// latencySpikes is how many consecutive latency spikes of an operation are
+	// treated as a congestion signal, so that a single slow answer does not back off.
+	latencySpikes = 3
+	// backoffCooldown is the minimum time between two decreases, so a burst of
+	// failures from the same window only backs off once.
+	backoffCooldown = 5 * time.Second
+)
+
+// Op is an upstream operation. the latency of each operation is averaged apart.
+type Op string
+
+const (
+	// OpUpload is an upload.
+	OpUpload Op = "upload"
+	// OpChat is a chat.
+	OpChat Op = "chat"
+)
+
+// Observer is implemented by limiters that adapt to the outcome of upstream requests.
+type Observer interface {
+	// Observe records the latency and error of an upstream request of op.
+	Observe(op Op, latency time.Duration, err error)
+	// Limit returns the current concurrency limit.
+	Limit() int
+}
+
+// AdaptiveWaitGroup has the same API as runner.SizedWaitGroup but adjusts the
+// amount of goroutines started concurrently with an AIMD (additive increase,
+// multiplicative decrease) algorithm driven by the observed upstream latency
+// and errors.
+type AdaptiveWaitGroup struct {
+	// Min is the lowest concurrency limit.
+	Min int
+	// Max is the highest concurrency limit.
+	Max int
+
+	// logger receives the limit changes.
+	logger gpt4batch.Logger
+	// mu guards the fields below.
+	mu sync.Mutex
+	// limit is the current concurrency limit, between Min and Max.
+	limit float64
+	// current is the number of goroutines running.
+	current int
+	// latency is the exponentially weighted average latency of the healthy
+	// requests of each operation.
+	latency map[Op]time.Duration
+	// spikes is the number of consecutive latency spikes of each operation.
+	spikes map[Op]int
+	// backoffAt is the time of the last decrease.
+	backoffAt time.Time
+	// changed is closed and replaced whenever a slot may have become available.
+	changed chan struct{}
+	// wg waits for the running goroutines.
+	wg sync.WaitGroup
+}
+
+// NewAdaptive creates an AdaptiveWaitGroup.
+// The concurrency limit starts at min and moves between min and max.
+func NewAdaptive(min, max int, logger gpt4batch.Logger) *AdaptiveWaitGroup {
+	if min <= 0 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &AdaptiveWaitGroup{
+		Min:     min,
+		Max:     max,
+		logger:  logger,
+		limit:   float64(min),
+		latency: make(map[Op]time.Duration),
+		spikes:  make(map[Op]int),
+		changed: make(chan struct{}),
+	}
+}
+
+// WithLogger sets the logger the limit changes are reported to.
+func (s *AdaptiveWaitGroup) WithLogger(log gpt4batch.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = log
+}
+
+// Add increments the internal WaitGroup counter.
+// It blocks while the current concurrency limit has been reached.
+func (s *AdaptiveWaitGroup) Add() {
+	s.AddWithContext(context.Background())
+}
+
+// AddWithContext increments the internal WaitGroup counter.
+// It blocks while the current concurrency limit has been reached, or
+// returns an error if the context is canceled before a slot is acquired.
+func (s *AdaptiveWaitGroup) AddWithContext(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if s.current < int(s.limit) {
+			s.current++
+			s.wg.Add(1)
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Done decrements the AdaptiveWaitGroup counter.
+func (s *AdaptiveWaitGroup) Done() {
+	s.mu.Lock()
+	s.current--
+	s.notify()
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// Wait blocks until the AdaptiveWaitGroup counter is zero.
+func (s *AdaptiveWaitGroup) Wait() {
+	s.wg.Wait()
+}
+
+// Limit returns the current concurrency limit.
+func (s *AdaptiveWaitGroup) Limit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.limit)
+}
+
+// Observe records the latency and error of an upstream request of op.
+// Throttling, server errors, timeouts and repeated latency spikes shrink the
+// limit multiplicatively; healthy requests grow it by one per window of limit
+// requests. every healthy latency is folded into the average of op, so that a
+// lasting latency increase is eventually absorbed.
+func (s *AdaptiveWaitGroup) Observe(op Op, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := int(s.limit)
+	switch {
+	case client.Unavailable(err):
+		s.backoff()
+	case err == nil:
+		avg := s.latency[op]
+		if avg == 0 {
+			s.latency[op] = latency
+		} else {
+			s.latency[op] += time.Duration(latencySmoothing * float64(latency-avg))
+		}
+
+		if avg == 0 || float64(latency) <= float64(avg)*latencyTolerance {
+			s.spikes[op] = 0
+			s.limit = math.Min(float64(s.Max), s.limit+1/s.limit)
+			break
+		}
+		// a spike neither grows the limit nor shrinks it until it repeats.
+		if s.spikes[op]++; s.spikes[op] >= latencySpikes {
+			s.spikes[op] = 0
+			s.backoff()
+		}
+	default:
+		// other errors say nothing about the upstream capacity.
+		return
+	}
+
+	if after := int(s.limit); after != before {
+		s.notify()
+		if s.logger != nil {
+			s.logger.
+				WithField("limiter", "adaptive").
+				WithField("from", before).
+				WithField("to", after).
+				WithField("op", op).
+				WithField("latency", s.latency[op]).
+				Info("Concurrency")
+		}
+	}
+}
+
+// backoff shrinks the limit unless it already shrank within the cooldown. s.mu must be held.
+func (s *AdaptiveWaitGroup) backoff() {
+	if time.Since(s.backoffAt) < backoffCooldown {
+		return
+	}
+	s.backoffAt = time.Now()
+	s.limit = math.Max(float64(s.Min), s.limit*backoffRatio)
+}
+
+// notify wakes up the goroutines blocked in AddWithContext. s.mu must be held.
+func (s *AdaptiveWaitGroup) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// withObserver returns the middleware reporting the outcome of the upstream
+// requests to the observer and its limit to the stats.
+func withObserver(observer Observer, stats *Stats) client.Middleware {
+	// observe reports the request of op started at start to the observer.
+	observe := func(op Op, start time.Time, err error) {
+		observer.Observe(op, time.Since(start), err)
+		stats.SetConcurrency(uint64(observer.Limit()))
+	}
+
+	return client.Intercept(client.Interceptor{
+		Upload: func(ctx context.Context, req *gpt4batch.UploadRequest, next client.UploadFunc) (*gpt4batch.UploadResponse, error) {
+			start := time.Now()
+			resp, err := next(ctx, req)
+			observe(OpUpload, start, err)
+			return resp, err
+		},
+		Chat: func(ctx context.Context, req *gpt4batch.ChatRequest, next client.ChatFunc) (*gpt4batch.ChatResponse, error) {
+			start := time.Now()
+			resp, err := next(ctx, req)
+			observe(OpChat, start, err)
+			return resp, err
+		},
+	})
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch/client"
+)
+
+func TestAdaptiveWaitGroup_Observe(t *testing.T) {
+	aw := NewAdaptive(2, 8, nil)
+	assert.Equal(t, 2, aw.Limit())
+
+	// healthy requests grow the limit up to max.
+	for i := 0; i < 100; i++ {
+		aw.Observe(OpChat, 100*time.Millisecond, nil)
+	}
+	assert.Equal(t, 8, aw.Limit())
+
+	// throttling halves the limit once per cooldown.
+	aw.Observe(OpChat, time.Millisecond, &client.StatusError{StatusCode: http.StatusTooManyRequests})
+	assert.Equal(t, 4, aw.Limit())
+	aw.Observe(OpChat, time.Millisecond, &client.StatusError{StatusCode: http.StatusBadGateway})
+	assert.Equal(t, 4, aw.Limit())
+
+	// client errors are not a congestion signal.
+	aw.backoffAt = time.Time{}
+	aw.Observe(OpChat, time.Millisecond, &client.StatusError{StatusCode: http.StatusBadRequest})
+	assert.Equal(t, 4, aw.Limit())
+
+	// repeated latency spikes shrink the limit but never below min.
+	aw.Observe(OpChat, time.Second, nil)
+	aw.Observe(OpChat, time.Second, nil)
+	assert.Equal(t, 4, aw.Limit())
+	aw.Observe(OpChat, time.Second, nil)
+	assert.Equal(t, 2, aw.Limit())
+}
+
+func TestAdaptiveWaitGroup_Observe_ops(t *testing.T) {
+	aw := NewAdaptive(1, 8, nil)
+
+	// chats much slower than uploads are not latency spikes.
+	for i := 0; i < 100; i++ {
+		aw.Observe(OpUpload, 100*time.Millisecond, nil)
+		aw.Observe(OpChat, 5*time.Second, nil)
+	}
+	assert.Equal(t, 8, aw.Limit())
+
+	// a lasting latency increase backs off once, then is absorbed by the average.
+	for i := 0; i < 100; i++ {
+		aw.Observe(OpChat, 20*time.Second, nil)
+	}
+	assert.Equal(t, 8, aw.Limit())
+	assert.InDelta(t, float64(20*time.Second), float64(aw.latency[OpChat]), float64(time.Second))
+}
+
+func TestAdaptiveWaitGroup_AddWithContext(t *testing.T) {
+	aw := NewAdaptive(1, 2, nil)
+	assert.NoError(t, aw.AddWithContext(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, aw.AddWithContext(ctx), context.DeadlineExceeded)
+
+	// a slot freed by Done unblocks a waiting Add.
+	acquired := make(chan struct{})
+	go func() {
+		aw.Add()
+		close(acquired)
+	}()
+	aw.Done()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected Add to acquire the released slot")
+	}
+	aw.Done()
+	aw.Wait()
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/runner"
+)
+
+// errAssertion is returned when an answer fails an assertion in assert_fail mode.
+var errAssertion = errors.New("answer assertion failed")
+
+// languages is the languages detected by their script.
+var languages = map[string]*unicode.RangeTable{
+	"zh": unicode.Han,
+	"ja": unicode.Hiragana,
+	"ko": unicode.Hangul,
+	"ru": unicode.Cyrillic,
+	"ar": unicode.Arabic,
+	"en": unicode.Latin,
+}
+
+// assertions is the assertions evaluated on each answer.
+type assertions struct {
+	match    []*regexp.Regexp
+	notMatch []*regexp.Regexp
+	minLen   int
+	maxLen   int
+	lang     string
+	download bool
+	endTurn  bool
+}
+
+// newAssertions returns the assertions of the option, nil if there is none.
+func newAssertions(o *Option) (*assertions, error) {
+	a := &assertions{
+		minLen:   o.AssertMinLen,
+		maxLen:   o.AssertMaxLen,
+		lang:     o.AssertLang,
+		download: o.AssertDownload,
+		endTurn:  o.AssertEndTurn,
+	}
+
+	for _, expr := range o.AssertMatch {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("assert_match: %w", err)
+		}
+		a.match = append(a.match, re)
+	}
+	for _, expr := range o.AssertNotMatch {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("assert_not_match: %w", err)
+		}
+		a.notMatch = append(a.notMatch, re)
+	}
+
+	if a.lang != "" {
+		if _, ok := languages[a.lang]; !ok {
+			return nil, fmt.Errorf("assert_lang: unsupported language %q", a.lang)
+		}
+	}
+
+	if a.minLen < 0 || a.maxLen < 0 || (a.maxLen > 0 && a.minLen > a.maxLen) {
+		return nil, errors.New("assert_min_len and assert_max_len must satisfy 0 <= min <= max")
+	}
+
+	if len(a.match) == 0 && len(a.notMatch) == 0 && a.minLen == 0 && a.maxLen == 0 &&
+		a.lang == "" && !a.download && !a.endTurn {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// check returns the assertions the answer fails.
+func (a *assertions) check(resp *gpt4batch.ChatResponse) []string {
+	if a == nil {
+		return nil
+	}
+
+	var (
+		failed []string
+		text   = resp.Text()
+		length = utf8.RuneCountInString(text)
+	)
+	for _, re := range a.match {
+		if !re.MatchString(text) {
+			failed = append(failed, fmt.Sprintf("match %s", re))
+		}
+	}
+	for _, re := range a.notMatch {
+		if re.MatchString(text) {
+			failed = append(failed, fmt.Sprintf("not match %s", re))
+		}
+	}
+	if a.minLen > 0 && length < a.minLen {
+		failed = append(failed, fmt.Sprintf("min length %d", a.minLen))
+	}
+	if a.maxLen > 0 && length > a.maxLen {
+		failed = append(failed, fmt.Sprintf("max length %d", a.maxLen))
+	}
+	if a.lang != "" && detectLanguage(text) != a.lang {
+		failed = append(failed, fmt.Sprintf("language %s", a.lang))
+	}
+	if a.download && len(resp.Downloads) == 0 {
+		failed = append(failed, "download")
+	}
+	if a.endTurn && !resp.EndTurn {
+		failed = append(failed, "end turn")
+	}
+	return failed
+}
+
+// detectLanguage returns the language whose script has the most letters in
+// the text. japanese is detected by its kana, as it shares the han script with chinese.
+func detectLanguage(text string) string {
+	counts := make(map[string]int, len(languages))
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for lang, table := range languages {
+			if unicode.Is(table, r) || (lang == "ja" && unicode.Is(unicode.Katakana, r)) {
+				counts[lang]++
+			}
+		}
+	}
+
+	if counts["ja"] > 0 {
+		return "ja"
+	}
+
+	var (
+		best  string
+		count int
+	)
+	for _, lang := range []string{"zh", "ko", "ru", "ar", "en"} {
+		if counts[lang] > count {
+			best, count = lang, counts[lang]
+		}
+	}
+	return best
+}
+
+// assertionError returns the error of the failed assertions of the answer to the ask.
+func assertionError(ask *gpt4batch.Ask, failed []string) error {
+	return &runner.AskError{
+		AskID: ask.ID,
+		Kind:  gpt4batch.ErrKindValidation,
+		Err:   fmt.Errorf("%w: %s", errAssertion, strings.Join(failed, ", ")),
+	}
+}
+
+// check records the assertions the answer failed. in assert_fail mode the ask fails.
+func (s *service) check(ask *gpt4batch.Ask, resp *gpt4batch.ChatResponse) error {
+	if resp.Assertions = s.assertions.check(resp); len(resp.Assertions) != 0 && s.config.AssertFail {
+		return assertionError(ask, resp.Assertions)
+	}
+	return nil
+}
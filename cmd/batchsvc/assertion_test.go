@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/runner"
+)
+
+func Test_newAssertions(t *testing.T) {
+	a, err := newAssertions(&Option{})
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+
+	_, err = newAssertions(&Option{AssertMatch: []string{"("}})
+	assert.Error(t, err)
+
+	_, err = newAssertions(&Option{AssertLang: "xx"})
+	assert.Error(t, err)
+
+	_, err = newAssertions(&Option{AssertMinLen: 10, AssertMaxLen: 5})
+	assert.Error(t, err)
+}
+
+func Test_assertions_check(t *testing.T) {
+	a, err := newAssertions(&Option{
+		AssertMatch:    []string{`\d+`},
+		AssertNotMatch: []string{`(?i)sorry`},
+		AssertMinLen:   3,
+		AssertMaxLen:   10,
+		AssertLang:     "zh",
+		AssertDownload: true,
+		AssertEndTurn:  true,
+	})
+	assert.NoError(t, err)
+
+	assert.Empty(t, a.check(&gpt4batch.ChatResponse{
+		EndTurn:   true,
+		Contents:  []interface{}{"答案是42"},
+		Downloads: []string{"https://example.com/a.png"},
+	}))
+
+	assert.Equal(t, []string{
+		`match \d+`,
+		`not match (?i)sorry`,
+		"max length 10",
+		"language zh",
+		"download",
+		"end turn",
+	}, a.check(&gpt4batch.ChatResponse{
+		Contents: []interface{}{"Sorry, I cannot help"},
+	}))
+
+	var none *assertions
+	assert.Nil(t, none.check(&gpt4batch.ChatResponse{}))
+}
+
+func Test_detectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"hello world", "en"},
+		{"你好，世界 hi", "zh"},
+		{"こんにちは世界", "ja"},
+		{"안녕하세요", "ko"},
+		{"привет мир", "ru"},
+		{"123 !?", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, detectLanguage(tt.text), tt.text)
+	}
+}
+
+func Test_assertionError(t *testing.T) {
+	err := assertionError(&gpt4batch.Ask{ID: "a1"}, []string{"download", "end turn"})
+	assert.True(t, errors.Is(err, errAssertion))
+	assert.EqualError(t, err, "answer assertion failed: download, end turn")
+
+	var ae *runner.AskError
+	assert.True(t, errors.As(err, &ae))
+	assert.Equal(t, gpt4batch.ErrKindValidation, ae.Kind)
+	assert.Equal(t, "a1", ae.AskID)
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/runner"
+)
+
+// errBudgetExhausted is returned when a request would exceed a budget cap.
+var errBudgetExhausted = runner.ErrBudgetExhausted
+
+// BudgetState is the usage counted against the budget caps, persisted across runs.
+type BudgetState struct {
+	// Chats is the number of chat requests.
+	Chats int `json:"chats"`
+	// Uploads is the number of upload requests.
+	Uploads int `json:"uploads"`
+	// Spend is the spend per model.
+	Spend map[string]float64 `json:"spend"`
+	// Daily is the requests of the day per access token fingerprint.
+	Daily map[string]*DailyUsage `json:"daily"`
+}
+
+// DailyUsage is the requests of a token on a day.
+type DailyUsage struct {
+	// Date is the local date of the usage. [2006-01-02]
+	Date string `json:"date"`
+	// Requests is the number of chat and upload requests on the date.
+	Requests int `json:"requests"`
+}
+
+// budget enforces the budget caps of a run and persists the usage to a file.
+type budget struct {
+	mu     sync.Mutex
+	file   string
+	config *Option
+	prices Prices
+	state  BudgetState
+	// reason is the cap that was hit, empty while the budget lasts.
+	reason string
+	done   chan struct{}
+	now    func() time.Time
+}
+
+// newBudget returns the budget of the caps of the option, nil if there is no cap.
+// the usage of previous runs is loaded from the state file.
+func newBudget(config *Option, prices Prices) (*budget, error) {
+	if config.MaxChats <= 0 && config.MaxUploads <= 0 && config.MaxSpend <= 0 && config.MaxDailyRequests <= 0 {
+		return nil, nil
+	}
+
+	b := &budget{
+		file:   config.BudgetState,
+		config: config,
+		prices: prices,
+		done:   make(chan struct{}),
+		now:    time.Now,
+	}
+
+	raw, err := os.ReadFile(b.file)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(raw, &b.state); err != nil {
+			return nil, fmt.Errorf("budget_state: %w", err)
+		}
+	}
+	if b.state.Spend == nil {
+		b.state.Spend = make(map[string]float64)
+	}
+	if b.state.Daily == nil {
+		b.state.Daily = make(map[string]*DailyUsage)
+	}
+	return b, nil
+}
+
+// Done returns a channel closed once a cap is hit.
+func (b *budget) Done() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.done
+}
+
+// exhausted returns the cap that was hit, empty while the budget lasts.
+func (b *budget) exhausted() string {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reason
+}
+
+// acquire counts a chat or upload request of the model sent with the token.
+// it returns errBudgetExhausted without counting if the request would exceed a
+// cap, and the error of the state file without counting if it cannot be saved.
+func (b *budget) acquire(upload bool, model, token string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.reason != "" {
+		return fmt.Errorf("%w: %s", errBudgetExhausted, b.reason)
+	}
+
+	var (
+		cost  = b.cost(upload, model)
+		date  = b.now().Format("2006-01-02")
+		key   = fingerprint(token)
+		daily = b.state.Daily[key]
+	)
+	prev := daily
+	if daily == nil || daily.Date != date {
+		daily = &DailyUsage{Date: date}
+	}
+
+	switch {
+	case !upload && b.config.MaxChats > 0 && b.state.Chats >= b.config.MaxChats:
+		b.reason = fmt.Sprintf("max_chats %d reached", b.config.MaxChats)
+	case upload && b.config.MaxUploads > 0 && b.state.Uploads >= b.config.MaxUploads:
+		b.reason = fmt.Sprintf("max_uploads %d reached", b.config.MaxUploads)
+	case b.config.MaxSpend > 0 && b.state.Spend[model]+cost > b.config.MaxSpend:
+		b.reason = fmt.Sprintf("max_spend %.4f of model %s reached", b.config.MaxSpend, model)
+	case b.config.MaxDailyRequests > 0 && daily.Requests >= b.config.MaxDailyRequests:
+		b.reason = fmt.Sprintf("max_daily_requests %d of the token reached on %s", b.config.MaxDailyRequests, date)
+	}
+	if b.reason != "" {
+		close(b.done)
+		return fmt.Errorf("%w: %s", errBudgetExhausted, b.reason)
+	}
+
+	if upload {
+		b.state.Uploads++
+	} else {
+		b.state.Chats++
+	}
+	b.state.Spend[model] += cost
+	daily.Requests++
+	b.state.Daily[key] = daily
+
+	// the request is not sent if its usage cannot be persisted. roll it back.
+	if err := b.save(); err != nil {
+		b.refund(upload, model, key, cost)
+		if prev == nil {
+			delete(b.state.Daily, key)
+		} else {
+			b.state.Daily[key] = prev
+		}
+		return err
+	}
+	return nil
+}
+
+// release gives back a request counted by acquire that was not sent. the
+// usage is persisted by the next request if it cannot be saved now.
+func (b *budget) release(upload bool, model, token string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refund(upload, model, fingerprint(token), b.cost(upload, model))
+	_ = b.save()
+}
+
+// refund removes a request from the usage. b.mu must be held.
+func (b *budget) refund(upload bool, model, key string, cost float64) {
+	if upload {
+		b.state.Uploads--
+	} else {
+		b.state.Chats--
+	}
+	b.state.Spend[model] -= cost
+	if daily := b.state.Daily[key]; daily != nil && daily.Requests > 0 {
+		daily.Requests--
+	}
+}
+
+// cost returns the price of a chat or upload request of the model.
+func (b *budget) cost(upload bool, model string) float64 {
+	price := b.prices.Of(model)
+	switch {
+	case price == nil:
+		return 0
+	case upload:
+		return price.Upload
+	default:
+		return price.Chat
+	}
+}
+
+// save writes the usage to the state file, replacing it atomically.
+func (b *budget) save() error {
+	raw, err := json.MarshalIndent(&b.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.file), filepath.Base(b.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.file)
+}
+
+// fingerprint returns a short digest of s, so that a token or a sink uri is not persisted in clear.
+func fingerprint(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// withBudget returns the middleware counting every request against the budget
+// before it is sent. the uploads are charged to model. a request refused by an
+// open circuit is never sent, so it is given back.
+func withBudget(b *budget, model string) client.Middleware {
+	return client.Intercept(client.Interceptor{
+		Upload: func(ctx context.Context, req *gpt4batch.UploadRequest, next client.UploadFunc) (*gpt4batch.UploadResponse, error) {
+			if err := b.acquire(true, model, req.AccessToken); err != nil {
+				return nil, err
+			}
+			resp, err := next(ctx, req)
+			if errors.Is(err, client.ErrCircuitOpen) {
+				b.release(true, model, req.AccessToken)
+			}
+			return resp, err
+		},
+		Chat: func(ctx context.Context, req *gpt4batch.ChatRequest, next client.ChatFunc) (*gpt4batch.ChatResponse, error) {
+			if err := b.acquire(false, req.Model, req.AccessToken); err != nil {
+				return nil, err
+			}
+			resp, err := next(ctx, req)
+			if errors.Is(err, client.ErrCircuitOpen) {
+				b.release(false, req.Model, req.AccessToken)
+			}
+			return resp, err
+		},
+	})
+}
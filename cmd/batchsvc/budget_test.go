@@ -0,0 +1,154 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/runner"
+)
+
+func Test_budget_acquire(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "out.budget.json")
+	config := &Option{MaxChats: 2, MaxUploads: 1, BudgetState: state}
+
+	b, err := newBudget(config, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, b.acquire(false, "gpt-4", "t"))
+	assert.NoError(t, b.acquire(true, "gpt-4", "t"))
+	assert.Equal(t, "", b.exhausted())
+
+	// the usage is persisted and counted by the next run.
+	b, err = newBudget(config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.state.Chats)
+	assert.Equal(t, 1, b.state.Uploads)
+	assert.NoError(t, b.acquire(false, "gpt-4", "t"))
+
+	err = b.acquire(false, "gpt-4", "t")
+	assert.True(t, errors.Is(err, errBudgetExhausted))
+	assert.Equal(t, "max_chats 2 reached", b.exhausted())
+	select {
+	case <-b.Done():
+	default:
+		t.Fatal("budget is not done")
+	}
+
+	// once a cap is hit every request is refused.
+	assert.ErrorIs(t, b.acquire(true, "gpt-4", "t"), errBudgetExhausted)
+
+	// a request whose usage cannot be saved is not counted.
+	b, err = newBudget(&Option{MaxChats: 2, BudgetState: filepath.Join(t.TempDir(), "out.budget.json")}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, b.acquire(false, "gpt-4", "t"))
+	b.file = filepath.Join(t.TempDir(), "missing", "out.budget.json")
+	assert.Error(t, b.acquire(false, "gpt-4", "t"))
+	assert.Equal(t, 1, b.state.Chats)
+	for _, daily := range b.state.Daily {
+		assert.Equal(t, 1, daily.Requests)
+	}
+	assert.Equal(t, "", b.exhausted())
+
+	var none *budget
+	assert.NoError(t, none.acquire(false, "gpt-4", "t"))
+	assert.Nil(t, none.Done())
+
+	none, err = newBudget(&Option{}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+}
+
+func Test_budget_spend_daily(t *testing.T) {
+	config := &Option{MaxSpend: 1, MaxDailyRequests: 2, BudgetState: filepath.Join(t.TempDir(), "b.json")}
+	b, err := newBudget(config, Prices{"gpt-4": {Chat: 0.4}})
+	assert.NoError(t, err)
+
+	day := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	b.now = func() time.Time { return day }
+
+	assert.NoError(t, b.acquire(false, "gpt-4", "t1"))
+	assert.NoError(t, b.acquire(false, "gpt-3", "t1"))
+	assert.NoError(t, b.acquire(false, "gpt-4", "t2"))
+
+	// the requests of a token are counted per day.
+	day = day.Add(24 * time.Hour)
+	assert.NoError(t, b.acquire(false, "gpt-3", "t1"))
+	assert.NoError(t, b.acquire(false, "gpt-3", "t1"))
+	assert.ErrorIs(t, b.acquire(false, "gpt-3", "t1"), errBudgetExhausted)
+	assert.Equal(t, "max_daily_requests 2 of the token reached on 2024-01-02", b.exhausted())
+
+	// the spend is capped per model.
+	b, err = newBudget(config, Prices{"gpt-4": {Chat: 0.4}})
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.8, b.state.Spend["gpt-4"], 1e-9)
+	assert.ErrorIs(t, b.acquire(false, "gpt-4", "t3"), errBudgetExhausted)
+	assert.Equal(t, "max_spend 1.0000 of model gpt-4 reached", b.exhausted())
+}
+
+func Test_withBudget(t *testing.T) {
+	b, err := newBudget(&Option{MaxChats: 1, BudgetState: filepath.Join(t.TempDir(), "b.json")}, nil)
+	assert.NoError(t, err)
+
+	cc := &recordClient{Client: client.NewNoop()}
+	item := &gpt4batch.In{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "q0"}, {ID: "a1", Content: "q1"}}}
+	svc := newTestService(&Option{}, client.Chain(cc, withBudget(b, "")), gpt4batch.Ins{item})
+
+	// the second ask exceeds the budget. the item keeps its answer and stays pending.
+	err = svc.runner.Chat(context.Background(), item, 1)
+	assert.ErrorIs(t, err, errBudgetExhausted)
+	assert.Len(t, cc.reqs, 1)
+	assert.Len(t, item.Answers, 1)
+
+	ierr := runner.NewIErr(err, 1)
+	assert.Equal(t, gpt4batch.ErrKindPending, ierr.Kind)
+	assert.Equal(t, "a1", ierr.AskID)
+}
+
+func Test_withBudget_circuitOpen(t *testing.T) {
+	config := &Option{MaxChats: 1, MaxDailyRequests: 1, BudgetState: filepath.Join(t.TempDir(), "b.json")}
+	b, err := newBudget(config, Prices{"gpt-4": {Chat: 0.4}})
+	assert.NoError(t, err)
+
+	open := client.Intercept(client.Interceptor{
+		Chat: func(ctx context.Context, req *gpt4batch.ChatRequest, next client.ChatFunc) (*gpt4batch.ChatResponse, error) {
+			return nil, client.ErrCircuitOpen
+		},
+	})
+	cc := client.Chain(client.NewNoop(), withBudget(b, ""), open)
+
+	// the requests refused by the open circuit are not charged.
+	for i := 0; i < 3; i++ {
+		_, err = cc.Chat(context.Background(), &gpt4batch.ChatRequest{Model: "gpt-4", Source: &gpt4batch.Source{AccessToken: "t"}})
+		assert.ErrorIs(t, err, client.ErrCircuitOpen)
+	}
+	assert.Equal(t, "", b.exhausted())
+
+	b, err = newBudget(config, Prices{"gpt-4": {Chat: 0.4}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.state.Chats)
+	assert.InDelta(t, 0, b.state.Spend["gpt-4"], 1e-9)
+	for _, daily := range b.state.Daily {
+		assert.Equal(t, 0, daily.Requests)
+	}
+}
@@ -19,7 +19,8 @@ package batchsvc
 import (
 	"context"
 	"encoding/json"
-	"net/http"
+	"fmt"
+	"os"
 	"path/filepath"
 	"time"
 
@@ -28,9 +29,15 @@ import (
 	"github.com/spf13/cobra"
 	"gitlab.com/gpt4batch"
 	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/event"
 	"gitlab.com/gpt4batch/log"
 	"gitlab.com/gpt4batch/nsq"
 	"gitlab.com/gpt4batch/reader"
+	"gitlab.com/gpt4batch/sink"
+	"gitlab.com/gpt4batch/webhook"
+
+	// register the sqlite sink.
+	_ "gitlab.com/gpt4batch/store"
 )
 
 // NewBatchCommand returns a new cobra.Command for launching the batchsvc.
@@ -38,17 +45,20 @@ func NewBatchCommand(ctx context.Context) *cobra.Command {
 	var (
 		option Option
 		logger = log.New(log.InfoLevel)
+		// nsqConfig is the default NSQ configuration.
+		nsqConfig = nsq.NewNSQConfig()
 	)
 
 	rootCmd := &cobra.Command{
 		Use:   "batchsvc",
 		Args:  cobra.NoArgs,
 		Short: "please proceed with caution when enabling batch calls to GP Ts scripts.",
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			logg := logger.
 				WithField("url", option.URL).
 				WithField("model", option.Model).
 				WithField("fix", option.Fix).
+				WithField("resume", option.Resume).
 				WithField("rdb", option.EnableRDB).
 				WithField("gizmo_id", option.GizmoId)
 
@@ -57,17 +67,36 @@ func NewBatchCommand(ctx context.Context) *cobra.Command {
 				return err
 			}
 
+			// worker mode. consume the items from NSQ instead of the input file.
+			if option.Worker {
+				sinks, err := newSinks(ctx, logger, &option)
+				if err != nil {
+					return err
+				}
+				cc := newClient(logger, &option, sinks)
+				events := newEmitter(logger, &option, sinks)
+				return runWorker(signals.WithStandardSignals(ctx), logg, &option, cc, events)
+			}
+
 			var (
 				// batchTotal is the total number of batches.
 				batchTotal uint64 = 0
 				// asks is the gpt4api batch.
 				ins = make(gpt4batch.Ins, 0)
-				// cc is the client.
-				cc = client.NewClientDownloader(option.EnableDownload, client.NewClientLogger(logger, client.NewClient()))
-				// todo NewNoop only use to test.
-				//cc = client.NewNoop()
+				// stats is the stats of the run, nil until the items are read.
+				stats *Stats
 			)
 
+			// notifier posts the notifications of the run to the webhooks.
+			// a fatal error of the run is posted as run.failed.
+			notifier := newNotifier(logger, &option)
+			defer func() {
+				if err != nil {
+					notify(context.Background(), notifier, logg, &option, stats, webhook.TypeRunFailed, err)
+				}
+				notifier.Close()
+			}()
+
 			// read the input file. if the input file is invalid, return an error.
 			// the input file is a json file. each line is a json object.
 			// the json object is a gpt4api batch.
@@ -81,11 +110,11 @@ func NewBatchCommand(ctx context.Context) *cobra.Command {
 				}
 
 				// If the run is not continued and there are no errors
-				// set the error message to Resource Not Ready.
+				// mark the item pending until it has been run.
 				if !option.Fix && in.IErr == nil {
 					in.IErr = &gpt4batch.IErr{
-						Code:    http.StatusBadRequest,
 						Message: "resource is not ready",
+						Kind:    gpt4batch.ErrKindPending,
 					}
 				}
 
@@ -106,35 +135,54 @@ func NewBatchCommand(ctx context.Context) *cobra.Command {
 				return err
 			}
 
-			// NSQ is enabled. create a new NSQ writer.
-			// the NSQ writer is used to send the gpt4api batch to the server.
-			if option.NSQ.Enable {
-				// create a new NSQ writer.
-				async, err := nsq.NewNSQWriter(option.NSQ, logger)
-				if err != nil {
-					return err
-				}
-				// connect to NSQ. if the connection is failed, return an error.
-				if err = async.Connect(ctx); err != nil {
-					return err
-				}
+			// inspect the items and estimate the requests, cost and duration of the run.
+			// prices is checked by Validate.
+			prices, _ := loadPrices(option.PriceTable)
+			inspection := Inspect(ins, filepath.Dir(option.In), &option)
+			est := estimate(inspection, &option, prices)
+
+			// dry run. check every item and print a summary without sending anything.
+			if option.DryRun {
+				return dryRun(logg, &option, inspection, est)
+			}
+
+			// refuse to start when the estimate exceeds the budget.
+			logEstimate(logg, est)
+			if err := checkBudget(&option, est); err != nil {
+				return err
+			}
+
+			// check the dependencies between the items before anything is sent.
+			if err := CheckDependencies(ins); err != nil {
+				return err
+			}
 
-				// create a new client that uses NSQ. the client is used to send the gpt4api batch to the server.
-				// the client is a wrapper of the NSQ writer.
-				cc = client.NewClientNSQ(logger, async, cc, option.NSQ.Topic)
+			// sinks is NSQ and the other sinks the run is published to.
+			sinks, err := newSinks(ctx, logger, &option)
+			if err != nil {
+				return err
 			}
 
+			// cc is the client.
+			cc := newClient(logger, &option, sinks)
+
+			// events publishes the events of the run to NSQ and the sinks.
+			events := newEmitter(logger, &option, sinks)
+
 			// create a new service. the service is used to send the gpt4api batch to the server.
-			svc := NewService(&option, cc, ins, &Stats{
+			stats = &Stats{
 				BatchTotal:    batchTotal,
 				CompleteTotal: 0,
 				SuccessTotal:  0,
 				FailedTotal:   0,
-			})
+			}
+			svc := NewService(&option, cc, ins, stats)
 
 			// set the logger for the service.
 			// the logger is used to log the service.
 			svc.WithLogger(logg)
+			svc.(*service).WithEmitter(events)
+			svc.(*service).WithNotifier(notifier)
 
 			logg.
 				WithField("in", option.In).
@@ -162,16 +210,163 @@ func NewBatchCommand(ctx context.Context) *cobra.Command {
 	rootCmd.Flags().StringVarP(&option.In, "in", "i", "example.jsonl", "输入文件路径，数据格式按照规定格式定义.")
 	rootCmd.Flags().StringVarP(&option.Out, "out", "o", "out.jsonl", "输出文件路径，GPTs数据跑完存储数据的文件路径.")
 	rootCmd.Flags().IntVarP(&option.Goroutine, "goroutine", "g", 1, "设置最大协程数量.")
+	rootCmd.Flags().BoolVar(&option.Adaptive, "adaptive", false, "是否开启自适应并发，根据接口延迟与429/5xx错误在min_goroutine与goroutine之间自动调整.")
+	rootCmd.Flags().IntVar(&option.MinGoroutine, "min_goroutine", 1, "设置自适应并发的最小协程数量.")
 	rootCmd.Flags().BoolVarP(&option.HistoryAndTrainingDisabled, "history_and_training_disabled", "s", true, "是否开启历史对话历史记录，默认是关闭的.")
 	rootCmd.Flags().StringVarP(&option.Model, "model", "m", "gpt-4-gizmo", "设置调用GPTs的模型.")
 	rootCmd.Flags().StringVarP(&option.GizmoId, "gizmo-id", "z", "", "设置GPTs gizmo id的名称.")
 	rootCmd.Flags().BoolVarP(&option.Fix, "fix", "f", false, "是否开启续跑模式.")
+	rootCmd.Flags().BoolVar(&option.Resume, "resume", false, "续跑时从第一个未回答的问题继续原会话.")
+	rootCmd.Flags().StringSliceVar(&option.RerunKinds, "rerun_kind", nil, "续跑时只重跑这些错误分类的题,例如timeout,quota.")
+	rootCmd.Flags().IntSliceVar(&option.RerunCodes, "rerun_code", nil, "续跑时只重跑这些错误状态码的题,例如429,502.")
+	rootCmd.Flags().StringSliceVar(&option.RerunIDs, "rerun_id", nil, "续跑时只重跑这些id的题.")
+	rootCmd.Flags().StringVar(&option.RerunIDRegex, "rerun_id_regex", "", "续跑时只重跑id匹配该正则的题.")
+	rootCmd.Flags().IntSliceVar(&option.RerunAskIndexes, "rerun_ask_index", nil, "续跑时只重跑在这些问题序号(从0开始)失败的题.")
+	rootCmd.Flags().BoolVar(&option.RerunEmpty, "rerun_empty", false, "续跑时重跑答案内容为空的成功题.")
+	rootCmd.Flags().BoolVar(&option.RerunNoEndTurn, "rerun_no_end_turn", false, "续跑时重跑答案end_turn为false的成功题.")
+	rootCmd.Flags().StringSliceVar(&option.Force, "force", nil, "续跑时强制重跑这些id的成功题.")
 	rootCmd.Flags().IntVarP(&option.QPS, "qps", "q", 8, "设置QPS并发量.")
 	rootCmd.Flags().BoolVarP(&option.NSQ.Enable, "enable_nsq", "n", false, "是否开启NSQ消息队列.")
+	rootCmd.Flags().StringSliceVar(&option.NSQ.Addresses, "nsq_address", nsqConfig.Addresses, "NSQ nsqd TCP地址列表，按顺序优先发送到健康的nsqd.")
+	rootCmd.Flags().StringSliceVar(&option.NSQ.LookupdAddresses, "nsq_lookupd", nil, "NSQ nsqlookupd HTTP地址列表，Worker模式通过它发现nsqd.")
+	rootCmd.Flags().StringVar(&option.NSQ.Topic, "nsq_topic", nsqConfig.Topic, "NSQ发布回答的topic.")
+	rootCmd.Flags().IntVar(&option.NSQ.MaxInFlight, "nsq_max_in_flight", nsqConfig.MaxInFlight, "NSQ最大处理中消息数.")
+	rootCmd.Flags().StringVar(&option.NSQ.UserAgent, "nsq_user_agent", nsqConfig.UserAgent, "NSQ客户端UserAgent.")
+	rootCmd.Flags().BoolVar(&option.NSQ.TLS, "nsq_tls", false, "是否使用TLS连接nsqd.")
+	rootCmd.Flags().StringVar(&option.NSQ.TLSCAFile, "nsq_tls_ca", "", "NSQ TLS CA证书文件，不设置则使用系统证书.")
+	rootCmd.Flags().StringVar(&option.NSQ.TLSCertFile, "nsq_tls_cert", "", "NSQ TLS客户端证书文件.")
+	rootCmd.Flags().StringVar(&option.NSQ.TLSKeyFile, "nsq_tls_key", "", "NSQ TLS客户端私钥文件.")
+	rootCmd.Flags().BoolVar(&option.NSQ.TLSSkipVerify, "nsq_tls_skip_verify", false, "NSQ TLS是否跳过服务端证书校验.")
+	rootCmd.Flags().StringVar(&option.NSQ.AuthSecret, "nsq_auth_secret", "", "NSQ AUTH认证密钥.")
+	rootCmd.Flags().IntVar(&option.NSQ.BatchSize, "nsq_batch_size", nsqConfig.BatchSize, "NSQ每次MultiPublish的最大消息数，1表示不批量发送.")
+	rootCmd.Flags().DurationVar(&option.NSQ.BatchInterval, "nsq_batch_interval", nsqConfig.BatchInterval, "NSQ批量发送时消息最长等待时间.")
+	rootCmd.Flags().DurationVar(&option.NSQ.HealthCheckInterval, "nsq_health_interval", nsqConfig.HealthCheckInterval, "NSQ连接健康检查与重连间隔，0表示关闭.")
+	rootCmd.Flags().StringVar(&option.NSQ.Outbox, "nsq_outbox", "", "NSQ发布失败的消息暂存文件，后台退避重试，退出时尽量发送完，默认是输出文件加.nsq-outbox.jsonl.")
+	rootCmd.Flags().StringSliceVar(&option.Sinks, "sink", nil, "回答同时发布到的目标URI，可多次设置，支持kafka://、redis://、rediss://、nats://、http(s)://、file://、sqlite://与nsq://，topic参数可覆盖发布的topic.")
+	rootCmd.Flags().StringVar(&option.EventEncoding, "event_encoding", "json", "发布事件的编码，json或protobuf(见event/event.proto)，legacy表示按旧版格式只发布回答，不发布生命周期事件.")
+	rootCmd.Flags().StringSliceVar(&option.EventTypes, "event_types", nil, "只发布这些类型的事件，支持item.started,ask.completed,ask.failed,item.completed,run.finished，默认全部.")
 	rootCmd.Flags().BoolVarP(&option.EnableDownload, "enable-download", "e", true, "是否开启文件下载.")
 	rootCmd.Flags().StringVarP(&option.DownloadDir, "download-dir", "d", "", "下载文件夹名称.如果未设置会存在当前文件夹目录.")
 	rootCmd.Flags().StringVarP(&option.DownloadFilePrefix, "download-prefix", "p", "GPT4API", "设置文件下载前缀，防止下载文件名冲突覆盖.")
+	rootCmd.Flags().StringVar(&option.JSONSchema, "json_schema", "", "设置JSON Schema文件，每个会话最后一条回答中的JSON需符合该Schema.")
+	rootCmd.Flags().IntVar(&option.JSONReask, "json_reask", 0, "回答JSON校验失败时在同一会话中重新提问的次数.")
+	rootCmd.Flags().StringSliceVar(&option.AssertMatch, "assert_match", nil, "断言:每条回答必须匹配的正则.")
+	rootCmd.Flags().StringSliceVar(&option.AssertNotMatch, "assert_not_match", nil, "断言:每条回答不能匹配的正则.")
+	rootCmd.Flags().IntVar(&option.AssertMinLen, "assert_min_len", 0, "断言:每条回答的最小字数.")
+	rootCmd.Flags().IntVar(&option.AssertMaxLen, "assert_max_len", 0, "断言:每条回答的最大字数.")
+	rootCmd.Flags().StringVar(&option.AssertLang, "assert_lang", "", "断言:每条回答的语言,支持zh,ja,ko,ru,ar,en.")
+	rootCmd.Flags().BoolVar(&option.AssertDownload, "assert_download", false, "断言:每条回答必须包含可下载文件.")
+	rootCmd.Flags().BoolVar(&option.AssertEndTurn, "assert_end_turn", false, "断言:每条回答end_turn必须为true.")
+	rootCmd.Flags().BoolVar(&option.AssertFail, "assert_fail", false, "断言失败时将该题记为失败，续跑时会重跑.")
+	rootCmd.Flags().IntVar(&option.BreakerThreshold, "breaker_threshold", 0, "设置熔断阈值，接口连续失败次数达到该值后暂停派发，0表示关闭.")
+	rootCmd.Flags().IntVar(&option.BreakerCooldown, "breaker_cooldown", 30, "设置熔断后探测接口恢复的等待秒数.")
+	rootCmd.Flags().StringVar(&option.PriceTable, "price_table", "", `设置价格表JSON文件,按模型设置每次请求价格,例如{"gpt-4-gizmo":{"chat":0.1,"upload":0.02},"default":{"chat":0.05}}.`)
+	rootCmd.Flags().Float64Var(&option.MaxBudget, "max_budget", 0, "设置预算上限，预估费用超过该值时不启动，0表示不限制.")
+	rootCmd.Flags().IntVar(&option.MaxChats, "max_chats", 0, "设置对话请求数上限(跨多次运行累计)，达到后停止派发，剩余题保持pending，0表示不限制.")
+	rootCmd.Flags().IntVar(&option.MaxUploads, "max_uploads", 0, "设置上传请求数上限(跨多次运行累计)，0表示不限制.")
+	rootCmd.Flags().Float64Var(&option.MaxSpend, "max_spend", 0, "设置每个模型的花费上限(按price_table计算，跨多次运行累计)，0表示不限制.")
+	rootCmd.Flags().IntVar(&option.MaxDailyRequests, "max_daily_requests", 0, "设置每个访问令牌每天的请求数上限，0表示不限制.")
+	rootCmd.Flags().StringVar(&option.BudgetState, "budget_state", "", "预算用量持久化文件，默认是输出文件加.budget.json.")
+	rootCmd.Flags().StringVar(&option.HookBeforeRun, "hook_before_run", "", "开始派发前通过sh -c执行的命令，运行信息JSON写入stdin，命令失败则不启动.")
+	rootCmd.Flags().StringVar(&option.HookBeforeItem, "hook_before_item", "", "每道题发送前执行的命令，题目JSON写入stdin，stdout输出的JSON会覆盖题目字段，退出码3表示跳过该题，其他失败将该题记为hook错误.")
+	rootCmd.Flags().StringVar(&option.HookAfterItem, "hook_after_item", "", "每道题完成后执行的命令，题目JSON写入stdin.")
+	rootCmd.Flags().StringVar(&option.HookOnFailure, "hook_on_failure", "", "每道题失败后执行的命令，题目JSON写入stdin.")
+	rootCmd.Flags().StringVar(&option.HookAfterRun, "hook_after_run", "", "输出文件写入后执行的命令，运行信息JSON写入stdin.")
+	rootCmd.Flags().DurationVar(&option.HookTimeout, "hook_timeout", 30*time.Second, "每次执行钩子命令的超时时间，超时的命令会被终止.")
+	rootCmd.Flags().StringSliceVar(&option.Webhooks, "webhook", nil, "运行开始、进度、结束与失败时POST通知的webhook地址，可多次设置.")
+	rootCmd.Flags().StringVar(&option.WebhookSecret, "webhook_secret", os.Getenv("GPT4BATCH_WEBHOOK_SECRET"), "webhook签名密钥，设置后请求头X-Gpt4batch-Signature为HMAC-SHA256签名，默认读取环境变量GPT4BATCH_WEBHOOK_SECRET.")
+	rootCmd.Flags().StringVar(&option.WebhookTemplate, "webhook_template", "", "webhook请求体的Go模板文件，模板结果需为JSON，默认发送通知JSON.")
+	rootCmd.Flags().StringSliceVar(&option.WebhookEvents, "webhook_events", nil, "只发送这些类型的通知，支持run.started,run.progress,run.finished,run.failed，默认全部.")
+	rootCmd.Flags().DurationVar(&option.WebhookInterval, "webhook_interval", time.Minute, "进度通知的间隔，0表示不发送进度通知.")
+	rootCmd.Flags().IntVar(&option.WebhookRetries, "webhook_retries", 3, "通知失败(网络错误、429或5xx)时的重试次数.")
+	rootCmd.Flags().DurationVar(&option.WebhookTimeout, "webhook_timeout", 10*time.Second, "每次通知请求的超时时间.")
+	rootCmd.Flags().BoolVar(&option.DryRun, "dry_run", false, "只校验输入文件(id重复、内容为空、图片与文件是否存在及大小类型)并输出请求数、上传数与预计耗时，不发送任何请求.")
+	rootCmd.Flags().BoolVar(&option.Worker, "worker", false, "是否开启Worker模式，从NSQ消费任务并将结果发布到结果topic，不读取输入文件.")
+	rootCmd.Flags().StringVar(&option.WorkerTopic, "worker_topic", "gpt4api_jobs", "Worker模式消费任务的topic.")
+	rootCmd.Flags().StringVar(&option.WorkerChannel, "worker_channel", "batchsvc", "Worker模式消费任务的channel.")
+	rootCmd.Flags().StringVar(&option.WorkerResultsTopic, "worker_results_topic", "gpt4api_results", "Worker模式发布结果的topic.")
+	rootCmd.Flags().IntVar(&option.WorkerMaxAttempts, "worker_max_attempts", 5, "Worker模式任务最大尝试次数，超过后发布失败结果不再重试.")
 	rootCmd.Flags().BoolVarP(&option.EnableRDB, "rdb", "r", true, "是否开启RDB文件缓存持久化策略.")
 	rootCmd.Flags().IntVarP(&option.RDBInterval, "rdb_interval", "v", 60, "RDB缓存时间间隔，默认是60分钟")
 	return rootCmd
 }
+
+// newClient returns the client of the option. the chats are guarded by the
+// circuit breaker when enabled. with the legacy event encoding, the answers
+// are published to sinks in the nsqChatMessage envelope of the client.
+func newClient(logger gpt4batch.Logger, option *Option, sinks nsq.Async) gpt4batch.Client {
+	// mws decorates the client, the first one being the outermost.
+	var mws []client.Middleware
+
+	// circuit breaker is enabled. stop sending requests to an endpoint
+	// after consecutive failures and probe it again after the cooldown.
+	if option.BreakerThreshold > 0 {
+		mws = append(mws, client.WithBreaker(logger, option.BreakerThreshold, time.Duration(option.BreakerCooldown)*time.Second))
+	}
+	if sinks != nil && option.EventEncoding == eventEncodingLegacy {
+		mws = append(mws, client.WithNSQ(logger, sinks, option.NSQ.Topic))
+	}
+	mws = append(mws, client.WithDownloader(option.EnableDownload), client.WithLogger(logger))
+
+	// todo NewNoop only use to test.
+	//return client.Chain(client.NewNoop(), mws...)
+	return client.Chain(client.NewClient(), mws...)
+}
+
+// sinkOutbox returns the outbox file of the sink uri. it is named after a
+// digest of the uri, so that the queued messages go to the same sink when
+// the sinks are reordered.
+func sinkOutbox(out, uri string) string {
+	return fmt.Sprintf("%s.sink-%s-outbox.jsonl", out, fingerprint(uri))
+}
+
+// newSinks returns NSQ and the other sinks of the option connected, nil if
+// none is enabled.
+func newSinks(ctx context.Context, logger gpt4batch.Logger, option *Option) (nsq.Async, error) {
+	// sinks is where the events are published to.
+	sinks := make([]nsq.Async, 0, len(option.Sinks)+1)
+
+	// NSQ is enabled. create a new NSQ writer.
+	if option.NSQ.Enable {
+		// create a new NSQ writer.
+		async, err := nsq.NewNSQWriter(option.NSQ, logger)
+		if err != nil {
+			return nil, err
+		}
+		// queue the messages that fail to publish in a local file and publish them again later.
+		sinks = append(sinks, nsq.NewOutbox(option.NSQ.Outbox, async, logger))
+	}
+
+	// the other sinks. each sink queues its failed messages in its own outbox.
+	for _, uri := range option.Sinks {
+		async, err := sink.Open(uri, logger)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, nsq.NewOutbox(sinkOutbox(option.Out, uri), async, logger))
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	async := sink.NewMulti(sinks...)
+	// connect to the sinks. if the connection is failed, return an error.
+	if err := async.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return async, nil
+}
+
+// newEmitter returns the emitter publishing the events of the run to sinks,
+// nil if sinks is nil or the answers are published by the client in the
+// legacy envelope.
+func newEmitter(logger gpt4batch.Logger, option *Option, sinks nsq.Async) *event.Emitter {
+	if sinks == nil || option.EventEncoding == eventEncodingLegacy {
+		return nil
+	}
+
+	// the event types have been checked by Option.Validate.
+	types, _ := event.ParseTypes(option.EventTypes)
+	return event.NewEmitter(sinks, option.NSQ.Topic, event.Encoding(option.EventEncoding), types, logger)
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitlab.com/gpt4batch"
+)
+
+// CheckDependencies checks that every dependency of the items refers to exactly
+// one item and that the dependencies have no cycle.
+func CheckDependencies(ins gpt4batch.Ins) error {
+	var (
+		index = make(map[string]*gpt4batch.In, len(ins))
+		dups  = make(map[string]struct{})
+	)
+	for _, in := range ins {
+		if _, ok := index[in.ID]; ok {
+			dups[in.ID] = struct{}{}
+		}
+		index[in.ID] = in
+	}
+
+	for _, in := range ins {
+		for _, dep := range in.DependsOn {
+			if _, ok := index[dep]; !ok {
+				return fmt.Errorf("item %s depends on unknown item %s", in.ID, dep)
+			}
+			if _, ok := dups[dep]; ok {
+				return fmt.Errorf("item %s depends on duplicate id %s", in.ID, dep)
+			}
+			if dep == in.ID {
+				return fmt.Errorf("item %s depends on itself", in.ID)
+			}
+		}
+	}
+
+	// Kahn's algorithm: the items left with dependencies are on a cycle.
+	pending := make(map[string]int, len(ins))
+	dependents := make(map[string][]string, len(ins))
+	queue := make([]string, 0, len(ins))
+	for _, in := range ins {
+		pending[in.ID] = len(in.DependsOn)
+		for _, dep := range in.DependsOn {
+			dependents[dep] = append(dependents[dep], in.ID)
+		}
+		if len(in.DependsOn) == 0 {
+			queue = append(queue, in.ID)
+		}
+	}
+	for len(queue) != 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[id] {
+			if pending[d]--; pending[d] == 0 {
+				queue = append(queue, d)
+			}
+		}
+	}
+
+	cycle := make([]string, 0)
+	for id, n := range pending {
+		if n > 0 {
+			cycle = append(cycle, id)
+		}
+	}
+	if len(cycle) != 0 {
+		sort.Strings(cycle)
+		return fmt.Errorf("dependency cycle between items: %s", strings.Join(cycle, ", "))
+	}
+	return nil
+}
+
+// node is an item of the dependency graph.
+type node struct {
+	item *gpt4batch.In
+	// run reports whether the item is run.
+	run bool
+	// pending is the number of unresolved dependencies.
+	pending int
+	// failedDep is the id of a failed dependency.
+	failedDep string
+	// dependents is the items depending on this item.
+	dependents []*node
+}
+
+// dag schedules the items once their dependencies are resolved.
+type dag struct {
+	mu    sync.Mutex
+	total int
+	// resolved is the number of resolved items.
+	resolved int
+	// ready is the items whose dependencies are resolved, closed once every item is resolved.
+	ready chan *node
+	// nodes is the node of each item.
+	nodes map[*gpt4batch.In]*node
+}
+
+// newDAG returns the schedule of the items. the items without dependencies are
+// ready in their original order.
+func newDAG(items gpt4batch.Ins, reruns []bool) *dag {
+	d := &dag{
+		total: len(items),
+		ready: make(chan *node, len(items)),
+		nodes: make(map[*gpt4batch.In]*node, len(items)),
+	}
+
+	nodes := make(map[string]*node, len(items))
+	list := make([]*node, 0, len(items))
+	for idx, item := range items {
+		n := &node{item: item, run: reruns[idx], pending: len(item.DependsOn)}
+		nodes[item.ID] = n
+		d.nodes[item] = n
+		list = append(list, n)
+	}
+	for _, n := range list {
+		for _, dep := range n.item.DependsOn {
+			nodes[dep].dependents = append(nodes[dep].dependents, n)
+		}
+	}
+
+	for _, n := range list {
+		if n.pending == 0 {
+			d.ready <- n
+		}
+	}
+	if d.total == 0 {
+		close(d.ready)
+	}
+	return d
+}
+
+// resolve resolves the node and readies the dependents whose dependencies are all resolved.
+func (d *dag) resolve(n *node, failed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, dep := range n.dependents {
+		if failed && dep.failedDep == "" {
+			dep.failedDep = n.item.ID
+		}
+		if dep.pending--; dep.pending == 0 {
+			d.ready <- dep
+		}
+	}
+
+	if d.resolved++; d.resolved == d.total {
+		close(d.ready)
+	}
+}
+
+// lookup returns the item of the id for the asks depending on it.
+func (s *service) lookup(id string) (*gpt4batch.In, bool) {
+	item, ok := s.index[id]
+	return item, ok
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	assert.NoError(t, CheckDependencies(gpt4batch.Ins{
+		{ID: "a"}, {ID: "b", DependsOn: []string{"a"}}, {ID: "c", DependsOn: []string{"a", "b"}},
+	}))
+	assert.EqualError(t, CheckDependencies(gpt4batch.Ins{
+		{ID: "a", DependsOn: []string{"c"}}, {ID: "b", DependsOn: []string{"a"}}, {ID: "c", DependsOn: []string{"b"}}, {ID: "d"},
+	}), "dependency cycle between items: a, b, c")
+	assert.Error(t, CheckDependencies(gpt4batch.Ins{{ID: "a", DependsOn: []string{"x"}}}))
+	assert.Error(t, CheckDependencies(gpt4batch.Ins{{ID: "a"}, {ID: "a"}, {ID: "b", DependsOn: []string{"a"}}}))
+}
+
+func Test_dag_resolve(t *testing.T) {
+	items := gpt4batch.Ins{
+		{ID: "c", DependsOn: []string{"a", "b"}}, {ID: "a"}, {ID: "b"}, {ID: "d", DependsOn: []string{"c"}},
+	}
+	d := newDAG(items, []bool{true, true, true, true})
+
+	// items without dependencies are ready in order.
+	a := <-d.ready
+	assert.Equal(t, "a", a.item.ID)
+	b := <-d.ready
+	assert.Equal(t, "b", b.item.ID)
+	assert.Len(t, d.ready, 0)
+
+	// dependents are ready once all their dependencies are resolved.
+	d.resolve(b, true)
+	assert.Len(t, d.ready, 0)
+	d.resolve(a, false)
+	c := <-d.ready
+	assert.Equal(t, "c", c.item.ID)
+	assert.Equal(t, "b", c.failedDep)
+
+	d.resolve(c, true)
+	dd := <-d.ready
+	assert.Equal(t, "c", dd.failedDep)
+
+	// the schedule is closed once every item is resolved.
+	d.resolve(dd, true)
+	_, ok := <-d.ready
+	assert.False(t, ok)
+}
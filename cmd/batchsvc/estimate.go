@@ -0,0 +1,123 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"gitlab.com/gpt4batch"
+)
+
+// defaultPrice is the key of the price of the models missing from the price table.
+const defaultPrice = "default"
+
+// Price is the price of the requests of a model.
+type Price struct {
+	// Chat is the price of a chat request.
+	Chat float64 `json:"chat"`
+	// Upload is the price of an upload request.
+	Upload float64 `json:"upload"`
+}
+
+// Prices is the price table keyed by model. the "default" entry prices the models missing from it.
+type Prices map[string]*Price
+
+// Of returns the price of the model, nil if it has none.
+func (p Prices) Of(model string) *Price {
+	if price, ok := p[model]; ok {
+		return price
+	}
+	return p[defaultPrice]
+}
+
+// loadPrices loads the price table from the json file, nil if file is empty.
+func loadPrices(file string) (Prices, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var prices Prices
+	if err := json.Unmarshal(raw, &prices); err != nil {
+		return nil, fmt.Errorf("price_table: %w", err)
+	}
+	for model, price := range prices {
+		if price == nil || price.Chat < 0 || price.Upload < 0 {
+			return nil, fmt.Errorf("price_table: price of %s must not be negative", model)
+		}
+	}
+	return prices, nil
+}
+
+// Estimate is the forecast of the requests, cost and duration of a run.
+type Estimate struct {
+	Model    string        // Model is the model of the chats.
+	Chats    int           // Chats is the number of chat requests.
+	Uploads  int           // Uploads is the number of uploads.
+	Cost     float64       // Cost is the estimated cost, 0 without a price.
+	Priced   bool          // Priced reports whether the model has a price.
+	Duration time.Duration // Duration is the estimated wall-clock time.
+}
+
+// estimate returns the forecast of the inspected items.
+func estimate(ret *Inspection, config *Option, prices Prices) *Estimate {
+	est := &Estimate{
+		Model:    config.Model,
+		Chats:    ret.Requests,
+		Uploads:  ret.Uploads,
+		Duration: ret.Duration,
+	}
+
+	if price := prices.Of(config.Model); price != nil {
+		est.Priced = true
+		est.Cost = float64(est.Chats)*price.Chat + float64(est.Uploads)*price.Upload
+	}
+	return est
+}
+
+// logEstimate logs the estimate.
+func logEstimate(logger gpt4batch.Logger, est *Estimate) {
+	logger.
+		WithField("model", est.Model).
+		WithField("chats", est.Chats).
+		WithField("uploads", est.Uploads).
+		WithField("cost", fmt.Sprintf("%.4f", est.Cost)).
+		WithField("priced", est.Priced).
+		WithField("duration", est.Duration.String()).
+		Info("Estimate")
+}
+
+// checkBudget fails if the estimated cost exceeds the max budget.
+func checkBudget(config *Option, est *Estimate) error {
+	if config.MaxBudget <= 0 {
+		return nil
+	}
+	if !est.Priced {
+		return fmt.Errorf("model %s has no price in the price table", est.Model)
+	}
+	if est.Cost > config.MaxBudget {
+		return fmt.Errorf("estimated cost %.4f exceeds max_budget %.4f", est.Cost, config.MaxBudget)
+	}
+	return nil
+}
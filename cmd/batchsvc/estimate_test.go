@@ -0,0 +1,72 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+)
+
+func Test_loadPrices(t *testing.T) {
+	prices, err := loadPrices("")
+	assert.NoError(t, err)
+	assert.Nil(t, prices)
+	assert.Nil(t, prices.Of("gpt-4"))
+
+	file := filepath.Join(t.TempDir(), "prices.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"gpt-4": {"chat": 0.1, "upload": 0.02}, "default": {"chat": 0.05}}`), 0644))
+	prices, err = loadPrices(file)
+	assert.NoError(t, err)
+	assert.Equal(t, &Price{Chat: 0.1, Upload: 0.02}, prices.Of("gpt-4"))
+	assert.Equal(t, &Price{Chat: 0.05}, prices.Of("gpt-4-gizmo"))
+
+	assert.NoError(t, os.WriteFile(file, []byte(`{"gpt-4": {"chat": -1}}`), 0644))
+	_, err = loadPrices(file)
+	assert.Error(t, err)
+}
+
+func Test_estimate(t *testing.T) {
+	ins := gpt4batch.Ins{
+		{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "q"}, {ID: "a1", Content: "q"}}},
+		{ID: "2", Asks: gpt4batch.Asks{{ID: "a0", Content: "q"}}, IErr: &gpt4batch.IErr{Kind: gpt4batch.ErrKindTimeout}},
+		{ID: "3", Asks: gpt4batch.Asks{{ID: "a0", Content: "q"}}, IErr: &gpt4batch.IErr{Kind: gpt4batch.ErrKindQuota}},
+	}
+	prices := Prices{"gpt-4": {Chat: 0.5, Upload: 0.1}}
+
+	// every item runs, the goroutine bounds the duration.
+	config := &Option{Model: "gpt-4", Goroutine: 4, QPS: 1}
+	est := estimate(Inspect(ins, "", config), config, prices)
+	assert.Equal(t, &Estimate{Model: "gpt-4", Chats: 4, Cost: 2, Priced: true, Duration: 30 * time.Second}, est)
+
+	// in fix mode only the selected failed item runs.
+	config = &Option{Model: "gpt-4", Goroutine: 4, Fix: true, RerunKinds: []string{"quota"}}
+	est = estimate(Inspect(ins, "", config), config, prices)
+	assert.Equal(t, 1, est.Chats)
+	assert.Equal(t, 0.5, est.Cost)
+	assert.Equal(t, 30*time.Second/4, est.Duration)
+
+	// the budget is checked against the estimate.
+	assert.NoError(t, checkBudget(&Option{}, est))
+	assert.NoError(t, checkBudget(&Option{MaxBudget: 0.5}, est))
+	assert.EqualError(t, checkBudget(&Option{MaxBudget: 0.4}, est), "estimated cost 0.5000 exceeds max_budget 0.4000")
+	assert.Error(t, checkBudget(&Option{MaxBudget: 1}, estimate(Inspect(ins, "", config), &Option{Model: "gpt-3"}, prices)))
+}
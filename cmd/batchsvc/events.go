@@ -0,0 +1,105 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
+	"gitlab.com/gpt4batch/runner"
+)
+
+// eventEncodingLegacy publishes the answers in the envelope of client.WithNSQ
+// instead of the events, for the consumers of the format before the events.
+const eventEncodingLegacy = "legacy"
+
+// WithEmitter sets the emitter the events of the run are published with.
+func (s *service) WithEmitter(e *event.Emitter) {
+	s.events = e
+}
+
+// itemEvent returns the event of the item. the error of the item is set for
+// item.completed.
+func (s *service) itemEvent(typ event.Type, in *gpt4batch.In, attempt int) *event.Event {
+	ev := &event.Event{
+		Type:    typ,
+		InID:    in.ID,
+		Model:   s.config.Model,
+		GizmoID: s.config.GizmoId,
+		Attempt: attempt,
+		Extra:   in.Extra,
+	}
+	if typ == event.TypeItemCompleted {
+		ev.Error = in.IErr
+	}
+	return ev
+}
+
+// itemStarted publishes the item.started event of the item.
+func (s *service) itemStarted(ctx context.Context, in *gpt4batch.In, attempt int) {
+	s.events.Emit(ctx, s.itemEvent(event.TypeItemStarted, in, attempt))
+}
+
+// answered publishes the event of an ask answered or failed.
+func (s *service) answered(ctx context.Context, a *runner.Answer) {
+	if s.events == nil {
+		return
+	}
+
+	typ := event.TypeAskCompleted
+	if a.Err != nil {
+		typ = event.TypeAskFailed
+	}
+	ev := s.itemEvent(typ, a.In, a.Attempt).Timing(a.Started, a.Finished)
+	ev.AskID = a.Ask.ID
+	ev.BranchID = a.Branch
+	ev.Ask = a.Content
+	ev.Images = a.Ask.Images
+	ev.Files = a.Ask.Files
+	ev.Answer = a.Resp
+	if a.Err != nil {
+		ev.Error = runner.NewIErr(a.Err, ev.Attempt)
+	}
+	s.events.Emit(ctx, ev)
+}
+
+// itemDone publishes the item.completed event of the item and runs its hooks.
+func (s *service) itemDone(ctx context.Context, r *runner.Result) {
+	s.events.Emit(ctx, s.itemEvent(event.TypeItemCompleted, r.In, r.Attempt).Timing(r.Started, r.Finished))
+	s.afterItem(ctx, r.In)
+}
+
+// finish publishes the run.finished event and closes the emitter, once.
+func (s *service) finish(ctx context.Context) error {
+	s.finishOnce.Do(func() {
+		s.events.Emit(ctx, &event.Event{
+			Type:    event.TypeRunFinished,
+			Model:   s.config.Model,
+			GizmoID: s.config.GizmoId,
+			Stats: &event.Stats{
+				Total:     s.stats.GetBatchTotal(),
+				Completed: s.stats.GetCompleteTotal(),
+				Succeeded: s.stats.GetSuccessTotal(),
+				Failed:    s.stats.GetFailedTotal(),
+				Skipped:   s.stats.GetSkippedTotal(),
+			},
+		})
+		s.finishErr = s.events.Close(ctx)
+	})
+	return s.finishErr
+}
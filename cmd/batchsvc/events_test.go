@@ -0,0 +1,125 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/event"
+	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+// emitted decodes the events published to the events topic.
+func emitted(t *testing.T, sink *memProducer) []*event.Event {
+	events := make([]*event.Event, 0)
+	for _, msg := range sink.msgs["events"] {
+		ev := new(event.Event)
+		assert.NoError(t, json.Unmarshal(msg, ev))
+		events = append(events, ev)
+	}
+	return events
+}
+
+func types(events []*event.Event) []event.Type {
+	typs := make([]event.Type, 0, len(events))
+	for _, ev := range events {
+		typs = append(typs, ev.Type)
+	}
+	return typs
+}
+
+func Test_service_events(t *testing.T) {
+	config := &Option{WorkerResultsTopic: "results", WorkerMaxAttempts: 3, Model: "gpt-4-gizmo", GizmoId: "g-1"}
+	job := []byte(`{"id": "1", "asks": [{"id": "a0", "content": "q0"}, {"id": "a1", "content": "q1"}], "extra": {"tag": "x"}}`)
+	all, _ := event.ParseTypes(nil)
+
+	// a successful item.
+	sink := new(memProducer)
+	w := newWorker(config, &recordClient{Client: client.NewNoop()}, new(memProducer), log.New(log.InfoLevel))
+	w.svc.WithEmitter(event.NewEmitter(sink, "events", event.EncodingJSON, all, log.New(log.InfoLevel)))
+	assert.NoError(t, w.handle(context.Background(), &nsq.Message{Body: job, Attempts: 1}))
+
+	events := emitted(t, sink)
+	assert.Equal(t, []event.Type{event.TypeItemStarted, event.TypeAskCompleted, event.TypeAskCompleted, event.TypeItemCompleted}, types(events))
+	for _, ev := range events {
+		assert.Equal(t, event.Version, ev.Version)
+		assert.Equal(t, "1", ev.InID)
+		assert.Equal(t, "gpt-4-gizmo", ev.Model)
+		assert.Equal(t, "g-1", ev.GizmoID)
+		assert.Equal(t, 1, ev.Attempt)
+		assert.Equal(t, map[string]interface{}{"tag": "x"}, ev.Extra)
+	}
+	assert.Equal(t, "a1", events[2].AskID)
+	assert.Equal(t, "q1", events[2].Ask)
+	assert.Equal(t, "m2", events[2].Answer.MessageID)
+	assert.Nil(t, events[3].Error)
+
+	// a failed item is retried, each attempt publishes its failure.
+	sink = new(memProducer)
+	w = newWorker(config, failClient{Client: client.NewNoop(), err: errors.New("boom")}, new(memProducer), log.New(log.InfoLevel))
+	w.svc.WithEmitter(event.NewEmitter(sink, "events", event.EncodingJSON, all, log.New(log.InfoLevel)))
+	assert.Error(t, w.handle(context.Background(), &nsq.Message{Body: job, Attempts: 2}))
+	assert.NoError(t, w.handle(context.Background(), &nsq.Message{Body: job, Attempts: 3}))
+	assert.NoError(t, w.svc.finish(context.Background()))
+	// the service is closed twice once every item is completed.
+	assert.NoError(t, w.svc.finish(context.Background()))
+
+	events = emitted(t, sink)
+	assert.Equal(t, []event.Type{
+		event.TypeItemStarted, event.TypeAskFailed,
+		event.TypeItemStarted, event.TypeAskFailed, event.TypeItemCompleted,
+		event.TypeRunFinished,
+	}, types(events))
+	assert.Equal(t, 2, events[1].Attempt)
+	assert.Equal(t, "a0", events[1].AskID)
+	assert.Equal(t, gpt4batch.ErrKindChat, events[1].Error.Kind)
+	assert.Equal(t, "boom", events[4].Error.Message)
+	assert.Equal(t, 3, events[4].Attempt)
+	assert.Equal(t, &event.Stats{Completed: 1, Failed: 1}, events[5].Stats)
+}
+
+func Test_newEmitter(t *testing.T) {
+	sink := new(memProducer)
+	assert.NotNil(t, newEmitter(log.New(log.InfoLevel), &Option{EventEncoding: "json"}, sink))
+	assert.Nil(t, newEmitter(log.New(log.InfoLevel), &Option{EventEncoding: "json"}, nil))
+	// the answers are published by the client in the envelope before the events.
+	assert.Nil(t, newEmitter(log.New(log.InfoLevel), &Option{EventEncoding: eventEncodingLegacy}, sink))
+}
+
+func TestOption_Validate_legacySqlite(t *testing.T) {
+	option := &Option{URL: "http://localhost", In: "in.jsonl", Out: "out.jsonl", DryRun: true, Sinks: []string{"sqlite://./results.db"}}
+	assert.NoError(t, option.Validate())
+
+	// the sqlite sink records events, none is published with the legacy encoding.
+	option.EventEncoding = eventEncodingLegacy
+	assert.EqualError(t, option.Validate(), "sink sqlite:// does not support event_encoding legacy")
+}
+
+func Test_sinkOutbox(t *testing.T) {
+	// the outbox of a sink does not depend on its position.
+	kafka := sinkOutbox("out.jsonl", "kafka://localhost:9092")
+	assert.Equal(t, kafka, sinkOutbox("out.jsonl", "kafka://localhost:9092"))
+	assert.NotEqual(t, kafka, sinkOutbox("out.jsonl", "redis://localhost:6379"))
+	assert.Regexp(t, `^out\.jsonl\.sink-[0-9a-f]{16}-outbox\.jsonl$`, kafka)
+}
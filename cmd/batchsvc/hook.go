@@ -0,0 +1,281 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/runner"
+)
+
+// hookSkipCode is the exit code of a before item hook skipping the item.
+const hookSkipCode = 3
+
+// hookWaitDelay is how long a hook may keep its output open after it is killed.
+const hookWaitDelay = time.Second
+
+// The hook points.
+const (
+	hookBeforeRun  = "before_run"
+	hookBeforeItem = "before_item"
+	hookAfterItem  = "after_item"
+	hookOnFailure  = "on_failure"
+	hookAfterRun   = "after_run"
+)
+
+// hooked reports whether a hook command is configured.
+func (o *Option) hooked() bool {
+	return o.HookBeforeRun != "" || o.HookBeforeItem != "" || o.HookAfterItem != "" ||
+		o.HookOnFailure != "" || o.HookAfterRun != ""
+}
+
+// hooks runs the commands of the hook points of a run with `sh -c`. the item
+// or the run is written to the stdin of the command as json, and described
+// by GPT4BATCH_* environment variables.
+type hooks struct {
+	config *Option
+	// afterRunOnce makes the after run hook run once.
+	afterRunOnce sync.Once
+}
+
+// newHooks returns the hooks of the option, nil if none is configured.
+func newHooks(config *Option) *hooks {
+	if !config.hooked() {
+		return nil
+	}
+	return &hooks{config: config}
+}
+
+// runInfo is the run written to the run hooks.
+type runInfo struct {
+	In       string `json:"in"`
+	Out      string `json:"out"`
+	Model    string `json:"model"`
+	GizmoID  string `json:"gizmo_id"`
+	Total    uint64 `json:"total"`
+	Complete uint64 `json:"complete"`
+	Success  uint64 `json:"success"`
+	Failed   uint64 `json:"failed"`
+	Skipped  uint64 `json:"skipped"`
+}
+
+// env returns the environment variables of the run.
+func (r *runInfo) env() []string {
+	return []string{
+		"GPT4BATCH_TOTAL=" + strconv.FormatUint(r.Total, 10),
+		"GPT4BATCH_COMPLETE=" + strconv.FormatUint(r.Complete, 10),
+		"GPT4BATCH_SUCCESS=" + strconv.FormatUint(r.Success, 10),
+		"GPT4BATCH_FAILED=" + strconv.FormatUint(r.Failed, 10),
+		"GPT4BATCH_SKIPPED=" + strconv.FormatUint(r.Skipped, 10),
+	}
+}
+
+// itemEnv returns the environment variables of the item.
+func itemEnv(in *gpt4batch.In) []string {
+	env := []string{
+		"GPT4BATCH_ITEM_ID=" + in.ID,
+		"GPT4BATCH_ATTEMPTS=" + strconv.Itoa(runner.Attempts(in)),
+		"GPT4BATCH_ITEM_FAILED=" + strconv.FormatBool(failed(in)),
+	}
+	if in.IErr != nil {
+		env = append(env,
+			"GPT4BATCH_ERROR_KIND="+string(in.IErr.Kind),
+			"GPT4BATCH_ERROR="+in.IErr.Message,
+		)
+	}
+	return env
+}
+
+// beforeRun runs the before run hook.
+func (h *hooks) beforeRun(ctx context.Context, info *runInfo) error {
+	if h == nil || h.config.HookBeforeRun == "" {
+		return nil
+	}
+	_, err := h.exec(ctx, hookBeforeRun, h.config.HookBeforeRun, info, info.env())
+	return err
+}
+
+// beforeItem runs the before item hook. the item is replaced by the json
+// object the hook writes to stdout, if any. the fields missing from the object
+// are kept. skip is true if the hook exits with hookSkipCode.
+func (h *hooks) beforeItem(ctx context.Context, in *gpt4batch.In) (skip bool, err error) {
+	if h == nil || h.config.HookBeforeItem == "" {
+		return false, nil
+	}
+
+	out, err := h.exec(ctx, hookBeforeItem, h.config.HookBeforeItem, in, itemEnv(in))
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == hookSkipCode {
+		return true, nil
+	}
+	if err != nil || len(bytes.TrimSpace(out)) == 0 {
+		return false, err
+	}
+
+	// decode the output over a copy of the item so that a bad output leaves it untouched.
+	body, err := json.Marshal(in)
+	if err != nil {
+		return false, err
+	}
+	modified := new(gpt4batch.In)
+	if err = json.Unmarshal(body, modified); err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(out, modified); err != nil {
+		return false, fmt.Errorf("hook %s: invalid item: %w", hookBeforeItem, err)
+	}
+	if modified.ID != in.ID {
+		return false, fmt.Errorf("hook %s: the id of item %s must not change", hookBeforeItem, in.ID)
+	}
+	// the dependencies are resolved before the hook runs.
+	if !equalStrings(modified.DependsOn, in.DependsOn) {
+		return false, fmt.Errorf("hook %s: the depends_on of item %s must not change", hookBeforeItem, in.ID)
+	}
+	*in = *modified
+	return false, nil
+}
+
+// failed reports whether the completed item failed. a skipped item did not.
+func failed(in *gpt4batch.In) bool {
+	return in.IErr != nil && in.IErr.Kind != gpt4batch.ErrKindSkipped
+}
+
+// equalStrings reports whether a and b hold the same strings in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// afterItem runs the after item hook of a completed item, and the on failure
+// hook if it failed.
+func (h *hooks) afterItem(ctx context.Context, in *gpt4batch.In) error {
+	if h == nil {
+		return nil
+	}
+
+	var errs []error
+	if h.config.HookAfterItem != "" {
+		if _, err := h.exec(ctx, hookAfterItem, h.config.HookAfterItem, in, itemEnv(in)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if failed(in) && h.config.HookOnFailure != "" {
+		if _, err := h.exec(ctx, hookOnFailure, h.config.HookOnFailure, in, itemEnv(in)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// afterRun runs the after run hook, once.
+func (h *hooks) afterRun(ctx context.Context, info *runInfo) error {
+	if h == nil || h.config.HookAfterRun == "" {
+		return nil
+	}
+
+	var err error
+	h.afterRunOnce.Do(func() {
+		_, err = h.exec(ctx, hookAfterRun, h.config.HookAfterRun, info, info.env())
+	})
+	return err
+}
+
+// exec runs the command of the hook point with v written to its stdin as json,
+// and returns its stdout. the command is killed after HookTimeout.
+func (h *hooks) exec(ctx context.Context, point, command string, v interface{}, env []string) ([]byte, error) {
+	cfg := jsoniter.Config{
+		EscapeHTML: false,
+	}.Froze()
+
+	body, err := cfg.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.config.HookTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = hookWaitDelay
+	cmd.Env = append(os.Environ(),
+		"GPT4BATCH_HOOK="+point,
+		"GPT4BATCH_IN="+h.config.In,
+		"GPT4BATCH_OUT="+h.config.Out,
+		"GPT4BATCH_MODEL="+h.config.Model,
+		"GPT4BATCH_GIZMO_ID="+h.config.GizmoId,
+	)
+	cmd.Env = append(cmd.Env, env...)
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("hook %s: timed out after %s", point, h.config.HookTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("hook %s: %w: %s", point, err, msg)
+		}
+		return nil, fmt.Errorf("hook %s: %w", point, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// runInfo returns the run written to the run hooks.
+func (s *service) runInfo() *runInfo {
+	return &runInfo{
+		In:       s.config.In,
+		Out:      s.config.Out,
+		Model:    s.config.Model,
+		GizmoID:  s.config.GizmoId,
+		Total:    s.stats.GetBatchTotal(),
+		Complete: s.stats.GetCompleteTotal(),
+		Success:  s.stats.GetSuccessTotal(),
+		Failed:   s.stats.GetFailedTotal(),
+		Skipped:  s.stats.GetSkippedTotal(),
+	}
+}
+
+// afterItem runs the hooks of the completed item. the errors of the hooks are logged.
+func (s *service) afterItem(ctx context.Context, in *gpt4batch.In) {
+	if err := s.hooks.afterItem(ctx, in); err != nil {
+		s.logger.
+			WithField("id", in.ID).
+			Warn(err)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+func Test_hooks_beforeItem(t *testing.T) {
+	newItem := func() *gpt4batch.In {
+		return &gpt4batch.In{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "hello"}}}
+	}
+	hook := func(command string) *hooks {
+		return newHooks(&Option{HookBeforeItem: command, HookTimeout: time.Second})
+	}
+
+	// no output leaves the item untouched.
+	item := newItem()
+	skip, err := hook("cat > /dev/null").beforeItem(context.Background(), item)
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.Equal(t, "hello", item.Asks[0].Content)
+
+	// the output overrides the fields of the item.
+	skip, err = hook(`echo '{"asks":[{"id":"a0","content":"hi"}]}'`).beforeItem(context.Background(), item)
+	assert.NoError(t, err)
+	assert.False(t, skip)
+	assert.Equal(t, "1", item.ID)
+	assert.Equal(t, "hi", item.Asks[0].Content)
+
+	// hookSkipCode skips the item.
+	skip, err = hook(`[ "$GPT4BATCH_ITEM_ID" = 1 ] && exit 3`).beforeItem(context.Background(), newItem())
+	assert.NoError(t, err)
+	assert.True(t, skip)
+
+	// the id must not change.
+	item = newItem()
+	_, err = hook(`echo '{"id":"2","asks":[]}'`).beforeItem(context.Background(), item)
+	assert.Error(t, err)
+	assert.Equal(t, "hello", item.Asks[0].Content)
+
+	// the dependencies must not change either.
+	_, err = hook(`echo '{"depends_on":["0"]}'`).beforeItem(context.Background(), newItem())
+	assert.ErrorContains(t, err, "depends_on")
+
+	_, err = hook("echo oops >&2; exit 1").beforeItem(context.Background(), newItem())
+	assert.ErrorContains(t, err, "oops")
+
+	_, err = hook("sleep 5").beforeItem(context.Background(), newItem())
+	assert.ErrorContains(t, err, "timed out")
+}
+
+func Test_hooks_afterItem(t *testing.T) {
+	dir := t.TempDir()
+	h := newHooks(&Option{
+		Model:         "gpt-4-gizmo",
+		HookAfterItem: `cat > "` + filepath.Join(dir, "after") + `"`,
+		HookOnFailure: `echo "$GPT4BATCH_HOOK $GPT4BATCH_MODEL $GPT4BATCH_ITEM_FAILED $GPT4BATCH_ERROR_KIND" > "` + filepath.Join(dir, "failure") + `"`,
+		HookTimeout:   time.Second,
+	})
+
+	item := &gpt4batch.In{ID: "1", IErr: &gpt4batch.IErr{Kind: gpt4batch.ErrKindChat}}
+	assert.NoError(t, h.afterItem(context.Background(), item))
+
+	after, err := os.ReadFile(filepath.Join(dir, "after"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(after), `"id":"1"`)
+	failure, err := os.ReadFile(filepath.Join(dir, "failure"))
+	assert.NoError(t, err)
+	assert.Equal(t, "on_failure gpt-4-gizmo true chat\n", string(failure))
+}
+
+func Test_hooks_run(t *testing.T) {
+	h := newHooks(&Option{HookBeforeRun: `[ "$GPT4BATCH_TOTAL" = 2 ]`, HookAfterRun: "exit 1", HookTimeout: time.Second})
+	assert.NoError(t, h.beforeRun(context.Background(), &runInfo{Total: 2}))
+	assert.Error(t, h.beforeRun(context.Background(), &runInfo{Total: 1}))
+
+	// the after run hook runs once.
+	assert.Error(t, h.afterRun(context.Background(), &runInfo{}))
+	assert.NoError(t, h.afterRun(context.Background(), &runInfo{}))
+
+	assert.Nil(t, newHooks(&Option{}))
+}
+
+func Test_dagSource_skip(t *testing.T) {
+	dir := t.TempDir()
+	option := &Option{
+		HookBeforeItem: `[ "$GPT4BATCH_ITEM_ID" = skip ] && exit 3; exit 0`,
+		HookAfterItem:  `cat >> "` + filepath.Join(dir, "after") + `"`,
+		HookOnFailure:  `cat >> "` + filepath.Join(dir, "failure") + `"`,
+		HookTimeout:    time.Second,
+	}
+	pending := &gpt4batch.IErr{Message: "resource is not ready", Kind: gpt4batch.ErrKindPending}
+	skip := &gpt4batch.In{ID: "skip", IErr: pending}
+	dependent := &gpt4batch.In{ID: "dependent", DependsOn: []string{"skip"}, IErr: pending}
+	items := gpt4batch.Ins{skip, dependent}
+
+	svc := newTestService(option, client.NewNoop(), items)
+	// keep the service from completing, which closes it.
+	svc.stats.BatchTotal++
+	src := &dagSource{svc: svc, dag: newDAG(items, []bool{true, true}), started: make(map[*gpt4batch.In]struct{})}
+	_, err := src.Next(context.Background())
+	assert.ErrorIs(t, err, io.EOF)
+
+	// the skipped item is counted as skipped and its dependents fail.
+	assert.Equal(t, gpt4batch.ErrKindSkipped, skip.IErr.Kind)
+	assert.Equal(t, gpt4batch.ErrKindDependency, dependent.IErr.Kind)
+	assert.Equal(t, uint64(1), svc.stats.GetSkippedTotal())
+	assert.Equal(t, uint64(1), svc.stats.GetFailedTotal())
+	assert.Equal(t, uint64(2), svc.stats.GetCompleteTotal())
+
+	// on_failure only runs for the dependent.
+	failure, err := os.ReadFile(filepath.Join(dir, "failure"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(failure), `"id":"skip"`)
+	assert.Contains(t, string(failure), `"id":"dependent"`)
+	after, err := os.ReadFile(filepath.Join(dir, "after"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(after), `"id":"skip"`)
+}
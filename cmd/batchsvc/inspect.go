@@ -0,0 +1,234 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/gpt4batch"
+)
+
+const (
+	// maxImageSize is the max size of an image upload.
+	maxImageSize = 20 << 20
+	// maxFileSize is the max size of a file upload.
+	maxFileSize = 512 << 20
+	// chatLatency is the assumed latency of a chat request.
+	chatLatency = 30 * time.Second
+	// uploadLatency is the assumed latency of an upload request.
+	uploadLatency = 5 * time.Second
+)
+
+// imageTypes is the mime types an image upload may have.
+var imageTypes = map[string]struct{}{
+	"image/png":  {},
+	"image/jpeg": {},
+	"image/gif":  {},
+	"image/webp": {},
+}
+
+// Inspection is the result of inspecting the items before a run.
+type Inspection struct {
+	Items       int           // Items is the number of items that will run.
+	Requests    int           // Requests is the number of chat requests.
+	Uploads     int           // Uploads is the number of uploads.
+	UploadBytes int64         // UploadBytes is the total size of the uploads.
+	Duration    time.Duration // Duration is the estimated duration of the run.
+	Problems    []string      // Problems is the problems found in the items.
+}
+
+// dryRun logs the problems, the summary and the estimate of the inspected
+// items, and fails if the items have a problem or exceed the budget.
+func dryRun(logger gpt4batch.Logger, config *Option, ret *Inspection, est *Estimate) error {
+	for _, p := range ret.Problems {
+		logger.Warn(p)
+	}
+
+	logger.
+		WithField("items", ret.Items).
+		WithField("requests", ret.Requests).
+		WithField("uploads", ret.Uploads).
+		WithField("upload_bytes", ret.UploadBytes).
+		WithField("duration", ret.Duration.String()).
+		WithField("problems", len(ret.Problems)).
+		Info("Dry Run")
+	logEstimate(logger, est)
+
+	if len(ret.Problems) != 0 {
+		return fmt.Errorf("input has %d problems", len(ret.Problems))
+	}
+	return checkBudget(config, est)
+}
+
+// Inspect checks every item without sending anything. files and images are
+// resolved relative to dir. in fix mode only the items selected to rerun are
+// counted, all of their asks included.
+func Inspect(ins gpt4batch.Ins, dir string, config *Option) *Inspection {
+	var (
+		ret = new(Inspection)
+		ids = make(map[string]int, len(ins))
+		// sel is checked by Validate.
+		sel, _ = newSelector(config)
+	)
+
+	problem := func(format string, args ...interface{}) {
+		ret.Problems = append(ret.Problems, fmt.Sprintf(format, args...))
+	}
+
+	// check checks the asks of the item or a branch of it.
+	check := func(where string, asks gpt4batch.Asks, askIDs map[string]struct{}, counted bool) {
+		for idx, ask := range asks {
+			at := fmt.Sprintf("%s ask %d", where, idx)
+			if ask.ID == "" {
+				problem("%s: ask id is empty", at)
+			} else if _, ok := askIDs[ask.ID]; ok {
+				problem("%s: duplicate ask id %q", at, ask.ID)
+			} else {
+				askIDs[ask.ID] = struct{}{}
+			}
+
+			if strings.TrimSpace(ask.Content) == "" {
+				problem("%s: content is empty", at)
+			}
+
+			for _, image := range ask.Images {
+				size, err := inspectFile(filepath.Join(dir, image), maxImageSize, true)
+				if err != nil {
+					problem("%s: image %s: %v", at, image, err)
+				}
+				if counted {
+					ret.Uploads++
+					ret.UploadBytes += size
+				}
+			}
+			for _, file := range ask.Files {
+				size, err := inspectFile(filepath.Join(dir, file), maxFileSize, false)
+				if err != nil {
+					problem("%s: file %s: %v", at, file, err)
+				}
+				if counted {
+					ret.Uploads++
+					ret.UploadBytes += size
+				}
+			}
+
+			if counted {
+				ret.Requests++
+			}
+		}
+	}
+
+	for line, in := range ins {
+		where := fmt.Sprintf("line %d (id %q)", line+1, in.ID)
+		if in.ID == "" {
+			problem("line %d: id is empty", line+1)
+		} else if first, ok := ids[in.ID]; ok {
+			problem("%s: duplicate id, first seen on line %d", where, first)
+		} else {
+			ids[in.ID] = line + 1
+		}
+
+		if len(in.Asks) == 0 && len(in.Branches) == 0 {
+			problem("%s: asks is empty", where)
+		}
+
+		counted := !config.Fix || sel.rerun(in, new(plan))
+		if counted {
+			ret.Items++
+		}
+
+		// the asks of a branch continue the shared prefix, so their ids must
+		// differ from the prefix but may repeat across branches.
+		prefix := make(map[string]struct{}, len(in.Asks))
+		check(where, in.Asks, prefix, counted)
+		for _, b := range in.Branches {
+			askIDs := make(map[string]struct{}, len(prefix)+len(b.Asks))
+			for id := range prefix {
+				askIDs[id] = struct{}{}
+			}
+			check(fmt.Sprintf("%s branch %q", where, b.ID), b.Asks, askIDs, counted)
+		}
+	}
+
+	if err := CheckDependencies(ins); err != nil {
+		problem("%v", err)
+	}
+
+	// the requests run goroutine at a time, and no faster than qps per second.
+	goroutine := config.Goroutine
+	if goroutine <= 0 {
+		goroutine = ret.Items
+	}
+	if goroutine > 0 {
+		ret.Duration = (time.Duration(ret.Requests)*chatLatency + time.Duration(ret.Uploads)*uploadLatency) / time.Duration(goroutine)
+	}
+	if config.QPS > 0 {
+		if d := time.Duration(ret.Requests+ret.Uploads) * time.Second / time.Duration(config.QPS); d > ret.Duration {
+			ret.Duration = d
+		}
+	}
+	return ret
+}
+
+// inspectFile returns the size of the file at path and checks that it is a
+// readable regular file within max bytes. images must have an image mime type.
+func inspectFile(path string, max int64, image bool) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, fmt.Errorf("not a regular file")
+	}
+	if fi.Size() == 0 {
+		return 0, fmt.Errorf("file is empty")
+	}
+	if fi.Size() > max {
+		return 0, fmt.Errorf("size %d exceeds the limit of %d bytes", fi.Size(), max)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if image {
+		if mime := http.DetectContentType(head[:n]); !imageType(mime) {
+			return 0, fmt.Errorf("unsupported image type %s", mime)
+		}
+	}
+
+	return fi.Size(), nil
+}
+
+// imageType reports whether the mime type is a supported image type.
+func imageType(mime string) bool {
+	_, ok := imageTypes[mime]
+	return ok
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+)
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.png"), png, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("hello"), 0644))
+
+	ins := gpt4batch.Ins{
+		{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "q", Images: []string{"a.png"}, Files: []string{"b.txt"}}}},
+		{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: " "}, {ID: "a0", Content: "q"}}},
+		{ID: "2", Asks: gpt4batch.Asks{{ID: "a0", Content: "q", Images: []string{"b.txt", "missing.png"}}}},
+		{ID: "3", Asks: gpt4batch.Asks{{ID: "a0", Content: "q"}}, Branches: gpt4batch.Branches{
+			{ID: "x", Asks: gpt4batch.Asks{{ID: "b0", Content: "q"}}},
+			{ID: "y", Asks: gpt4batch.Asks{{ID: "a0", Content: "q"}}},
+		}},
+	}
+
+	ret := Inspect(ins, dir, &Option{Goroutine: 2})
+	assert.Equal(t, 4, ret.Items)
+	assert.Equal(t, 7, ret.Requests)
+	assert.Equal(t, 4, ret.Uploads)
+	assert.Equal(t, int64(len(png)+5), ret.UploadBytes)
+	assert.Equal(t, (7*chatLatency+4*uploadLatency)/2, ret.Duration)
+	assert.Len(t, ret.Problems, 6)
+	assert.Equal(t, `line 2 (id "1"): duplicate id, first seen on line 1`, ret.Problems[0])
+	assert.Equal(t, `line 2 (id "1") ask 0: content is empty`, ret.Problems[1])
+	assert.Equal(t, `line 2 (id "1") ask 1: duplicate ask id "a0"`, ret.Problems[2])
+	assert.Contains(t, ret.Problems[3], "image b.txt: unsupported image type text/plain")
+	assert.Contains(t, ret.Problems[4], "image missing.png")
+	assert.Equal(t, `line 4 (id "3") branch "y" ask 0: duplicate ask id "a0"`, ret.Problems[5])
+
+	// in fix mode only the failed items are counted.
+	ins = gpt4batch.Ins{
+		{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "q"}}},
+		{ID: "2", Asks: gpt4batch.Asks{{ID: "a0", Content: "q"}}, IErr: &gpt4batch.IErr{Message: "x"}},
+	}
+	ret = Inspect(ins, dir, &Option{Fix: true})
+	assert.Equal(t, 1, ret.Items)
+	assert.Equal(t, 1, ret.Requests)
+	assert.Equal(t, chatLatency, ret.Duration)
+	assert.Empty(t, ret.Problems)
+}
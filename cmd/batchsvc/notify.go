@@ -0,0 +1,107 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
+	"gitlab.com/gpt4batch/webhook"
+)
+
+// newNotifier returns the notifier posting the notifications of the run to
+// the webhooks, nil if none is set or the run is dry.
+func newNotifier(logger gpt4batch.Logger, option *Option) *webhook.Notifier {
+	if len(option.Webhooks) == 0 || option.DryRun {
+		return nil
+	}
+
+	// the template and the types have been checked by Option.Validate.
+	config := webhook.Config{
+		URLs:    option.Webhooks,
+		Secret:  option.WebhookSecret,
+		Retries: option.WebhookRetries,
+		Timeout: option.WebhookTimeout,
+	}
+	if option.WebhookTemplate != "" {
+		config.Template, _ = webhook.ParseTemplate(option.WebhookTemplate)
+	}
+	config.Types, _ = webhook.ParseTypes(option.WebhookEvents)
+	return webhook.NewNotifier(config, logger)
+}
+
+// notify posts the notification of the run. stats may be nil before the
+// items are read, the counts are 0 then. a failed notification is logged and
+// does not fail the run.
+func notify(ctx context.Context, n *webhook.Notifier, logger gpt4batch.Logger, option *Option, stats *Stats, typ webhook.Type, err error) {
+	no := &webhook.Notification{
+		Type:    typ,
+		Model:   option.Model,
+		GizmoID: option.GizmoId,
+		In:      option.In,
+		Out:     option.Out,
+		Stats:   new(event.Stats),
+	}
+	if stats != nil {
+		no.Stats.Total = stats.GetBatchTotal()
+		no.Stats.Completed = stats.GetCompleteTotal()
+		no.Stats.Succeeded = stats.GetSuccessTotal()
+		no.Stats.Failed = stats.GetFailedTotal()
+		no.Stats.Skipped = stats.GetSkippedTotal()
+	}
+	if err != nil {
+		no.Error = err.Error()
+	}
+
+	if err := n.Notify(ctx, no); err != nil {
+		logger.Warn("Notify: ", err)
+	}
+}
+
+// WithNotifier sets the notifier the notifications of the run are posted with.
+func (s *service) WithNotifier(n *webhook.Notifier) {
+	s.notifier = n
+}
+
+// notify posts the notification of the run.
+func (s *service) notify(ctx context.Context, typ webhook.Type) {
+	notify(ctx, s.notifier, s.logger, s.config, s.stats, typ, nil)
+}
+
+// progress posts the progress of the run every WebhookInterval until ctx is
+// done or the service is closed.
+func (s *service) progress(ctx context.Context) {
+	if s.notifier == nil || s.config.WebhookInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(s.config.WebhookInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.closed:
+			return
+		case <-t.C:
+			s.notify(ctx, webhook.TypeRunProgress)
+		}
+	}
+}
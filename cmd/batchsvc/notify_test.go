@@ -0,0 +1,95 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/webhook"
+)
+
+func Test_service_progress(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		notifications []*webhook.Notification
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		no := new(webhook.Notification)
+		assert.NoError(t, json.Unmarshal(body, no))
+		assert.True(t, webhook.Verify([]byte("secret"), r.Header.Get(webhook.TimestampHeader), body, r.Header.Get(webhook.SignatureHeader)))
+
+		mu.Lock()
+		defer mu.Unlock()
+		notifications = append(notifications, no)
+	}))
+	defer srv.Close()
+
+	option := &Option{
+		Out:             "out.jsonl",
+		Webhooks:        []string{srv.URL},
+		WebhookSecret:   "secret",
+		WebhookInterval: 10 * time.Millisecond,
+		WebhookTimeout:  time.Second,
+	}
+	items := gpt4batch.Ins{{ID: "1"}, {ID: "2"}}
+	svc := newTestService(option, client.NewNoop(), items)
+	svc.WithNotifier(newNotifier(svc.logger, option))
+	svc.stats.IncrSuccessCount()
+	svc.stats.IncrCompleteCount()
+
+	// the progress is posted until the service is closed, even while the
+	// counts say every item is completed.
+	done := make(chan struct{})
+	go func() {
+		svc.progress(context.Background())
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(notifications) >= 1
+	}, time.Second, 5*time.Millisecond)
+	svc.stats.IncrCompleteCount()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return notifications[len(notifications)-1].Stats.Completed == 2
+	}, time.Second, 5*time.Millisecond)
+	svc.closeOnce.Do(func() { close(svc.closed) })
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.NotEmpty(t, notifications) {
+		no := notifications[0]
+		assert.Equal(t, webhook.TypeRunProgress, no.Type)
+		assert.Equal(t, "out.jsonl", no.Out)
+		assert.Equal(t, uint64(2), no.Stats.Total)
+		assert.Equal(t, uint64(1), no.Stats.Completed)
+	}
+}
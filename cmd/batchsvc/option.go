@@ -18,11 +18,18 @@ package batchsvc
 
 import (
 	"errors"
+	"fmt"
 	"github.com/asaskevich/govalidator"
 	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
 	"gitlab.com/gpt4batch/nsq"
+	"gitlab.com/gpt4batch/sink"
+	"gitlab.com/gpt4batch/webhook"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // Option is the option.
@@ -42,6 +49,12 @@ type Option struct {
 	// goroutine is the goroutine.
 	// 设置并发数
 	Goroutine int
+	// Adaptive whether adapt the goroutine to the upstream latency and errors.
+	// 是否开启自适应并发，开启后并发数在MinGoroutine与Goroutine之间根据延迟与错误自动调整
+	Adaptive bool
+	// MinGoroutine is the min goroutine of the adaptive mode.
+	// 自适应并发的最小协程数量
+	MinGoroutine int
 	// Model is the model.
 	// 模型名称,GPT-3,GPT-4,GPT-4-Gizmo
 	Model string
@@ -54,6 +67,33 @@ type Option struct {
 	// Fix is the fix.
 	// 是否开启续跑，只跑错误的题。
 	Fix bool
+	// Resume continues the conversations of failed items from the first unanswered ask in fix mode.
+	// 续跑时从第一个未回答的问题继续原会话，不重新开始对话
+	Resume bool
+	// RerunKinds is the error kinds of the failed items to rerun in fix mode.
+	// 续跑时只重跑这些错误分类的题
+	RerunKinds []string
+	// RerunCodes is the error codes of the failed items to rerun in fix mode.
+	// 续跑时只重跑这些错误状态码的题
+	RerunCodes []int
+	// RerunIDs is the ids of the items to rerun in fix mode.
+	// 续跑时只重跑这些id的题
+	RerunIDs []string
+	// RerunIDRegex matches the ids of the items to rerun in fix mode.
+	// 续跑时只重跑id匹配该正则的题
+	RerunIDRegex string
+	// RerunAskIndexes is the indexes of the asks to rerun in fix mode.
+	// 续跑时只重跑在这些问题序号(从0开始)失败的题
+	RerunAskIndexes []int
+	// RerunEmpty reruns successful items with an empty answer in fix mode.
+	// 续跑时重跑答案内容为空的成功题
+	RerunEmpty bool
+	// RerunNoEndTurn reruns successful items with an answer that did not end the turn in fix mode.
+	// 续跑时重跑答案end_turn为false的成功题
+	RerunNoEndTurn bool
+	// Force is the ids of the successful items to rerun in fix mode.
+	// 续跑时强制重跑这些id的成功题
+	Force []string
 	// AccessToken is the access token file.
 	// 访问令牌，访问https://gpt4api.shop/consul。复制该令牌
 	AccessToken string
@@ -63,6 +103,15 @@ type Option struct {
 	// NSQ is the nsq config.
 	// NSQ配置将数据存储到NSQ队列里，防止丢失.
 	NSQ nsq.NSQConfig
+	// Sinks is the uris of the sinks the answers are published to besides NSQ.
+	// 回答发布的其他目标，例如kafka://、redis://、nats://、http(s)://、file://
+	Sinks []string
+	// EventEncoding is the encoding of the published events. [json, protobuf, legacy]
+	// 发布事件的编码
+	EventEncoding string
+	// EventTypes is the types of the published events, every type if empty.
+	// 发布的事件类型
+	EventTypes []string
 	// EnableDownload is the download.
 	// 是否开启下载文件
 	EnableDownload bool
@@ -72,6 +121,120 @@ type Option struct {
 	// DownloadFilePrefix is the download file prefix.
 	// 设置下载文件前缀
 	DownloadFilePrefix string
+	// JSONSchema is the json schema file the last answer of each conversation must match.
+	// JSON Schema文件，每个会话最后一条回答中的JSON需要符合该Schema
+	JSONSchema string
+	// JSONReask is the times an answer with invalid json is asked again.
+	// 回答JSON校验失败时在同一会话中重新提问的次数
+	JSONReask int
+	// AssertMatch is the regular expressions every answer must match.
+	// 每条回答必须匹配的正则
+	AssertMatch []string
+	// AssertNotMatch is the regular expressions no answer may match.
+	// 每条回答不能匹配的正则
+	AssertNotMatch []string
+	// AssertMinLen is the min length of every answer.
+	// 每条回答的最小字数
+	AssertMinLen int
+	// AssertMaxLen is the max length of every answer.
+	// 每条回答的最大字数
+	AssertMaxLen int
+	// AssertLang is the language of every answer. [zh, ja, ko, ru, ar, en]
+	// 每条回答的语言
+	AssertLang string
+	// AssertDownload asserts every answer has a downloadable file.
+	// 每条回答必须包含可下载文件
+	AssertDownload bool
+	// AssertEndTurn asserts every answer ends the turn.
+	// 每条回答end_turn必须为true
+	AssertEndTurn bool
+	// AssertFail fails the item when an answer fails an assertion.
+	// 断言失败时将该题记为失败，续跑时会重跑
+	AssertFail bool
+	// BreakerThreshold is the consecutive failures that open the circuit of an endpoint.
+	// 熔断阈值，接口连续失败次数达到该值后暂停派发任务，0表示关闭熔断
+	BreakerThreshold int
+	// BreakerCooldown is the seconds the circuit stays open before probing.
+	// 熔断后等待多少秒再发送探测请求
+	BreakerCooldown int
+	// PriceTable is the json file of the prices of the requests per model.
+	// 价格表JSON文件，按模型设置每次对话与上传请求的价格
+	PriceTable string
+	// MaxBudget is the max estimated cost a run may start with, 0 disables it.
+	// 预算上限，预估费用超过该值时不启动，0表示不限制
+	MaxBudget float64
+	// MaxChats is the max chat requests, counted across runs. 0 disables it.
+	// 对话请求数上限(跨多次运行累计)，0表示不限制
+	MaxChats int
+	// MaxUploads is the max upload requests, counted across runs. 0 disables it.
+	// 上传请求数上限(跨多次运行累计)，0表示不限制
+	MaxUploads int
+	// MaxSpend is the max spend per model priced by the price table, counted across runs. 0 disables it.
+	// 每个模型的花费上限(按价格表计算，跨多次运行累计)，0表示不限制
+	MaxSpend float64
+	// MaxDailyRequests is the max requests per access token per day. 0 disables it.
+	// 每个访问令牌每天的请求数上限，0表示不限制
+	MaxDailyRequests int
+	// BudgetState is the file the usage counted against the caps is persisted to.
+	// 预算用量持久化文件，默认是输出文件加.budget.json
+	BudgetState string
+	// DryRun checks the input and prints a summary without sending anything.
+	// 只校验输入文件并输出请求数、上传数与预计耗时，不发送任何请求
+	DryRun bool
+	// Worker consumes the items from NSQ and publishes the results instead of running the input file.
+	// 是否开启Worker模式，从NSQ消费任务并发布结果
+	Worker bool
+	// WorkerTopic is the topic the items are consumed from.
+	// Worker模式消费任务的topic
+	WorkerTopic string
+	// WorkerChannel is the channel the items are consumed from.
+	// Worker模式消费任务的channel
+	WorkerChannel string
+	// WorkerResultsTopic is the topic the results are published to.
+	// Worker模式发布结果的topic
+	WorkerResultsTopic string
+	// WorkerMaxAttempts is the attempts of an item before its failure is published.
+	// Worker模式任务最大尝试次数
+	WorkerMaxAttempts int
+	// HookBeforeRun is the command run before the items are dispatched. the run fails if it fails.
+	// 开始派发前执行的命令，命令失败则不启动
+	HookBeforeRun string
+	// HookBeforeItem is the command run before each item is sent. it may modify or skip the item.
+	// 每道题发送前执行的命令，可修改或跳过该题
+	HookBeforeItem string
+	// HookAfterItem is the command run after each item is completed.
+	// 每道题完成后执行的命令
+	HookAfterItem string
+	// HookOnFailure is the command run after each item failed.
+	// 每道题失败后执行的命令
+	HookOnFailure string
+	// HookAfterRun is the command run after the output is written.
+	// 输出文件写入后执行的命令
+	HookAfterRun string
+	// HookTimeout is the timeout of each hook command.
+	// 每次执行钩子命令的超时时间
+	HookTimeout time.Duration
+	// Webhooks is the urls the notifications of the run are posted to.
+	// 运行通知发送的webhook地址
+	Webhooks []string
+	// WebhookSecret is the key the notifications are signed with, no signature if empty.
+	// webhook签名密钥
+	WebhookSecret string
+	// WebhookTemplate is the template file the payloads are rendered with, the notification as JSON if empty.
+	// webhook请求体模板文件
+	WebhookTemplate string
+	// WebhookEvents is the types of the posted notifications, every type if empty.
+	// 发送的通知类型
+	WebhookEvents []string
+	// WebhookInterval is the interval of the progress notifications, 0 disables them.
+	// 进度通知间隔
+	WebhookInterval time.Duration
+	// WebhookRetries is the retries of a failed notification.
+	// 通知失败重试次数
+	WebhookRetries int
+	// WebhookTimeout is the timeout of each notification request.
+	// 通知请求超时时间
+	WebhookTimeout time.Duration
 	// EnableRDB whether enable rdb.
 	// 是否开启RDB缓存.默认会缓存临时数据.
 	EnableRDB bool
@@ -96,20 +259,144 @@ func (o *Option) Validate() error {
 		return errors.New("goroutine must be greater than 0")
 	}
 
-	if o.NSQ.Enable {
-		// todo 设置默认参数.
-		o.NSQ = nsq.NewNSQConfig()
+	if o.Adaptive {
+		if o.Goroutine == 0 {
+			return errors.New("goroutine is required in adaptive mode")
+		}
+		if o.MinGoroutine <= 0 || o.MinGoroutine > o.Goroutine {
+			return errors.New("min_goroutine must be between 1 and goroutine")
+		}
+	}
+
+	if !o.Fix && o.Resume {
+		return errors.New("resume requires fix mode")
+	}
+
+	if !o.Fix && (len(o.RerunKinds) != 0 || len(o.RerunCodes) != 0 || len(o.RerunIDs) != 0 || o.RerunIDRegex != "" ||
+		len(o.RerunAskIndexes) != 0 || o.RerunEmpty || o.RerunNoEndTurn || len(o.Force) != 0) {
+		return errors.New("rerun selectors require fix mode")
+	}
+
+	if _, err := newSelector(o); err != nil {
+		return err
+	}
+
+	if _, err := compileSchema(o.JSONSchema); err != nil {
+		return err
+	}
+
+	if o.JSONReask < 0 {
+		return errors.New("json_reask must not be negative")
+	}
+
+	if _, err := newAssertions(o); err != nil {
+		return err
+	}
+
+	if _, err := loadPrices(o.PriceTable); err != nil {
+		return err
+	}
+
+	if o.MaxBudget < 0 {
+		return errors.New("max_budget must not be negative")
+	}
+
+	if o.MaxBudget > 0 && govalidator.IsNull(o.PriceTable) {
+		return errors.New("max_budget requires price_table")
+	}
+
+	if o.MaxChats < 0 || o.MaxUploads < 0 || o.MaxSpend < 0 || o.MaxDailyRequests < 0 {
+		return errors.New("budget caps must not be negative")
+	}
+
+	if o.MaxSpend > 0 && govalidator.IsNull(o.PriceTable) {
+		return errors.New("max_spend requires price_table")
+	}
+
+	if govalidator.IsNull(o.BudgetState) {
+		o.BudgetState = o.Out + ".budget.json"
+	}
+
+	if _, err := newBudget(o, nil); err != nil {
+		return err
+	}
+
+	if o.BreakerThreshold > 0 && o.BreakerCooldown <= 0 {
+		return errors.New("breaker_cooldown must be greater than 0")
+	}
+
+	if o.NSQ.Enable || o.Worker {
+		if govalidator.IsNull(o.NSQ.Outbox) {
+			o.NSQ.Outbox = o.Out + ".nsq-outbox.jsonl"
+		}
 		if err := o.NSQ.Validate(); err != nil {
 			return err
 		}
 	}
 
-	// get credentials from access token filepath.
-	ak, err := gpt4batch.ParseCredentials(o.AccessToken)
-	if err != nil {
+	for _, uri := range o.Sinks {
+		if err := sink.Validate(uri); err != nil {
+			return err
+		}
+	}
+
+	switch event.Encoding(o.EventEncoding) {
+	case "", event.EncodingJSON, event.EncodingProtobuf, eventEncodingLegacy:
+	default:
+		return errors.New("event_encoding must be json, protobuf or legacy")
+	}
+	// the sqlite sink records events, the legacy encoding publishes none.
+	if o.EventEncoding == eventEncodingLegacy {
+		for _, uri := range o.Sinks {
+			if u, err := url.Parse(uri); err == nil && strings.EqualFold(u.Scheme, "sqlite") {
+				return errors.New("sink sqlite:// does not support event_encoding legacy")
+			}
+		}
+	}
+	if _, err := event.ParseTypes(o.EventTypes); err != nil {
 		return err
 	}
-	o.AccessToken = ak
+
+	if o.Worker {
+		if o.Fix || o.DryRun {
+			return errors.New("worker mode does not support fix or dry_run")
+		}
+		if !nsq.IsValidTopicName(o.WorkerTopic) || !nsq.IsValidTopicName(o.WorkerResultsTopic) {
+			return errors.New("worker_topic and worker_results_topic must be valid nsq topic names")
+		}
+		if o.WorkerTopic == o.WorkerResultsTopic {
+			return errors.New("worker_results_topic must differ from worker_topic")
+		}
+		if !nsq.IsValidChannelName(o.WorkerChannel) {
+			return errors.New("worker_channel must be a valid nsq channel name")
+		}
+		if o.WorkerMaxAttempts <= 0 {
+			return errors.New("worker_max_attempts must be greater than 0")
+		}
+		if o.hooked() {
+			return errors.New("worker mode does not support hooks")
+		}
+		if len(o.Webhooks) > 0 {
+			return errors.New("worker mode does not support webhooks")
+		}
+	}
+
+	if o.hooked() && o.HookTimeout <= 0 {
+		return errors.New("hook_timeout must be greater than 0")
+	}
+
+	if err := o.validateWebhooks(); err != nil {
+		return err
+	}
+
+	// get credentials from access token filepath. a dry run sends nothing.
+	if !o.DryRun {
+		ak, err := gpt4batch.ParseCredentials(o.AccessToken)
+		if err != nil {
+			return err
+		}
+		o.AccessToken = ak
+	}
 
 	if o.EnableDownload {
 		// DownloadDir is null, use the current directory.
@@ -127,3 +414,41 @@ func (o *Option) Validate() error {
 	}
 	return nil
 }
+
+// validateWebhooks checks the urls, template and notification types of the webhooks.
+func (o *Option) validateWebhooks() error {
+	if len(o.Webhooks) == 0 {
+		return nil
+	}
+
+	for _, uri := range o.Webhooks {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %q must be an http(s) url", uri)
+		}
+	}
+
+	if !govalidator.IsNull(o.WebhookTemplate) {
+		if _, err := webhook.ParseTemplate(o.WebhookTemplate); err != nil {
+			return err
+		}
+	}
+
+	if _, err := webhook.ParseTypes(o.WebhookEvents); err != nil {
+		return err
+	}
+
+	if o.WebhookInterval < 0 {
+		return errors.New("webhook_interval must not be negative")
+	}
+	if o.WebhookRetries < 0 {
+		return errors.New("webhook_retries must not be negative")
+	}
+	if o.WebhookTimeout <= 0 {
+		return errors.New("webhook_timeout must be greater than 0")
+	}
+	return nil
+}
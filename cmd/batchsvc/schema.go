@@ -0,0 +1,27 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import "github.com/santhosh-tekuri/jsonschema/v5"
+
+// compileSchema compiles the json schema of the file.
+func compileSchema(filename string) (*jsonschema.Schema, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	return jsonschema.Compile(filename)
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gitlab.com/gpt4batch"
+)
+
+// selector selects the items to rerun in fix mode.
+type selector struct {
+	// kinds is the error kinds of the failed items to rerun.
+	kinds map[gpt4batch.ErrKind]struct{}
+	// codes is the error codes of the failed items to rerun.
+	codes map[int]struct{}
+	// askIndexes is the indexes of the failing asks of the failed items to rerun.
+	askIndexes map[int]struct{}
+	// ids is the ids of the items to rerun.
+	ids map[string]struct{}
+	// idRegex matches the ids of the items to rerun.
+	idRegex *regexp.Regexp
+	// empty reruns successful items with an empty answer.
+	empty bool
+	// noEndTurn reruns successful items with an answer that did not end the turn.
+	noEndTurn bool
+	// force is the ids of the items to rerun even if they succeeded.
+	force map[string]struct{}
+}
+
+// plan is the summary of the selection.
+type plan struct {
+	Failed    int // Failed is the number of failed items to rerun.
+	Predicate int // Predicate is the number of successful items whose answers fail a predicate.
+	Forced    int // Forced is the number of successful items forced to rerun.
+	Skipped   int // Skipped is the number of items not rerun.
+}
+
+// newSelector returns the selector of the option.
+func newSelector(o *Option) (*selector, error) {
+	sel := &selector{
+		kinds:      make(map[gpt4batch.ErrKind]struct{}),
+		codes:      make(map[int]struct{}),
+		askIndexes: make(map[int]struct{}),
+		ids:        make(map[string]struct{}),
+		empty:      o.RerunEmpty,
+		noEndTurn:  o.RerunNoEndTurn,
+		force:      make(map[string]struct{}),
+	}
+
+	for _, kind := range o.RerunKinds {
+		k := gpt4batch.ErrKind(strings.TrimSpace(kind))
+		switch k {
+		case gpt4batch.ErrKindPending, gpt4batch.ErrKindUpload, gpt4batch.ErrKindChat, gpt4batch.ErrKindDecode,
+			gpt4batch.ErrKindTimeout, gpt4batch.ErrKindCanceled, gpt4batch.ErrKindAuth, gpt4batch.ErrKindQuota,
+			gpt4batch.ErrKindValidation, gpt4batch.ErrKindDependency, gpt4batch.ErrKindHook,
+			gpt4batch.ErrKindSkipped:
+		default:
+			return nil, fmt.Errorf("rerun_kind: unknown error kind %q", kind)
+		}
+		sel.kinds[k] = struct{}{}
+	}
+	for _, code := range o.RerunCodes {
+		sel.codes[code] = struct{}{}
+	}
+	for _, idx := range o.RerunAskIndexes {
+		sel.askIndexes[idx] = struct{}{}
+	}
+	for _, id := range o.RerunIDs {
+		sel.ids[id] = struct{}{}
+	}
+	for _, id := range o.Force {
+		sel.force[id] = struct{}{}
+	}
+
+	if o.RerunIDRegex != "" {
+		re, err := regexp.Compile(o.RerunIDRegex)
+		if err != nil {
+			return nil, fmt.Errorf("rerun_id_regex: %w", err)
+		}
+		sel.idRegex = re
+	}
+	return sel, nil
+}
+
+// rerun reports whether the item is rerun and updates the plan.
+func (sel *selector) rerun(in *gpt4batch.In, p *plan) bool {
+	if _, ok := sel.force[in.ID]; ok {
+		if in.IErr == nil {
+			p.Forced++
+		} else {
+			p.Failed++
+		}
+		return true
+	}
+
+	if !sel.matchID(in) {
+		p.Skipped++
+		return false
+	}
+
+	if in.IErr != nil {
+		if sel.matchErr(in) {
+			p.Failed++
+			return true
+		}
+		p.Skipped++
+		return false
+	}
+
+	if sel.matchPredicate(in) {
+		p.Predicate++
+		return true
+	}
+	p.Skipped++
+	return false
+}
+
+// matchID reports whether the id of the item is selected.
+func (sel *selector) matchID(in *gpt4batch.In) bool {
+	if len(sel.ids) == 0 && sel.idRegex == nil {
+		return true
+	}
+	if _, ok := sel.ids[in.ID]; ok {
+		return true
+	}
+	return sel.idRegex != nil && sel.idRegex.MatchString(in.ID)
+}
+
+// matchErr reports whether the error of the failed item is selected.
+// selectors of different kinds must all match.
+func (sel *selector) matchErr(in *gpt4batch.In) bool {
+	if len(sel.kinds) != 0 {
+		if _, ok := sel.kinds[in.IErr.Kind]; !ok {
+			return false
+		}
+	}
+
+	if len(sel.codes) != 0 {
+		if _, ok := sel.codes[in.IErr.Code]; !ok {
+			return false
+		}
+	}
+
+	if len(sel.askIndexes) != 0 {
+		var matched bool
+		for idx, ask := range in.Asks {
+			if _, ok := sel.askIndexes[idx]; ok && ask.ID == in.IErr.AskID {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPredicate reports whether an answer of the successful item fails a selected predicate.
+func (sel *selector) matchPredicate(in *gpt4batch.In) bool {
+	if !sel.empty && !sel.noEndTurn {
+		return false
+	}
+
+	resps, err := in.ChatResponses()
+	if err != nil {
+		return true
+	}
+
+	for idx, resp := range resps {
+		if len(sel.askIndexes) != 0 {
+			if _, ok := sel.askIndexes[idx]; !ok {
+				continue
+			}
+		}
+
+		if sel.empty && emptyContents(resp.Contents) {
+			return true
+		}
+		if sel.noEndTurn && !resp.EndTurn {
+			return true
+		}
+	}
+	return false
+}
+
+// emptyContents reports whether the contents have no non-blank content.
+func emptyContents(contents []interface{}) bool {
+	for _, content := range contents {
+		switch v := content.(type) {
+		case nil:
+		case string:
+			if strings.TrimSpace(v) != "" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
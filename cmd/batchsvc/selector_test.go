@@ -0,0 +1,71 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+)
+
+func Test_selector_rerun(t *testing.T) {
+	asks := gpt4batch.Asks{{ID: "a0"}, {ID: "a1"}}
+	items := gpt4batch.Ins{
+		{ID: "ok", Asks: asks, Answers: []interface{}{map[string]interface{}{"end_turn": true, "contents": []interface{}{"hi"}}}},
+		{ID: "empty", Asks: asks, Answers: []interface{}{map[string]interface{}{"end_turn": true, "contents": []interface{}{" "}}}},
+		{ID: "cut", Asks: asks, Answers: []interface{}{&gpt4batch.ChatResponse{Contents: []interface{}{"hi"}}}},
+		{ID: "timeout-1", Asks: asks, IErr: &gpt4batch.IErr{Kind: gpt4batch.ErrKindTimeout, AskID: "a1"}},
+		{ID: "quota-0", Asks: asks, IErr: &gpt4batch.IErr{Kind: gpt4batch.ErrKindQuota, Code: 429, AskID: "a0"}},
+	}
+
+	tests := []struct {
+		name   string
+		option Option
+		want   []string
+	}{
+		{"default", Option{}, []string{"timeout-1", "quota-0"}},
+		{"kind", Option{RerunKinds: []string{"timeout"}}, []string{"timeout-1"}},
+		{"code", Option{RerunCodes: []int{429}}, []string{"quota-0"}},
+		{"ask index", Option{RerunAskIndexes: []int{1}}, []string{"timeout-1"}},
+		{"id regex", Option{RerunIDRegex: "^quota"}, []string{"quota-0"}},
+		{"empty", Option{RerunEmpty: true}, []string{"empty", "timeout-1", "quota-0"}},
+		{"no end turn", Option{RerunNoEndTurn: true, RerunIDs: []string{"cut"}}, []string{"cut"}},
+		{"force", Option{RerunKinds: []string{"auth"}, Force: []string{"ok"}}, []string{"ok"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := newSelector(&tt.option)
+			assert.NoError(t, err)
+
+			var (
+				p   plan
+				got []string
+			)
+			for _, item := range items {
+				if sel.rerun(item, &p) {
+					got = append(got, item.ID)
+				}
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, len(items), p.Failed+p.Predicate+p.Forced+p.Skipped)
+		})
+	}
+
+	_, err := newSelector(&Option{RerunKinds: []string{"unknown"}})
+	assert.Error(t, err)
+}
@@ -19,19 +19,24 @@ package batchsvc
 import (
 	"bufio"
 	"context"
-	"errors"
 	"fmt"
 	jsoniter "github.com/json-iterator/go"
-	"net/http"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/schollz/progressbar/v3"
 
 	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/event"
 	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/runner"
+	"gitlab.com/gpt4batch/webhook"
 )
 
 // service implements gpt4batch.Service.
@@ -55,9 +60,36 @@ type service struct {
 	// doneChan is the service done channel.
 	doneChan <-chan struct{}
 	// wg is the limit go size wg.
-	wg SizedWaitGroup
-	// currentDir is the current dir.
-	currentDir string
+	wg runner.Limiter
+	// breaker is the circuit breaker of the client, nil if disabled.
+	breaker client.CircuitBreaker
+	// selector selects the items to rerun in fix mode.
+	selector *selector
+	// schema is the json schema the answers of the run must match, nil if disabled.
+	schema *jsonschema.Schema
+	// assertions is the assertions evaluated on each answer, nil if disabled.
+	assertions *assertions
+	// budget is the budget caps of the run, nil if disabled.
+	budget *budget
+	// events publishes the events of the run, nil if disabled.
+	events *event.Emitter
+	// hooks runs the hook commands of the run, nil if disabled.
+	hooks *hooks
+	// notifier posts the notifications of the run to the webhooks, nil if disabled.
+	notifier *webhook.Notifier
+	// finished makes the run.finished notification posted once.
+	finished sync.Once
+	// closed is closed once the service is closing, closeOnce closes it once.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// finishOnce makes the run.finished event published once.
+	finishOnce sync.Once
+	// finishErr is the error of closing the emitter.
+	finishErr error
+	// index is the items by id the asks render the answers of.
+	index map[string]*gpt4batch.In
+	// runner runs the items.
+	runner *runner.Runner
 }
 
 // NewService returns a new gpt4batch.Service.
@@ -70,12 +102,73 @@ func NewService(config *Option, cc gpt4batch.Client, items gpt4batch.Ins, stats
 		items:       items,
 		rdbInterval: time.Duration(config.RDBInterval) * time.Minute,
 		progressBar: progressbar.Default(int64(len(items))),
-		wg:          New(config.Goroutine),
-		currentDir:  filepath.Dir(config.In),
+		index:       make(map[string]*gpt4batch.In, len(items)),
+		closed:      make(chan struct{}),
 	}
+	for _, item := range items {
+		svc.index[item.ID] = item
+	}
+
+	// the selectors have been checked by Option.Validate.
+	svc.selector, _ = newSelector(config)
+	svc.schema, _ = compileSchema(config.JSONSchema)
+	svc.assertions, _ = newAssertions(config)
+	svc.hooks = newHooks(config)
+
+	// pause the dispatch while the circuit of an endpoint is open.
+	client.As(cc, &svc.breaker)
+
+	// mws decorates the client of the service, the first one being the outermost.
+	var mws []client.Middleware
+
+	// Adaptive grows and shrinks the concurrency between MinGoroutine and Goroutine
+	// depending on the upstream latency and errors.
+	if config.Adaptive {
+		aw := NewAdaptive(config.MinGoroutine, config.Goroutine, svc.logger)
+		svc.wg = aw
+		mws = append(mws, withObserver(aw, stats))
+		stats.SetConcurrency(uint64(aw.Limit()))
+	} else {
+		wg := runner.NewSizedWaitGroup(config.Goroutine)
+		svc.wg = &wg
+		stats.SetConcurrency(uint64(wg.Size))
+	}
+
+	// count every request against the budget caps before it is sent.
+	// the price table and the budget state have been checked by Option.Validate.
+	prices, _ := loadPrices(config.PriceTable)
+	if svc.budget, _ = newBudget(config, prices); svc.budget != nil {
+		mws = append(mws, withBudget(svc.budget, config.Model))
+	}
+	svc.cc = client.Chain(cc, mws...)
+	svc.runner = svc.newRunner()
 	return svc
 }
 
+// newRunner returns the runner of the items with the options of the service.
+func (s *service) newRunner() *runner.Runner {
+	return runner.New(s.cc,
+		runner.WithLogger(s.logger),
+		runner.WithStats(s.stats),
+		runner.WithConcurrency(s.config.Goroutine),
+		runner.WithLimiter(s.wg),
+		runner.WithURL(s.config.URL),
+		runner.WithUploadURL(s.config.UploadURL),
+		runner.WithModel(s.config.Model, s.config.GizmoId),
+		runner.WithAccessToken(s.config.AccessToken),
+		runner.WithDownload(s.config.DownloadDir, s.config.DownloadFilePrefix),
+		runner.WithHistoryAndTrainingDisabled(s.config.HistoryAndTrainingDisabled),
+		runner.WithBaseDir(filepath.Dir(s.config.In)),
+		runner.WithResume(s.config.Resume),
+		runner.WithSchema(s.schema, s.config.JSONReask),
+		runner.WithCheck(s.check),
+		runner.WithLookup(s.lookup),
+		runner.OnItemStart(s.itemStarted),
+		runner.OnAnswer(s.answered),
+		runner.OnItemDone(s.itemDone),
+	)
+}
+
 // Done is shutdown.
 func (s *service) Done() <-chan struct{} {
 	return s.doneChan
@@ -83,10 +176,17 @@ func (s *service) Done() <-chan struct{} {
 
 // Open opens the service.
 func (s *service) Open(ctx context.Context) error {
+	// the before run hook may stop the run before anything is sent.
+	if err := s.hooks.beforeRun(ctx, s.runInfo()); err != nil {
+		return err
+	}
+
 	ctx, s.cancel = context.WithCancel(ctx)
 	s.doneChan = ctx.Done()
 
 	s.logger.Info("Start")
+	s.notify(ctx, webhook.TypeRunStarted)
+	go s.progress(ctx)
 
 	// if the items is null, return an error.
 	// if the items is not null, do the work.
@@ -100,198 +200,209 @@ func (s *service) Open(ctx context.Context) error {
 }
 
 func (s *service) doWork(ctx context.Context) {
-	for _, item := range s.items {
-		if s.config.Fix && item.IErr == nil {
-			s.stats.IncrSuccessCount()
-			s.updateProgressBar(ctx)
+	// reruns is whether each item is run. every item is run unless in fix mode.
+	reruns := s.plan()
+
+	// items are dispatched once their dependencies are resolved.
+	src := &dagSource{
+		svc:     s,
+		dag:     newDAG(s.items, reruns),
+		reruns:  reruns,
+		started: make(map[*gpt4batch.In]struct{}, len(s.items)),
+	}
+	if err := s.runner.Run(ctx, src, runner.SinkFunc(src.put)); err != nil && ctx.Err() == nil {
+		s.logger.Error("Run: ", err)
+	}
+}
+
+// dagSource is the runner.Source of the items whose dependencies are resolved.
+// the items that are not rerun or whose dependencies failed are completed
+// without being run.
+type dagSource struct {
+	svc *service
+	dag *dag
+	// reruns is whether each item is run.
+	reruns []bool
+	// started is the items that have been dispatched.
+	started map[*gpt4batch.In]struct{}
+}
+
+// Next implements runner.Source. it returns io.EOF once every item is
+// dispatched or a budget cap has been hit.
+func (src *dagSource) Next(ctx context.Context) (*gpt4batch.In, error) {
+	s := src.svc
+	for {
+		var n *node
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.budget.Done():
+			s.stopBudget(src.reruns, src.started)
+			return nil, io.EOF
+		case next, ok := <-src.dag.ready:
+			if !ok {
+				return nil, io.EOF
+			}
+			n = next
+		}
+		item := n.item
+
+		if !n.run {
+			src.complete(ctx, n)
 			continue
 		}
 
-		s.wg.Add()
-		go func(item *gpt4batch.In) {
-			defer func() {
-				s.updateProgressBar(ctx)
-				s.wg.Done()
-			}()
-			if err := s.Chat(ctx, item); err != nil {
-				s.stats.IncrFailedCount()
-				item.IErr = &gpt4batch.IErr{
-					Code:    http.StatusNotImplemented,
-					Message: err.Error(),
-				}
-			} else {
-				s.stats.IncrSuccessCount()
-			}
-		}(item)
+		// a dependency failed. skip the item without sending anything.
+		if n.failedDep != "" {
+			src.fail(ctx, n, fmt.Sprintf("dependency %s failed", n.failedDep), gpt4batch.ErrKindDependency)
+			continue
+		}
+
+		// wait for the endpoints to recover. if the service is canceled meanwhile,
+		// the remaining items are left pending.
+		if err := s.waitBreaker(ctx, item); err != nil {
+			return nil, err
+		}
+
+		// a budget cap has been hit. stop dispatching and leave the remaining items pending.
+		if s.budget.exhausted() != "" {
+			s.stopBudget(src.reruns, src.started)
+			return nil, io.EOF
+		}
+
+		// the before item hook may modify or skip the item. if the service is
+		// canceled meanwhile, the remaining items are left pending.
+		skip, err := s.hooks.beforeItem(ctx, item)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			src.fail(ctx, n, err.Error(), gpt4batch.ErrKindHook)
+			continue
+		}
+		if skip {
+			s.logger.WithField("id", item.ID).Info("Skipped by hook")
+			src.fail(ctx, n, "skipped by hook", gpt4batch.ErrKindSkipped)
+			continue
+		}
+
+		src.started[item] = struct{}{}
+		return item, nil
 	}
 }
 
-// Chat sends a message to the server and returns the response.
-// if the response is not null, append the response.
-func (s *service) Chat(ctx context.Context, in *gpt4batch.In) error {
-	var (
-		// conversationID is the conversation id.
-		conversationID string
-		// parentMessageID is the parent message id.
-		parentMessageID string
-		// answers is the answers.
-		answers []interface{}
-		// attachments is the attachments.
-		attachments gpt4batch.Attachments
-		// parts is the parts.
-		parts gpt4batch.Parts
-	)
+// complete completes the item without running it. it is counted as skipped
+// or failed if it holds an error. the dependents of an item with an error fail.
+func (src *dagSource) complete(ctx context.Context, n *node) {
+	s := src.svc
+	switch {
+	case n.item.IErr == nil:
+		s.stats.IncrSuccessCount()
+	case n.item.IErr.Kind == gpt4batch.ErrKindSkipped:
+		s.stats.IncrSkippedCount()
+	default:
+		s.stats.IncrFailedCount()
+	}
+	s.stats.IncrCompleteCount()
+	src.dag.resolve(n, n.item.IErr != nil)
+	s.updateProgressBar(ctx)
+}
 
-	if ctx.Err() != nil {
-		return errors.New("service canceled")
+// fail completes the item with an error of kind without sending anything.
+func (src *dagSource) fail(ctx context.Context, n *node, msg string, kind gpt4batch.ErrKind) {
+	s := src.svc
+	item := n.item
+	item.IErr = &gpt4batch.IErr{
+		Message:   msg,
+		Kind:      kind,
+		Attempts:  runner.Attempts(item),
+		Timestamp: time.Now().Unix(),
 	}
+	s.events.Emit(ctx, s.itemEvent(event.TypeItemCompleted, item, runner.Attempts(item)))
+	s.afterItem(ctx, item)
+	src.complete(ctx, n)
+}
 
-	for _, ask := range in.Asks {
-		s.logger.
-			WithField("id", in.ID).
-			WithField("pid", ask.ID).
-			WithField("complete", s.stats.GetCompleteTotal()).
-			WithField("success", s.stats.GetSuccessTotal()).
-			WithField("failed", s.stats.GetFailedTotal()).
-			Info()
-
-		// tmpConversationID is the temporary conversation id.
-		// if the conversation id is not null, use the conversation id.
-		var tmpConversationID string
-
-		// conversationID is the conversation id. if the conversation id is not null, use the conversation id.
-		// if the conversation id is null, use the temporary conversation id.
-		if conversationID != "" {
-			tmpConversationID = conversationID
-		}
+// put resolves the dependents of the item run.
+func (src *dagSource) put(ctx context.Context, in *gpt4batch.In) error {
+	src.dag.resolve(src.dag.nodes[in], in.IErr != nil)
+	src.svc.updateProgressBar(ctx)
+	return nil
+}
 
-		// Images is the images. if the images is not null, upload the images.
-		// if the images is null, do nothing.
-		if len(ask.Images) != 0 {
-			for _, image := range ask.Images {
-				// resp is the response. if the response is not null, upload the image.
-				// if the response is null, do nothing.
-				resp, err := s.cc.Upload(ctx, &gpt4batch.UploadRequest{
-					Source: &gpt4batch.Source{
-						ID:          in.ID,                       // in.ID is the id of the batch.
-						URL:         s.config.UploadURL,          // s.config.URL is the url of the server.
-						Name:        "UploadImage",               // "Upload" is the name of the upload.
-						Pid:         ask.ID,                      // ask.ID is the id of the ask.
-						Prefix:      s.config.DownloadFilePrefix, // Prefix  is the download file prefix.
-						AccessToken: s.config.AccessToken,        // s.config.AccessToken is the access token of the server.
-						Dir:         s.config.DownloadDir,        // s.config.DownloadDir is the download dir of the server.
-					},
-					ConversationId: tmpConversationID,
-					UploadPath:     filepath.Join(s.currentDir, image),
-					UploadType:     gpt4batch.Multimodal,
-				})
-				if err != nil {
-					return err
-				}
+// stopBudget waits for the items in flight, marks the items that were not
+// dispatched pending with the cap that was hit, and stops the service.
+func (s *service) stopBudget(reruns []bool, started map[*gpt4batch.In]struct{}) {
+	s.wg.Wait()
 
-				// parts is the parts. if the parts is not null, append the parts.
-				// if the parts is null, do nothing.
-				parts = append(parts, &gpt4batch.Part{
-					Name:         resp.Part.Name,
-					AssetPointer: resp.Part.AssetPointer,
-					SizeBytes:    resp.Part.SizeBytes,
-					MimeType:     resp.Part.MimeType,
-					Width:        resp.Part.Width,
-					Height:       resp.Part.Height,
-				})
-
-				tmpConversationID = resp.ConversationId
-			}
+	reason := s.budget.exhausted()
+	var pending int
+	for idx, item := range s.items {
+		if _, ok := started[item]; ok || !reruns[idx] {
+			continue
+		}
+		item.IErr = &gpt4batch.IErr{
+			Message:   fmt.Sprintf("%v: %s", errBudgetExhausted, reason),
+			Kind:      gpt4batch.ErrKindPending,
+			Attempts:  runner.Attempts(item),
+			Timestamp: time.Now().Unix(),
 		}
+		pending++
+	}
 
-		// Files is the files. if the files is not null, upload the files.
-		if len(ask.Files) != 0 {
-			for _, file := range ask.Files {
-				// resp is the response. if the response is not null, upload the file.
-				// if the response is null, do nothing.
-				resp, err := s.cc.Upload(ctx, &gpt4batch.UploadRequest{
-					Source: &gpt4batch.Source{
-						ID:          in.ID,                       // in.ID is the id of the batch.
-						URL:         s.config.UploadURL,          // s.config.URL is the url of the server.
-						Name:        "UploadFile",                // "Upload" is the name of the upload.
-						Pid:         ask.ID,                      // ask.ID is the id of the ask.
-						Prefix:      s.config.DownloadFilePrefix, // Prefix  is the download file prefix.
-						AccessToken: s.config.AccessToken,        // s.config.AccessToken is the access token of the server.
-						Dir:         s.config.DownloadDir,        // s.config.DownloadDir is the download dir of the server.
-					},
-					ConversationId: tmpConversationID,
-					UploadPath:     filepath.Join(s.currentDir, file),
-					UploadType:     gpt4batch.MyFiles,
-				})
-				if err != nil {
-					return err
-				}
+	s.logger.
+		WithField("reason", reason).
+		WithField("pending", pending).
+		Warn("Budget Exhausted")
 
-				// parts is the parts. if the parts is not null, append the parts.
-				// if the parts is null, do nothing.
-				attachments = append(attachments, &gpt4batch.Attachment{
-					Id:            resp.Attachment.Id,
-					Name:          resp.Attachment.Name,
-					Size:          resp.Attachment.Size,
-					FileTokenSize: resp.Attachment.FileTokenSize,
-					MimeType:      resp.Attachment.MimeType,
-					Width:         resp.Attachment.Width,
-					Height:        resp.Attachment.Height,
-				})
-
-				tmpConversationID = resp.ConversationId
-			}
-		}
+	// the output is written by Close once the service is done.
+	s.cancel()
+}
 
-		// Chat sends a message to the server and returns the response.
-		// if the response is not null, append the response.
-		resp, err := s.cc.Chat(ctx, &gpt4batch.ChatRequest{
-			Source: &gpt4batch.Source{
-				ID:          in.ID,                       // in.ID is the id of the batch.
-				URL:         s.config.URL,                // s.config.URL is the url of the server.
-				Name:        "Chat",                      // "Chat" is the name of the chat.
-				Pid:         ask.ID,                      // ask.ID is the id of the ask.
-				Prefix:      s.config.DownloadFilePrefix, // Prefix  is the download file prefix.
-				AccessToken: s.config.AccessToken,        // s.config.AccessToken is the access token of the server.
-				Dir:         s.config.DownloadDir,        // s.config.DownloadDir is the download dir of the server.
-			},
-			GizmoId:                    s.config.GizmoId,
-			Message:                    ask.Content,
-			ParentMessageID:            parentMessageID,
-			ConversationID:             tmpConversationID,
-			Stream:                     false,
-			Model:                      s.config.Model,
-			Attachments:                attachments,
-			Parts:                      parts,
-			HistoryAndTrainingDisabled: s.config.HistoryAndTrainingDisabled,
-		})
-		if err != nil {
-			return err
+// plan selects the items to run and logs the summary of the selection.
+func (s *service) plan() []bool {
+	reruns := make([]bool, len(s.items))
+	if !s.config.Fix {
+		for idx := range reruns {
+			reruns[idx] = true
 		}
-
-		// answers is the answers. if the answers is not null, append the answers.
-		// if the answers is null, do nothing.
-		answers = append(answers, resp)
-		parentMessageID = resp.MessageID
-		conversationID = resp.ConversationID
+		return reruns
 	}
 
-	// in.Answers is the answers. if the answers is not null, append the answers.
-	// if the answers is null, do nothing.
-	if len(answers) != 0 {
-		in.Answers = answers
-		in.IErr = nil
+	var p plan
+	for idx, item := range s.items {
+		reruns[idx] = s.selector.rerun(item, &p)
+	}
 
-		s.logger.
-			WithField("id", in.ID).
-			WithField("complete", s.stats.GetCompleteTotal()).
-			WithField("success", s.stats.GetSuccessTotal()).
-			WithField("failed", s.stats.GetFailedTotal()).
-			Info("OK")
+	s.logger.
+		WithField("failed", p.Failed).
+		WithField("predicate", p.Predicate).
+		WithField("forced", p.Forced).
+		WithField("skipped", p.Skipped).
+		Info("Rerun")
+	return reruns
+}
 
+// waitBreaker blocks until the circuits of the endpoints used by the item accept requests.
+func (s *service) waitBreaker(ctx context.Context, item *gpt4batch.In) error {
+	if s.breaker == nil {
 		return nil
 	}
-	return fmt.Errorf("chat answer is required")
+
+	asks := item.Asks
+	for _, b := range item.Branches {
+		asks = append(asks[:len(asks):len(asks)], b.Asks...)
+	}
+
+	for _, ask := range asks {
+		if len(ask.Images) != 0 || len(ask.Files) != 0 {
+			if err := s.breaker.Wait(ctx, s.config.UploadURL); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return s.breaker.Wait(ctx, s.config.URL)
 }
 
 // kill the service.
@@ -302,12 +413,10 @@ func (s *service) kill(ctx context.Context) error {
 	return syscall.Kill(pid, syscall.SIGTERM)
 }
 
-// updateProgressBar increases the complete total.
+// updateProgressBar advances the progress bar of a completed item.
 func (s *service) updateProgressBar(ctx context.Context) {
-	// incr increases the complete total.
+	// incr increases the progress.
 	s.progressBar.Add(1)
-	// incr increases the complete total.
-	s.stats.IncrCompleteCount()
 
 	// if the complete total is equal to the batch total, kill the service.
 	if s.stats.GetCompleteTotal() == s.stats.GetBatchTotal() {
@@ -369,6 +478,11 @@ func (s *service) WithLogger(log gpt4batch.Logger) {
 	s.logger = log.
 		WithField("service", "batchsvc").
 		WithField("total", s.stats.GetBatchTotal())
+
+	if aw, ok := s.wg.(*AdaptiveWaitGroup); ok {
+		aw.WithLogger(s.logger)
+	}
+	s.runner = s.newRunner()
 }
 
 // write writes the items to the file.
@@ -448,6 +562,12 @@ func (s *service) write(ctx context.Context, filename string) error {
 // Close closes the service.
 func (s *service) Close(ctx context.Context) error {
 	s.logger.Info("Close")
+	s.closeOnce.Do(func() { close(s.closed) })
+
+	// publish the end of the run. the output is written even if the sinks fail to close.
+	if err := s.finish(ctx); err != nil {
+		s.logger.Error("Close events: ", err)
+	}
 
 	// if the cancel is not null, cancel the service.
 	if s.cc != nil {
@@ -461,5 +581,15 @@ func (s *service) Close(ctx context.Context) error {
 	}
 
 	s.logger.Info("Write Complete")
+
+	// the after run hook is not bound to the deadline of the close.
+	if err := s.hooks.afterRun(context.Background(), s.runInfo()); err != nil {
+		s.logger.Error("Close hooks: ", err)
+	}
+
+	// the notification is not bound to the deadline of the close either.
+	s.finished.Do(func() {
+		s.notify(context.Background(), webhook.TypeRunFinished)
+	})
 	return nil
 }
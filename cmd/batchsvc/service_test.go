@@ -0,0 +1,75 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+// recordClient is a client that records the chat requests and answers each one
+// in the conversation "c" with the message id "m<n>".
+type recordClient struct {
+	gpt4batch.Client
+
+	mu   sync.Mutex
+	reqs []*gpt4batch.ChatRequest
+}
+
+func (c *recordClient) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reqs = append(c.reqs, req)
+	return &gpt4batch.ChatResponse{
+		MessageID:      fmt.Sprintf("m%d", len(c.reqs)),
+		ConversationID: "c",
+		EndTurn:        true,
+		Contents:       []interface{}{req.Message},
+	}, nil
+}
+
+func newTestService(option *Option, cc gpt4batch.Client, items gpt4batch.Ins) *service {
+	return NewService(option, cc, items, &Stats{BatchTotal: uint64(len(items))}).(*service)
+}
+
+func Test_service_runner(t *testing.T) {
+	outline := &gpt4batch.In{ID: "outline", Answers: []interface{}{&gpt4batch.ChatResponse{Contents: []interface{}{"intro"}}}}
+	newItem := func() *gpt4batch.In {
+		return &gpt4batch.In{ID: "expand", DependsOn: []string{"outline"}, Asks: gpt4batch.Asks{{ID: "a0", Content: `expand {{ answer "outline" }}`}}}
+	}
+
+	// the asks render the answers of the items they depend on.
+	cc := &recordClient{Client: client.NewNoop()}
+	item := newItem()
+	svc := newTestService(&Option{AssertMinLen: 100}, cc, gpt4batch.Ins{outline, item})
+	assert.NoError(t, svc.runner.Chat(context.Background(), item, 1))
+	assert.Equal(t, "expand intro", cc.reqs[0].Message)
+	assert.Equal(t, []string{"min length 100"}, item.Answers[0].(*gpt4batch.ChatResponse).Assertions)
+
+	// in assert_fail mode the failed assertions fail the item, and the failing
+	// answer is not kept so that a resumed run asks it again.
+	item = newItem()
+	svc = newTestService(&Option{AssertMinLen: 100, AssertFail: true}, cc, gpt4batch.Ins{outline, item})
+	assert.ErrorIs(t, svc.runner.Chat(context.Background(), item, 1), errAssertion)
+	assert.Empty(t, item.Answers)
+}
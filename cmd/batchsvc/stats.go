@@ -16,51 +16,7 @@ limitations under the License.
 
 package batchsvc
 
-import "sync/atomic"
+import "gitlab.com/gpt4batch/runner"
 
-type Stats struct {
-	BatchTotal    uint64 // BatchTotal is the total number of batches processed.
-	CompleteTotal uint64 // CompleteTotal is the total number of batches completed.
-	SuccessTotal  uint64 // SuccessTotal is the total number of batches successfully processed.
-	FailedTotal   uint64 // FailedTotal is the total number of batches failed to process.
-}
-
-// AddBatch adds n to the total number of batches processed.
-func (s *Stats) AddBatch(n uint64) {
-	atomic.AddUint64(&s.BatchTotal, uint64(n))
-}
-
-// IncrCompleteCount increments the total number of batches completed.
-func (s *Stats) IncrCompleteCount() {
-	atomic.AddUint64(&s.CompleteTotal, 1)
-}
-
-// IncrSuccessCount increments the total number of batches successfully processed.
-func (s *Stats) IncrSuccessCount() {
-	atomic.AddUint64(&s.SuccessTotal, 1)
-}
-
-// IncrFailedCount increments the total number of batches failed to process.
-func (s *Stats) IncrFailedCount() {
-	atomic.AddUint64(&s.FailedTotal, 1)
-}
-
-// GetBatchTotal get batch total.
-func (s *Stats) GetBatchTotal() uint64 {
-	return atomic.LoadUint64(&s.BatchTotal)
-}
-
-// GetCompleteTotal get complete total.
-func (s *Stats) GetCompleteTotal() uint64 {
-	return atomic.LoadUint64(&s.CompleteTotal)
-}
-
-// GetSuccessTotal get success total.
-func (s *Stats) GetSuccessTotal() uint64 {
-	return atomic.LoadUint64(&s.SuccessTotal)
-}
-
-// GetFailedTotal get failed total.
-func (s *Stats) GetFailedTotal() uint64 {
-	return atomic.LoadUint64(&s.FailedTotal)
-}
+// Stats is the counters of the run.
+type Stats = runner.Stats
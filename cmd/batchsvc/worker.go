@@ -0,0 +1,207 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
+	"gitlab.com/gpt4batch/nsq"
+	"gitlab.com/gpt4batch/runner"
+)
+
+// errDependsOn is returned for an item with dependencies in worker mode.
+var errDependsOn = errors.New("depends_on is not supported in worker mode")
+
+// worker consumes items from NSQ, runs them like the items of an input file
+// and publishes the results. failed items are requeued with backoff until
+// they run out of attempts. a result may be published more than once.
+type worker struct {
+	svc      *service
+	producer nsq.Async
+	config   *Option
+	logger   gpt4batch.Logger
+	// stop stops consuming.
+	stop func()
+}
+
+// runWorker consumes items until ctx is done or the budget is exhausted.
+// the events of the items are published with events.
+func runWorker(ctx context.Context, logger gpt4batch.Logger, config *Option, cc gpt4batch.Client, events *event.Emitter) error {
+	consumer, err := nsq.NewNSQReader(config.NSQ, logger)
+	if err != nil {
+		return err
+	}
+
+	producer, err := nsq.NewNSQWriter(config.NSQ, logger)
+	if err != nil {
+		return err
+	}
+	if err = producer.Connect(ctx); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := newWorker(config, cc, producer, logger)
+	w.svc.WithEmitter(events)
+	w.stop = cancel
+
+	concurrency := config.Goroutine
+	if concurrency <= 0 {
+		concurrency = config.NSQ.MaxInFlight
+	}
+
+	logger.
+		WithField("topic", config.WorkerTopic).
+		WithField("channel", config.WorkerChannel).
+		WithField("results_topic", config.WorkerResultsTopic).
+		Info("Worker")
+	err = consumer.Consume(ctx, config.WorkerTopic, config.WorkerChannel, concurrency, w.handle)
+
+	// Tear down the worker, allowing it a few seconds to finish any
+	// in-progress items.
+	shutdownCtx, shutdown := context.WithTimeout(context.Background(), 3*time.Second)
+	defer shutdown()
+	if cerr := consumer.Close(shutdownCtx); cerr != nil && err == nil {
+		err = cerr
+	}
+	if cerr := producer.Close(shutdownCtx); cerr != nil && err == nil {
+		err = cerr
+	}
+	if cerr := w.svc.finish(shutdownCtx); cerr != nil && err == nil {
+		err = cerr
+	}
+	if cerr := cc.Close(shutdownCtx); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	logger.
+		WithField("complete", w.svc.stats.GetCompleteTotal()).
+		WithField("success", w.svc.stats.GetSuccessTotal()).
+		WithField("failed", w.svc.stats.GetFailedTotal()).
+		Info("Worker Done")
+	return err
+}
+
+// newWorker returns a worker running the items with cc and publishing the results with producer.
+func newWorker(config *Option, cc gpt4batch.Client, producer nsq.Async, logger gpt4batch.Logger) *worker {
+	svc := NewService(config, cc, nil, new(Stats)).(*service)
+	svc.WithLogger(logger)
+	return &worker{
+		svc:      svc,
+		producer: producer,
+		config:   config,
+		logger:   svc.logger,
+		stop:     func() {},
+	}
+}
+
+// handle runs the item of the message. it returns an error to requeue the message.
+func (w *worker) handle(ctx context.Context, msg *nsq.Message) error {
+	in := new(gpt4batch.In)
+	if err := json.Unmarshal(msg.Body, in); err != nil {
+		// a malformed message can never succeed. drop it.
+		w.logger.
+			WithField("message_id", msg.ID).
+			Warn("Drop malformed message: ", err)
+		return nil
+	}
+
+	logg := w.logger.
+		WithField("id", in.ID).
+		WithField("attempts", msg.Attempts)
+
+	var (
+		err     error
+		attempt = int(msg.Attempts)
+		started = time.Now()
+	)
+	w.svc.events.Emit(ctx, w.svc.itemEvent(event.TypeItemStarted, in, attempt))
+	if len(in.DependsOn) != 0 {
+		err = &runner.AskError{Kind: gpt4batch.ErrKindValidation, Err: errDependsOn}
+	} else {
+		err = w.svc.runner.Chat(ctx, in, attempt)
+	}
+
+	if err != nil {
+		in.IErr = runner.NewIErr(err, int(msg.Attempts))
+
+		switch {
+		// the worker is shutting down. leave the item to another worker.
+		case ctx.Err() != nil:
+			return err
+		// the budget is exhausted. stop consuming and leave the item pending.
+		case errors.Is(err, errBudgetExhausted):
+			logg.Warn("Budget Exhausted")
+			w.stop()
+			return err
+		case retryable(in.IErr) && int(msg.Attempts) < w.config.WorkerMaxAttempts:
+			logg.
+				WithField("kind", in.IErr.Kind).
+				Warn("Requeue: ", err)
+			return err
+		}
+	}
+
+	// the result could not be published. requeue the item to run it again.
+	if perr := w.publish(ctx, in); perr != nil {
+		logg.Error("Publish: ", perr)
+		return perr
+	}
+
+	if err != nil {
+		w.svc.stats.IncrFailedCount()
+	} else {
+		w.svc.stats.IncrSuccessCount()
+	}
+	w.svc.stats.IncrCompleteCount()
+	w.svc.events.Emit(ctx, w.svc.itemEvent(event.TypeItemCompleted, in, attempt).Timing(started, time.Now()))
+	logg.
+		WithField("failed", err != nil).
+		Info("Published")
+	return nil
+}
+
+// publish publishes the item to the results topic.
+func (w *worker) publish(ctx context.Context, in *gpt4batch.In) error {
+	cfg := jsoniter.Config{
+		EscapeHTML: false,
+	}.Froze()
+
+	body, err := cfg.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return w.producer.WriteBatch(ctx, w.config.WorkerResultsTopic, body)
+}
+
+// retryable reports whether the item may succeed when it runs again.
+func retryable(ierr *gpt4batch.IErr) bool {
+	switch ierr.Kind {
+	case gpt4batch.ErrKindValidation, gpt4batch.ErrKindAuth, gpt4batch.ErrKindDependency:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+// memProducer records the published messages.
+type memProducer struct {
+	mu   sync.Mutex
+	err  error
+	msgs map[string][][]byte
+}
+
+func (p *memProducer) Connect(ctx context.Context) error { return nil }
+
+func (p *memProducer) WriteBatch(ctx context.Context, topic string, msg []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if p.msgs == nil {
+		p.msgs = make(map[string][][]byte)
+	}
+	p.msgs[topic] = append(p.msgs[topic], msg)
+	return nil
+}
+
+func (p *memProducer) Close(ctx context.Context) error { return nil }
+
+// failClient fails every chat with err.
+type failClient struct {
+	gpt4batch.Client
+	err error
+}
+
+func (c failClient) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	return nil, c.err
+}
+
+func Test_worker_handle(t *testing.T) {
+	config := &Option{WorkerResultsTopic: "results", WorkerMaxAttempts: 2}
+	job := []byte(`{"id": "1", "asks": [{"id": "a0", "content": "q0"}]}`)
+
+	// a successful item is published with its answers.
+	producer := new(memProducer)
+	w := newWorker(config, &recordClient{Client: client.NewNoop()}, producer, log.New(log.InfoLevel))
+	assert.NoError(t, w.handle(context.Background(), &nsq.Message{Body: job, Attempts: 1}))
+	assert.Len(t, producer.msgs["results"], 1)
+
+	var out gpt4batch.In
+	assert.NoError(t, json.Unmarshal(producer.msgs["results"][0], &out))
+	assert.Nil(t, out.IErr)
+	assert.Len(t, out.Answers, 1)
+	assert.Equal(t, uint64(1), w.svc.stats.GetSuccessTotal())
+
+	// a failed item is requeued until it runs out of attempts, then its failure is published.
+	producer = new(memProducer)
+	w = newWorker(config, failClient{Client: client.NewNoop(), err: errors.New("boom")}, producer, log.New(log.InfoLevel))
+	assert.Error(t, w.handle(context.Background(), &nsq.Message{Body: job, Attempts: 1}))
+	assert.Empty(t, producer.msgs)
+	assert.NoError(t, w.handle(context.Background(), &nsq.Message{Body: job, Attempts: 2}))
+	assert.NoError(t, json.Unmarshal(producer.msgs["results"][0], &out))
+	assert.Equal(t, gpt4batch.ErrKindChat, out.IErr.Kind)
+	assert.Equal(t, 2, out.IErr.Attempts)
+	assert.Equal(t, uint64(1), w.svc.stats.GetFailedTotal())
+
+	// an item that can never succeed is published at once.
+	producer = new(memProducer)
+	w = newWorker(config, &recordClient{Client: client.NewNoop()}, producer, log.New(log.InfoLevel))
+	assert.NoError(t, w.handle(context.Background(), &nsq.Message{Body: []byte(`{"id": "2", "asks": [{"id": "a0", "content": "q"}], "depends_on": ["1"]}`), Attempts: 1}))
+	assert.NoError(t, json.Unmarshal(producer.msgs["results"][0], &out))
+	assert.Equal(t, gpt4batch.ErrKindValidation, out.IErr.Kind)
+
+	// a malformed message is dropped.
+	assert.NoError(t, w.handle(context.Background(), &nsq.Message{Body: []byte(`{`), Attempts: 1}))
+	assert.Len(t, producer.msgs["results"], 1)
+
+	// the item is requeued when its result cannot be published.
+	producer.err = errors.New("nsqd is down")
+	assert.Error(t, w.handle(context.Background(), &nsq.Message{Body: job, Attempts: 1}))
+}
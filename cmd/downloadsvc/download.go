@@ -0,0 +1,328 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package downloadsvc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/cobra"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/reader"
+	"gitlab.com/gpt4batch/signals"
+)
+
+// task is a single file referenced by an answer.
+type task struct {
+	// id is the id of the batch.
+	id string
+	// pid is the id of the ask.
+	pid string
+	// spec is the spec download of the file.
+	spec *gpt4batch.SpecDownload
+}
+
+// report is the result of a download run.
+type report struct {
+	Total     uint64 // Total is the total number of referenced files.
+	Present   uint64 // Present is the number of files that were already complete.
+	Recovered uint64 // Recovered is the number of files downloaded again.
+	Expired   uint64 // Expired is the number of files whose link has expired.
+	Failed    uint64 // Failed is the number of files that failed for other reasons.
+
+	mu           sync.Mutex
+	expiredLinks []string
+}
+
+// NewDownloadCommand returns a new cobra.Command that re-downloads the files referenced in an output file.
+func NewDownloadCommand(ctx context.Context) *cobra.Command {
+	var (
+		option Option
+		logger = log.New(log.InfoLevel)
+	)
+
+	rootCmd := &cobra.Command{
+		Use:   "download",
+		Args:  cobra.NoArgs,
+		Short: "Re-download the files referenced in a batchsvc output file that are missing or truncated.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// validate the option. if the option is invalid, return an error.
+			if err := option.Validate(); err != nil {
+				return err
+			}
+
+			rpt, err := download(signals.WithStandardSignals(ctx), logger, &option)
+			if err != nil {
+				return err
+			}
+
+			logg := logger.
+				WithField("in", option.In).
+				WithField("dir", option.DownloadDir)
+			for _, link := range rpt.expiredLinks {
+				logg.WithField("url", link).Warn("Expired")
+			}
+
+			logg.
+				WithField("total", rpt.Total).
+				WithField("present", rpt.Present).
+				WithField("recovered", rpt.Recovered).
+				WithField("expired", rpt.Expired).
+				WithField("failed", rpt.Failed).
+				Info("Done")
+			return nil
+		},
+	}
+
+	rootCmd.Flags().StringVarP(&option.In, "in", "i", "out.jsonl", "需要补充下载文件的输出文件路径.")
+	rootCmd.Flags().StringVarP(&option.Out, "out", "o", "", "补全spec_downloads后写入的文件路径，不设置则覆盖输入文件.")
+	rootCmd.Flags().IntVarP(&option.Goroutine, "goroutine", "g", 4, "设置最大协程数量.")
+	rootCmd.Flags().StringVarP(&option.DownloadDir, "download-dir", "d", "", "下载文件夹名称.如果未设置会存在输入文件所在目录.")
+	rootCmd.Flags().StringVarP(&option.DownloadFilePrefix, "download-prefix", "p", "GPT4API", "设置文件下载前缀，防止下载文件名冲突覆盖.")
+	return rootCmd
+}
+
+// download downloads the files referenced in the input file that are missing
+// or truncated, and writes the items with the local file names they were given.
+func download(ctx context.Context, logger gpt4batch.Logger, option *Option) (*report, error) {
+	var (
+		// ins is the items of the output file.
+		ins = make(gpt4batch.Ins, 0)
+		// tasks is the files referenced by the answers.
+		tasks = make([]*task, 0)
+		// changed reports whether a spec download was added to an answer.
+		changed bool
+	)
+
+	if err := reader.Reader(option.In, func(le string) error {
+		in := new(gpt4batch.In)
+		if err := json.Unmarshal([]byte(le), in); err != nil {
+			return err
+		}
+		ins = append(ins, in)
+
+		// collect collects the files referenced by the answers of asks.
+		collect := func(asks gpt4batch.Asks, answers []interface{}) error {
+			resps, err := gpt4batch.ChatResponses(answers)
+			if err != nil {
+				return err
+			}
+
+			for idx, resp := range resps {
+				// pid is the id of the ask that produced the answer.
+				var pid string
+				if idx < len(asks) {
+					pid = asks[idx].ID
+				}
+
+				// downloads that were never assigned a local file name get one now.
+				if specDownloads(in.ID, pid, option.DownloadFilePrefix, resp) {
+					answers[idx] = resp
+					changed = true
+				}
+
+				for _, spec := range resp.SpecDownloads {
+					tasks = append(tasks, &task{id: in.ID, pid: pid, spec: spec})
+				}
+			}
+			return nil
+		}
+
+		if err := collect(in.Asks, in.Answers); err != nil {
+			return err
+		}
+		for _, b := range in.Branches {
+			if err := collect(b.Asks, b.Answers); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	rpt := &report{Total: uint64(len(tasks))}
+	cc := client.Chain(client.NewClient(), client.WithDownloader(true), client.WithLogger(logger))
+	defer cc.Close(ctx)
+
+	run(ctx, cc, remoteSize, option, tasks, rpt)
+
+	// the local file names are saved so that the next run finds the files.
+	if changed {
+		if err := write(option.Out, ins); err != nil {
+			return nil, err
+		}
+		logger.WithField("out", option.Out).Info("Write Complete")
+	}
+	return rpt, nil
+}
+
+// specDownloads adds a spec download for every download url that has none.
+// it reports whether the response was changed.
+func specDownloads(id, pid, prefix string, resp *gpt4batch.ChatResponse) bool {
+	origins := make(map[string]struct{}, len(resp.SpecDownloads))
+	for _, spec := range resp.SpecDownloads {
+		origins[spec.Origin] = struct{}{}
+	}
+
+	var changed bool
+	for _, download := range resp.Downloads {
+		if _, ok := origins[download]; ok {
+			continue
+		}
+
+		localFileName := client.DownloadFileName(id, pid, download, prefix)
+		if localFileName == "" {
+			continue
+		}
+
+		resp.SpecDownloads = append(resp.SpecDownloads, &gpt4batch.SpecDownload{
+			Origin: download,
+			Local:  localFileName,
+		})
+		changed = true
+	}
+	return changed
+}
+
+// remoteSize returns the size of the file at url from the Content-Length of
+// a HEAD request, -1 if the server does not tell it.
+func remoteSize(ctx context.Context, url string) (int64, error) {
+	resp, err := resty.New().
+		SetTimeout(30 * time.Second).
+		R().
+		SetContext(ctx).
+		Head(url)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return 0, &client.StatusError{Op: "head file", StatusCode: resp.StatusCode(), Status: resp.Status()}
+	}
+	return resp.RawResponse.ContentLength, nil
+}
+
+// complete reports whether the local file of size bytes is the complete file
+// at url. a file whose size cannot be checked against the server, e.g. because
+// the link has expired, is kept as complete since it cannot be fetched again.
+func complete(ctx context.Context, size func(ctx context.Context, url string) (int64, error), url string, local int64) bool {
+	remote, err := size(ctx, url)
+	return err != nil || remote < 0 || remote == local
+}
+
+// run downloads every task whose local file is missing, empty or truncated.
+// size returns the size of a remote file the local files are checked against.
+func run(ctx context.Context, cc gpt4batch.Client, size func(ctx context.Context, url string) (int64, error), option *Option, tasks []*task, rpt *report) {
+	var (
+		wg      sync.WaitGroup
+		current = make(chan struct{}, option.Goroutine)
+	)
+
+	for _, t := range tasks {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case current <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(t *task) {
+			defer func() {
+				<-current
+				wg.Done()
+			}()
+
+			localPath := filepath.Join(option.DownloadDir, t.spec.Local)
+			if fi, err := os.Stat(localPath); err == nil && fi.Size() > 0 && complete(ctx, size, t.spec.Origin, fi.Size()) {
+				atomic.AddUint64(&rpt.Present, 1)
+				return
+			}
+
+			err := cc.Download(ctx, &gpt4batch.DownloadRequest{
+				Source: &gpt4batch.Source{
+					ID:  t.id,
+					Pid: t.pid,
+					URL: t.spec.Origin,
+				},
+				LocalDir:      option.DownloadDir,
+				LocalFileName: t.spec.Local,
+			})
+			switch {
+			case err == nil:
+				atomic.AddUint64(&rpt.Recovered, 1)
+			case errors.Is(err, client.ErrDownloadExpired):
+				atomic.AddUint64(&rpt.Expired, 1)
+				rpt.mu.Lock()
+				rpt.expiredLinks = append(rpt.expiredLinks, t.spec.Origin)
+				rpt.mu.Unlock()
+			default:
+				atomic.AddUint64(&rpt.Failed, 1)
+			}
+		}(t)
+	}
+	wg.Wait()
+}
+
+// write writes the items to the file, replacing it atomically since it may be the input file.
+func write(filename string, ins gpt4batch.Ins) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	cfg := jsoniter.Config{
+		EscapeHTML: false,
+	}.Froze()
+
+	writer := bufio.NewWriter(file)
+	for _, in := range ins {
+		jsonStr, err := cfg.Marshal(in)
+		if err != nil {
+			return err
+		}
+		if _, err = writer.WriteString(string(jsonStr) + "\n"); err != nil {
+			return err
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
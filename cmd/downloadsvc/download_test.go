@@ -0,0 +1,134 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package downloadsvc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/log"
+)
+
+func Test_run(t *testing.T) {
+	const content = "0123456789"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"complete.txt":  content,
+		"truncated.txt": content[:4],
+		"empty.txt":     "",
+		// a truncated file whose link expired cannot be checked and is kept.
+		"kept.txt": content[:4],
+	}
+	for name, data := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644))
+	}
+
+	newTask := func(path, local string) *task {
+		return &task{id: "1", pid: "a0", spec: &gpt4batch.SpecDownload{Origin: srv.URL + path, Local: local}}
+	}
+	tasks := []*task{
+		newTask("/file", "complete.txt"),
+		newTask("/file", "truncated.txt"),
+		newTask("/file", "empty.txt"),
+		newTask("/file", "missing.txt"),
+		newTask("/gone", "kept.txt"),
+		newTask("/forbidden", "forbidden.txt"),
+		newTask("/missing", "notfound.txt"),
+		newTask("/gone", "gone.txt"),
+		newTask("/error", "error.txt"),
+	}
+
+	rpt := &report{Total: uint64(len(tasks))}
+	run(context.Background(), client.NewClient(), remoteSize, &Option{Goroutine: 2, DownloadDir: dir}, tasks, rpt)
+	assert.Equal(t, uint64(2), rpt.Present)
+	assert.Equal(t, uint64(3), rpt.Recovered)
+	assert.Equal(t, uint64(3), rpt.Expired)
+	assert.Equal(t, uint64(1), rpt.Failed)
+	assert.Len(t, rpt.expiredLinks, 3)
+
+	for _, name := range []string{"complete.txt", "truncated.txt", "empty.txt", "missing.txt"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(data), name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "kept.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, content[:4], string(data))
+
+	// the failed downloads leave neither the file nor its temporary file behind.
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, len(files)+1)
+}
+
+func Test_download_rerun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "cat.png", time.Time{}, strings.NewReader("cat"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "out.jsonl")
+	line := `{"id":"1","asks":[{"id":"a0","content":"draw"}],"answers":[{"downloads":["` +
+		srv.URL + `/files/cat?rscd=attachment;%20filename=cat.png"]}]}` + "\n"
+	assert.NoError(t, os.WriteFile(in, []byte(line), 0o644))
+
+	// without out the local file names are written back to the input file.
+	option := &Option{In: in, Goroutine: 1}
+	assert.NoError(t, option.Validate())
+	rpt, err := download(context.Background(), log.New(log.InfoLevel), option)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), rpt.Recovered)
+
+	// the next run finds the downloaded file.
+	option = &Option{In: in, Goroutine: 1}
+	assert.NoError(t, option.Validate())
+	rpt, err = download(context.Background(), log.New(log.InfoLevel), option)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), rpt.Present)
+	assert.Equal(t, uint64(0), rpt.Recovered)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
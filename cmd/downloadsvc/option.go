@@ -0,0 +1,75 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package downloadsvc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/asaskevich/govalidator"
+)
+
+// Option is the option of the download service.
+type Option struct {
+	// In is the output file of a finished batch run.
+	// 需要补充下载的输出文件
+	In string
+	// Out is the file the updated items are written to, In if empty.
+	// 补全spec_downloads后写入的文件，不传则覆盖输入文件
+	Out string
+	// Goroutine is the goroutine.
+	// 设置并发数
+	Goroutine int
+	// DownloadDir is the download dir.
+	// 下载文件文件夹，不传默认输入文件所在文件夹
+	DownloadDir string
+	// DownloadFilePrefix is the download file prefix.
+	// 设置下载文件前缀
+	DownloadFilePrefix string
+}
+
+// Validate validates the option.
+func (o *Option) Validate() error {
+	if govalidator.IsNull(o.In) {
+		return errors.New("in is required")
+	}
+
+	// the local file names are written back to the input file by default,
+	// so that the next run finds the downloaded files.
+	if govalidator.IsNull(o.Out) {
+		o.Out = o.In
+	}
+
+	if o.Goroutine <= 0 {
+		return errors.New("goroutine must be greater than 0")
+	}
+
+	// DownloadDir is null, use the directory of the input file.
+	if govalidator.IsNull(o.DownloadDir) {
+		localInDir, err := filepath.Abs(o.In)
+		if err != nil {
+			return err
+		}
+		o.DownloadDir = filepath.Dir(localInDir)
+	} else {
+		if _, err := os.Stat(o.DownloadDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
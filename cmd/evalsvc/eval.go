@@ -0,0 +1,405 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package evalsvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/cobra"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/reader"
+	"gitlab.com/gpt4batch/signals"
+)
+
+// defaultRubric is the rubric used when no rubric file is set.
+const defaultRubric = `You are a strict grader. Grade the answer to the question on a scale from 0 to 10.
+
+Question:
+{{ .Ask }}
+
+Answer:
+{{ .Answer }}
+
+Reply with a single JSON object: {"score": <number>, "rationale": "<one or two sentences>"}`
+
+// untagged is the tag of the items without a tag.
+const untagged = "-"
+
+// errNoScore is returned when the judge reply has no score.
+var errNoScore = errors.New("judge reply has no score")
+
+// scoreRe matches a score written in plain text.
+var scoreRe = regexp.MustCompile(`(?i)score\W{0,3}(-?\d+(?:\.\d+)?)`)
+
+// pair is an ask and its answer to grade.
+type pair struct {
+	// ID is the id of the item.
+	ID string
+	// AskID is the id of the ask.
+	AskID string
+	// Tag is the tag of the item.
+	Tag string
+	// Ask is the content of the ask.
+	Ask string
+	// Answer is the text of the answer.
+	Answer string
+	// Extra is the extra of the item.
+	Extra interface{}
+}
+
+// Grade is the grade of a pair.
+type Grade struct {
+	ID        string   `json:"id"`
+	AskID     string   `json:"ask_id"`
+	Tag       string   `json:"tag"`
+	Score     *float64 `json:"score,omitempty"`
+	Rationale string   `json:"rationale,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Stats is the aggregate statistics of a group of grades.
+type Stats struct {
+	Count  int     `json:"count"`
+	Failed int     `json:"failed"`
+	Mean   float64 `json:"mean"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+// Report is the evaluation report.
+type Report struct {
+	Overall *Stats            `json:"overall"`
+	Tags    map[string]*Stats `json:"tags"`
+	Grades  []*Grade          `json:"grades"`
+}
+
+// NewEvalCommand returns a new cobra.Command that grades the answers of a
+// finished output file with a judge model.
+func NewEvalCommand(ctx context.Context) *cobra.Command {
+	var (
+		option Option
+		logger = log.New(log.InfoLevel)
+	)
+
+	rootCmd := &cobra.Command{
+		Use:   "eval",
+		Args:  cobra.NoArgs,
+		Short: "Grade the answers of a batchsvc output file with a judge model and report statistics per tag.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// validate the option. if the option is invalid, return an error.
+			if err := option.Validate(); err != nil {
+				return err
+			}
+
+			logg := logger.
+				WithField("in", option.In).
+				WithField("out", option.Out)
+
+			rubric := defaultRubric
+			if option.Rubric != "" {
+				raw, err := os.ReadFile(option.Rubric)
+				if err != nil {
+					return err
+				}
+				rubric = string(raw)
+			}
+			tmpl, err := template.New("rubric").Option("missingkey=error").Parse(rubric)
+			if err != nil {
+				return err
+			}
+
+			// pairs is the asks and answers of the successful items.
+			pairs := make([]*pair, 0)
+			if err := reader.Reader(option.In, func(le string) error {
+				in := new(gpt4batch.In)
+				if err := json.Unmarshal([]byte(le), in); err != nil {
+					return err
+				}
+				if in.IErr != nil {
+					return nil
+				}
+
+				ps, err := collect(in, option.Tag)
+				if err != nil {
+					return err
+				}
+				pairs = append(pairs, ps...)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			cc := client.Chain(client.NewClient(), client.WithLogger(logger))
+			defer cc.Close(ctx)
+
+			grades := judge(signals.WithStandardSignals(ctx), cc, &option, tmpl, pairs)
+			report := aggregate(grades)
+			if err := write(option.Out, report); err != nil {
+				return err
+			}
+
+			tags := make([]string, 0, len(report.Tags))
+			for tag := range report.Tags {
+				tags = append(tags, tag)
+			}
+			sort.Strings(tags)
+			for _, tag := range tags {
+				st := report.Tags[tag]
+				logg.
+					WithField("tag", tag).
+					WithField("count", st.Count).
+					WithField("failed", st.Failed).
+					WithField("mean", st.Mean).
+					Info("Tag")
+			}
+
+			logg.
+				WithField("count", report.Overall.Count).
+				WithField("failed", report.Overall.Failed).
+				WithField("mean", report.Overall.Mean).
+				Info("Done")
+			return nil
+		},
+	}
+
+	rootCmd.Flags().StringVarP(&option.In, "in", "i", "out.jsonl", "已跑完的输出文件路径.")
+	rootCmd.Flags().StringVarP(&option.Out, "out", "o", "eval.json", "评测报告文件路径.")
+	rootCmd.Flags().StringVarP(&option.Rubric, "rubric", "r", "", "评分提示词模板文件,可用{{ .Ask }} {{ .Answer }} {{ .ID }} {{ .AskID }} {{ .Extra }},不设置则使用默认模板.")
+	rootCmd.Flags().StringVarP(&option.URL, "url", "u", "https://beta.gpt4api.plus/standard/all-tools", "设置评分模型的对话服务地址.")
+	rootCmd.Flags().StringVarP(&option.Model, "model", "m", "gpt-4", "设置评分模型.")
+	rootCmd.Flags().StringVarP(&option.GizmoId, "gizmo-id", "z", "", "设置评分GPTs gizmo id的名称.")
+	rootCmd.Flags().IntVarP(&option.Goroutine, "goroutine", "g", 4, "设置最大协程数量.")
+	rootCmd.Flags().StringVarP(&option.Tag, "tag", "t", "tag", "按extra中该字段分组统计,extra为字符串时直接作为分组.")
+	return rootCmd
+}
+
+// collect returns the asks and answers of the item and its branches.
+func collect(in *gpt4batch.In, key string) ([]*pair, error) {
+	tag := tagOf(in.Extra, key)
+
+	pairs := make([]*pair, 0, len(in.Answers))
+	add := func(asks gpt4batch.Asks, answers []interface{}) error {
+		resps, err := gpt4batch.ChatResponses(answers)
+		if err != nil {
+			return err
+		}
+		for idx, resp := range resps {
+			if idx >= len(asks) {
+				break
+			}
+			pairs = append(pairs, &pair{
+				ID:     in.ID,
+				AskID:  asks[idx].ID,
+				Tag:    tag,
+				Ask:    asks[idx].Content,
+				Answer: resp.Text(),
+				Extra:  in.Extra,
+			})
+		}
+		return nil
+	}
+
+	if err := add(in.Asks, in.Answers); err != nil {
+		return nil, err
+	}
+	for _, b := range in.Branches {
+		if err := add(b.Asks, b.Answers); err != nil {
+			return nil, err
+		}
+	}
+	return pairs, nil
+}
+
+// tagOf returns the tag of the extra. a string extra is the tag itself.
+func tagOf(extra interface{}, key string) string {
+	switch e := extra.(type) {
+	case string:
+		if e != "" {
+			return e
+		}
+	case map[string]interface{}:
+		if v, ok := e[key]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return untagged
+}
+
+// judge grades every pair with the judge model.
+func judge(ctx context.Context, cc gpt4batch.Client, option *Option, tmpl *template.Template, pairs []*pair) []*Grade {
+	var (
+		wg      sync.WaitGroup
+		current = make(chan struct{}, option.Goroutine)
+		grades  = make([]*Grade, len(pairs))
+	)
+
+	for idx, p := range pairs {
+		grades[idx] = &Grade{ID: p.ID, AskID: p.AskID, Tag: p.Tag}
+
+		select {
+		case <-ctx.Done():
+			grades[idx].Error = ctx.Err().Error()
+			continue
+		case current <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(p *pair, g *Grade) {
+			defer func() {
+				<-current
+				wg.Done()
+			}()
+
+			score, rationale, err := grade(ctx, cc, option, tmpl, p)
+			if err != nil {
+				g.Error = err.Error()
+				return
+			}
+			g.Score, g.Rationale = &score, rationale
+		}(p, grades[idx])
+	}
+	wg.Wait()
+	return grades
+}
+
+// grade asks the judge model to grade the pair.
+func grade(ctx context.Context, cc gpt4batch.Client, option *Option, tmpl *template.Template, p *pair) (float64, string, error) {
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, p); err != nil {
+		return 0, "", err
+	}
+
+	resp, err := cc.Chat(ctx, &gpt4batch.ChatRequest{
+		Source: &gpt4batch.Source{
+			ID:          p.ID,
+			URL:         option.URL,
+			Name:        "Judge",
+			Pid:         p.AskID,
+			AccessToken: option.AccessToken,
+		},
+		GizmoId:                    option.GizmoId,
+		Message:                    message.String(),
+		Model:                      option.Model,
+		HistoryAndTrainingDisabled: true,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	return parse(resp.Text())
+}
+
+// parse returns the score and rationale of the judge reply. the reply is
+// expected to hold a json object with a score, a plain "score: n" is accepted too.
+func parse(text string) (float64, string, error) {
+	for idx := strings.IndexByte(text, '{'); idx >= 0; {
+		var v struct {
+			Score     *json.Number `json:"score"`
+			Rationale string       `json:"rationale"`
+		}
+		if err := json.NewDecoder(strings.NewReader(text[idx:])).Decode(&v); err == nil && v.Score != nil {
+			score, err := v.Score.Float64()
+			if err != nil {
+				return 0, "", err
+			}
+			return score, v.Rationale, nil
+		}
+
+		next := strings.IndexByte(text[idx+1:], '{')
+		if next < 0 {
+			break
+		}
+		idx += next + 1
+	}
+
+	if m := scoreRe.FindStringSubmatch(text); m != nil {
+		score, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return 0, "", err
+		}
+		return score, strings.TrimSpace(text), nil
+	}
+	return 0, "", errNoScore
+}
+
+// aggregate returns the report of the grades.
+func aggregate(grades []*Grade) *Report {
+	report := &Report{
+		Overall: new(Stats),
+		Tags:    make(map[string]*Stats),
+		Grades:  grades,
+	}
+
+	sums := make(map[*Stats]float64)
+	add := func(st *Stats, g *Grade) {
+		if g.Score == nil {
+			st.Failed++
+			return
+		}
+		if st.Count == 0 || *g.Score < st.Min {
+			st.Min = *g.Score
+		}
+		if st.Count == 0 || *g.Score > st.Max {
+			st.Max = *g.Score
+		}
+		st.Count++
+		sums[st] += *g.Score
+	}
+
+	for _, g := range grades {
+		st, ok := report.Tags[g.Tag]
+		if !ok {
+			st = new(Stats)
+			report.Tags[g.Tag] = st
+		}
+		add(st, g)
+		add(report.Overall, g)
+	}
+
+	for st, sum := range sums {
+		st.Mean = math.Round(sum/float64(st.Count)*100) / 100
+	}
+	return report
+}
+
+// write writes the report to the file.
+func write(filename string, report *Report) error {
+	cfg := jsoniter.Config{
+		EscapeHTML: false,
+	}.Froze()
+
+	jsonStr, err := cfg.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(jsonStr, '\n'), 0644)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package evalsvc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+// judgeClient replies with the score written after "score=" in the message.
+type judgeClient struct {
+	gpt4batch.Client
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (c *judgeClient) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	c.mu.Lock()
+	c.msgs = append(c.msgs, req.Message)
+	c.mu.Unlock()
+	return &gpt4batch.ChatResponse{Contents: []interface{}{strings.TrimPrefix(req.Message, "A:")}}, nil
+}
+
+func Test_parse(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		score     float64
+		rationale string
+		err       bool
+	}{
+		{"json", `{"score": 8, "rationale": "good"}`, 8, "good", false},
+		{"fenced", "```json\n{\"score\": 6.5, \"rationale\": \"ok\"}\n```", 6.5, "ok", false},
+		{"skip invalid", `{oops} {"score": 3}`, 3, "", false},
+		{"plain", "Score: 7\nclear and correct", 7, "Score: 7\nclear and correct", false},
+		{"none", "no idea", 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, rationale, err := parse(tt.text)
+			if tt.err {
+				assert.ErrorIs(t, err, errNoScore)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.score, score)
+			assert.Equal(t, tt.rationale, rationale)
+		})
+	}
+}
+
+func Test_collect(t *testing.T) {
+	in := &gpt4batch.In{
+		ID:      "1",
+		Asks:    gpt4batch.Asks{{ID: "a0", Content: "q0"}},
+		Answers: []interface{}{&gpt4batch.ChatResponse{Contents: []interface{}{"r0"}}},
+		Extra:   map[string]interface{}{"tag": "math"},
+		Branches: gpt4batch.Branches{{
+			ID:      "b",
+			Asks:    gpt4batch.Asks{{ID: "b0", Content: "q1"}},
+			Answers: []interface{}{&gpt4batch.ChatResponse{Contents: []interface{}{"r1"}}},
+		}},
+	}
+	pairs, err := collect(in, "tag")
+	assert.NoError(t, err)
+	assert.Len(t, pairs, 2)
+	assert.Equal(t, &pair{ID: "1", AskID: "b0", Tag: "math", Ask: "q1", Answer: "r1", Extra: in.Extra}, pairs[1])
+
+	assert.Equal(t, "zh", tagOf("zh", "tag"))
+	assert.Equal(t, untagged, tagOf(nil, "tag"))
+	assert.Equal(t, untagged, tagOf(map[string]interface{}{"lang": "zh"}, "tag"))
+}
+
+func Test_judge(t *testing.T) {
+	tmpl := template.Must(template.New("rubric").Parse(`A:{{ .Answer }}`))
+	pairs := []*pair{
+		{ID: "1", AskID: "a0", Tag: "math", Answer: `{"score": 8, "rationale": "good"}`},
+		{ID: "2", AskID: "a0", Tag: "math", Answer: `{"score": 4}`},
+		{ID: "3", AskID: "a0", Tag: "poem", Answer: `no score`},
+	}
+	cc := &judgeClient{Client: client.NewNoop()}
+	grades := judge(context.Background(), cc, &Option{Goroutine: 2}, tmpl, pairs)
+	assert.Len(t, cc.msgs, 3)
+
+	report := aggregate(grades)
+	assert.Equal(t, &Stats{Count: 2, Failed: 1, Mean: 6, Min: 4, Max: 8}, report.Overall)
+	assert.Equal(t, &Stats{Count: 2, Mean: 6, Min: 4, Max: 8}, report.Tags["math"])
+	assert.Equal(t, &Stats{Failed: 1}, report.Tags["poem"])
+	assert.Equal(t, "good", grades[0].Rationale)
+	assert.Equal(t, errNoScore.Error(), grades[2].Error)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package evalsvc
+
+import (
+	"errors"
+
+	"github.com/asaskevich/govalidator"
+
+	"gitlab.com/gpt4batch"
+)
+
+// Option is the option of the evaluation service.
+type Option struct {
+	// In is the output file of a finished batch run.
+	// 已跑完的输出文件
+	In string
+	// Out is the evaluation report file.
+	// 评测报告文件
+	Out string
+	// Rubric is the rubric prompt template file, the default rubric is used if not set.
+	// 评分提示词模板文件，不设置则使用默认模板
+	Rubric string
+	// URL is the chat url of the judge.
+	// 评分模型的对话服务地址
+	URL string
+	// Model is the model of the judge.
+	// 评分模型名称
+	Model string
+	// GizmoId is the gizmo id of the judge.
+	// 评分GPTs模型ID
+	GizmoId string
+	// Goroutine is the goroutine.
+	// 设置并发数
+	Goroutine int
+	// Tag is the key of the extra field the statistics are grouped by.
+	// 按extra中该字段分组统计
+	Tag string
+	// AccessToken is the access token file.
+	// 访问令牌
+	AccessToken string
+}
+
+// Validate validates the option.
+func (o *Option) Validate() error {
+	if govalidator.IsNull(o.In) {
+		return errors.New("in is required")
+	}
+
+	if govalidator.IsNull(o.Out) {
+		return errors.New("out is required")
+	}
+
+	if o.In == o.Out {
+		return errors.New("out must differ from in")
+	}
+
+	if !govalidator.IsURL(o.URL) {
+		return errors.New("url is invalid")
+	}
+
+	if govalidator.IsNull(o.Model) {
+		return errors.New("model is required")
+	}
+
+	if o.Goroutine <= 0 {
+		return errors.New("goroutine must be greater than 0")
+	}
+
+	// get credentials from access token filepath.
+	ak, err := gpt4batch.ParseCredentials(o.AccessToken)
+	if err != nil {
+		return err
+	}
+	o.AccessToken = ak
+	return nil
+}
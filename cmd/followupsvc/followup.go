@@ -0,0 +1,168 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package followupsvc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/cobra"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/reader"
+)
+
+// NewFollowupCommand returns a new cobra.Command that builds a follow-up input
+// continuing every conversation of a finished output file with new asks.
+func NewFollowupCommand(ctx context.Context) *cobra.Command {
+	var (
+		option Option
+		logger = log.New(log.InfoLevel)
+	)
+
+	rootCmd := &cobra.Command{
+		Use:   "followup",
+		Args:  cobra.NoArgs,
+		Short: "Build a batchsvc input that continues each conversation of a finished output file with new asks.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// validate the option. if the option is invalid, return an error.
+			if err := option.Validate(); err != nil {
+				return err
+			}
+
+			logg := logger.
+				WithField("in", option.In).
+				WithField("asks", option.Asks).
+				WithField("out", option.Out)
+
+			// read the follow-up asks. each line is a json ask.
+			asks := make(gpt4batch.Asks, 0)
+			if err := reader.Reader(option.Asks, func(le string) error {
+				if strings.TrimSpace(le) == "" {
+					return nil
+				}
+
+				ask := new(gpt4batch.Ask)
+				if err := json.Unmarshal([]byte(le), ask); err != nil {
+					return err
+				}
+				asks = append(asks, ask)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if len(asks) == 0 {
+				return errors.New("asks has no ask")
+			}
+
+			file, err := os.Create(option.Out)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			var (
+				writer = bufio.NewWriter(file)
+				cfg    = jsoniter.Config{EscapeHTML: false}.Froze()
+				// continued is the number of conversations continued.
+				continued = 0
+				// skipped is the number of items without a conversation to continue.
+				skipped = 0
+			)
+
+			if err := reader.Reader(option.In, func(le string) error {
+				in := new(gpt4batch.In)
+				if err := json.Unmarshal([]byte(le), in); err != nil {
+					return err
+				}
+
+				next := followup(in, asks, option.IncludeFailed)
+				if next == nil {
+					skipped++
+					logg.WithField("id", in.ID).Warn("Skip")
+					return nil
+				}
+
+				jsonStr, err := cfg.Marshal(next)
+				if err != nil {
+					return err
+				}
+				if _, err = writer.WriteString(string(jsonStr) + "\n"); err != nil {
+					return err
+				}
+				continued++
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if err = writer.Flush(); err != nil {
+				return err
+			}
+
+			logg.
+				WithField("continued", continued).
+				WithField("skipped", skipped).
+				Info("Done")
+			return file.Sync()
+		},
+	}
+
+	rootCmd.Flags().StringVarP(&option.In, "in", "i", "out.jsonl", "已跑完的输出文件路径.")
+	rootCmd.Flags().StringVarP(&option.Asks, "asks", "a", "asks.jsonl", "追问文件路径，每行一个问题,格式同asks.")
+	rootCmd.Flags().StringVarP(&option.Out, "out", "o", "followup.jsonl", "生成的追问输入文件路径.")
+	rootCmd.Flags().BoolVarP(&option.IncludeFailed, "include-failed", "f", false, "是否同时追问失败题已回答的部分.")
+	return rootCmd
+}
+
+// followup returns the item that continues the conversation of in with asks,
+// nil if in has no answer to continue from.
+func followup(in *gpt4batch.In, asks gpt4batch.Asks, includeFailed bool) *gpt4batch.In {
+	if in.IErr != nil && !includeFailed {
+		return nil
+	}
+
+	resps, err := in.ChatResponses()
+	if err != nil || len(resps) == 0 {
+		return nil
+	}
+
+	last := resps[len(resps)-1]
+	if last.ConversationID == "" || last.MessageID == "" {
+		return nil
+	}
+
+	next := &gpt4batch.In{
+		ID:              in.ID,
+		Asks:            make(gpt4batch.Asks, 0, len(asks)),
+		Extra:           in.Extra,
+		ConversationID:  last.ConversationID,
+		ParentMessageID: last.MessageID,
+	}
+	for _, ask := range asks {
+		cp := *ask
+		next.Asks = append(next.Asks, &cp)
+	}
+	return next
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package followupsvc
+
+import (
+	"errors"
+
+	"github.com/asaskevich/govalidator"
+)
+
+// Option is the option of the follow-up service.
+type Option struct {
+	// In is the output file of a finished batch run.
+	// 已跑完的输出文件
+	In string
+	// Asks is the file of the follow-up asks, one ask per line.
+	// 追问文件，每行一个问题
+	Asks string
+	// Out is the follow-up input file.
+	// 生成的追问输入文件
+	Out string
+	// IncludeFailed continues the failed items from their last answer too.
+	// 是否同时追问失败题已回答的部分
+	IncludeFailed bool
+}
+
+// Validate validates the option.
+func (o Option) Validate() error {
+	if govalidator.IsNull(o.In) {
+		return errors.New("in is required")
+	}
+
+	if govalidator.IsNull(o.Asks) {
+		return errors.New("asks is required")
+	}
+
+	if govalidator.IsNull(o.Out) {
+		return errors.New("out is required")
+	}
+
+	if o.In == o.Out {
+		return errors.New("out must differ from in")
+	}
+	return nil
+}
@@ -25,6 +25,10 @@ import (
 	"github.com/spf13/cobra"
 	"gitlab.com/gpt4batch/cmd/authsvc"
 	"gitlab.com/gpt4batch/cmd/batchsvc"
+	"gitlab.com/gpt4batch/cmd/downloadsvc"
+	"gitlab.com/gpt4batch/cmd/evalsvc"
+	"gitlab.com/gpt4batch/cmd/followupsvc"
+	"gitlab.com/gpt4batch/cmd/querysvc"
 )
 
 func main() {
@@ -38,6 +42,10 @@ func main() {
 	rootCmd := NewCommand()
 	rootCmd.AddCommand(authsvc.NewAuthenticationCommand(ctx))
 	rootCmd.AddCommand(batchsvc.NewBatchCommand(ctx))
+	rootCmd.AddCommand(downloadsvc.NewDownloadCommand(ctx))
+	rootCmd.AddCommand(followupsvc.NewFollowupCommand(ctx))
+	rootCmd.AddCommand(evalsvc.NewEvalCommand(ctx))
+	rootCmd.AddCommand(querysvc.NewQueryCommand(ctx))
 	rootCmd.SilenceUsage = true
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -0,0 +1,51 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package querysvc
+
+import (
+	"errors"
+
+	"github.com/asaskevich/govalidator"
+)
+
+// Option is the option of the query command.
+type Option struct {
+	// DB is the sqlite database written by batchsvc --sink sqlite://.
+	// batchsvc通过--sink sqlite://写入的数据库文件
+	DB string
+	// Run is the id of the run queried, every run if empty, the last run if "last".
+	// 查询的运行id，为空查询全部运行，last为最近一次运行
+	Run string
+	// Limit is the max number of rows.
+	// 最多输出行数
+	Limit int
+	// JSON prints the rows as json lines.
+	// 是否按JSON每行输出
+	JSON bool
+}
+
+// Validate validates the option.
+func (o *Option) Validate() error {
+	if govalidator.IsNull(o.DB) {
+		return errors.New("db is required")
+	}
+
+	if o.Limit <= 0 {
+		return errors.New("limit must be greater than 0")
+	}
+	return nil
+}
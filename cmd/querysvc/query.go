@@ -0,0 +1,154 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package querysvc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/cobra"
+
+	"gitlab.com/gpt4batch/store"
+)
+
+// question is a question answered from the store.
+type question func(ctx context.Context, s *store.Store, option *Option, args []string) (*store.Table, error)
+
+// NewQueryCommand returns a new cobra.Command for querying the runs stored by batchsvc.
+func NewQueryCommand(ctx context.Context) *cobra.Command {
+	var option Option
+
+	rootCmd := &cobra.Command{
+		Use:   "query",
+		Args:  cobra.NoArgs,
+		Short: "Query the runs, items, asks and answers stored by batchsvc --sink sqlite://.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.PrintErrf("See '%s -h' for help\n", cmd.CommandPath())
+		},
+	}
+
+	// subcommand returns the subcommand answering q.
+	subcommand := func(use, short string, args cobra.PositionalArgs, q question) *cobra.Command {
+		return &cobra.Command{
+			Use:   use,
+			Short: short,
+			Args:  args,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return run(ctx, cmd.OutOrStdout(), &option, args, q)
+			},
+		}
+	}
+
+	rootCmd.AddCommand(
+		subcommand("runs", "List the runs, the last started first.", cobra.NoArgs,
+			func(ctx context.Context, s *store.Store, option *Option, _ []string) (*store.Table, error) {
+				return s.Runs(ctx, option.Limit)
+			}),
+		subcommand("failures", "Count the failed items by error kind and code.", cobra.NoArgs,
+			func(ctx context.Context, s *store.Store, option *Option, _ []string) (*store.Table, error) {
+				return s.Failures(ctx, option.Run)
+			}),
+		subcommand("slowest", "List the slowest answered asks.", cobra.NoArgs,
+			func(ctx context.Context, s *store.Store, option *Option, _ []string) (*store.Table, error) {
+				return s.Slowest(ctx, option.Run, option.Limit)
+			}),
+		subcommand("search <text>", "List the answers containing the text.", cobra.ExactArgs(1),
+			func(ctx context.Context, s *store.Store, option *Option, args []string) (*store.Table, error) {
+				return s.Search(ctx, option.Run, args[0], option.Limit)
+			}),
+		subcommand("sql <statement>", "Run a sql statement on the read-only database.", cobra.ExactArgs(1),
+			func(ctx context.Context, s *store.Store, _ *Option, args []string) (*store.Table, error) {
+				return s.Query(ctx, args[0])
+			}),
+	)
+
+	rootCmd.PersistentFlags().StringVar(&option.DB, "db", "results.db", "batchsvc通过--sink sqlite://写入的数据库文件.")
+	rootCmd.PersistentFlags().StringVar(&option.Run, "run", "", "查询的运行id，为空查询全部运行，last为最近一次运行.")
+	rootCmd.PersistentFlags().IntVarP(&option.Limit, "limit", "n", 20, "最多输出行数.")
+	rootCmd.PersistentFlags().BoolVar(&option.JSON, "json", false, "是否按JSON每行输出.")
+	return rootCmd
+}
+
+// run answers q from the store of the option and prints the rows to w.
+func run(ctx context.Context, w io.Writer, option *Option, args []string, q question) error {
+	// validate the option. if the option is invalid, return an error.
+	if err := option.Validate(); err != nil {
+		return err
+	}
+
+	s, err := store.OpenReadOnly(option.DB)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	opt := *option
+	if opt.Run == "last" {
+		if opt.Run, err = s.LastRun(ctx); err != nil {
+			return err
+		}
+	}
+
+	t, err := q(ctx, s, &opt, args)
+	if err != nil {
+		return err
+	}
+	if option.JSON {
+		return printJSON(w, t)
+	}
+	return printTable(w, t)
+}
+
+// printTable prints the rows aligned in columns.
+func printTable(w io.Writer, t *store.Table) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(t.Columns, "\t")))
+	for _, row := range t.Rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			if v != nil {
+				cells[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(fmt.Sprint(v))
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printJSON prints each row as a json object.
+func printJSON(w io.Writer, t *store.Table) error {
+	cfg := jsoniter.Config{
+		EscapeHTML:  false,
+		SortMapKeys: true,
+	}.Froze()
+
+	enc := cfg.NewEncoder(w)
+	for _, row := range t.Rows {
+		obj := make(map[string]interface{}, len(row))
+		for i, v := range row {
+			obj[t.Columns[i]] = v
+		}
+		if err := enc.Encode(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
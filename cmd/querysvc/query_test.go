@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package querysvc
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
+	"gitlab.com/gpt4batch/store"
+)
+
+func TestNewQueryCommand(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "results.db")
+	)
+	s, err := store.Open(path)
+	assert.NoError(t, err)
+	for _, ev := range []*event.Event{
+		{Type: event.TypeItemCompleted, Run: "r1", Time: 1000, InID: "1", Error: &gpt4batch.IErr{Code: 502, Kind: gpt4batch.ErrKindChat, Message: "bad gateway"}},
+		{Type: event.TypeItemCompleted, Run: "r2", Time: 2000, InID: "1", Error: &gpt4batch.IErr{Code: 429, Kind: gpt4batch.ErrKindQuota, Message: "slow down"}},
+	} {
+		assert.NoError(t, s.Record(ctx, ev))
+	}
+	assert.NoError(t, s.Close())
+
+	query := func(args ...string) string {
+		out := new(bytes.Buffer)
+		cmd := NewQueryCommand(ctx)
+		cmd.SetOut(out)
+		cmd.SetArgs(append([]string{"--db", path}, args...))
+		assert.NoError(t, cmd.Execute())
+		return out.String()
+	}
+
+	assert.Equal(t, "KIND   CODE  ITEMS  MESSAGE\nquota  429   1      slow down\n", query("failures", "--run", "last"))
+	assert.Equal(t, "{\"code\":502,\"items\":1,\"kind\":\"chat\",\"message\":\"bad gateway\"}\n", query("failures", "--run", "r1", "--json"))
+	assert.Equal(t, "N\n2\n", query("sql", "SELECT COUNT(*) AS n FROM runs"))
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package event defines the versioned events published to the sinks while a
+// batch runs, and encodes them as JSON or protobuf.
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+// Version is the version of the event schema. it changes when a field is
+// removed or its meaning changes, not when a field is added.
+const Version = 1
+
+// Type is the type of an event.
+type Type string
+
+const (
+	// TypeItemStarted is an item started running.
+	TypeItemStarted Type = "item.started"
+	// TypeAskCompleted is an ask was answered.
+	TypeAskCompleted Type = "ask.completed"
+	// TypeAskFailed is an ask failed.
+	TypeAskFailed Type = "ask.failed"
+	// TypeItemCompleted is an item finished, Error is set if it failed.
+	TypeItemCompleted Type = "item.completed"
+	// TypeRunFinished is the run finished, Stats is set.
+	TypeRunFinished Type = "run.finished"
+)
+
+// Types is every event type.
+var Types = []Type{TypeItemStarted, TypeAskCompleted, TypeAskFailed, TypeItemCompleted, TypeRunFinished}
+
+// Encoding is the encoding of the published events.
+type Encoding string
+
+const (
+	// EncodingJSON encodes the events as JSON.
+	EncodingJSON Encoding = "json"
+	// EncodingProtobuf encodes the events as the Event message of event.proto.
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// Event is an event of a run.
+type Event struct {
+	// Version is the version of the schema.
+	Version int `json:"version"`
+	// ID is the unique id of the event.
+	ID   string `json:"id"`
+	Type Type   `json:"type"`
+	// Time is the unix time in milliseconds the event happened at.
+	Time int64 `json:"time"`
+	// Run is the id of the run the event belongs to.
+	Run string `json:"run"`
+	// InID is the id of the in.
+	InID string `json:"in_id,omitempty"`
+	// AskID is the id of the ask.
+	AskID string `json:"ask_id,omitempty"`
+	// BranchID is the id of the branch of the ask, empty for the asks of the in.
+	BranchID string `json:"branch_id,omitempty"`
+	Model    string `json:"model,omitempty"`
+	GizmoID  string `json:"gizmo_id,omitempty"`
+	// Attempt is the number of times the item has been run, including this one.
+	Attempt int `json:"attempt,omitempty"`
+	// Started is the unix time in milliseconds the ask or item started at.
+	Started int64 `json:"started,omitempty"`
+	// Finished is the unix time in milliseconds the ask or item finished at.
+	Finished int64 `json:"finished,omitempty"`
+	// Elapsed is the duration of the ask or item in milliseconds.
+	Elapsed int64 `json:"elapsed,omitempty"`
+	// Ask is the content sent for the ask.
+	Ask string `json:"ask,omitempty"`
+	// Images is the images uploaded with the ask.
+	Images []string `json:"images,omitempty"`
+	// Files is the files uploaded with the ask.
+	Files []string `json:"files,omitempty"`
+	// Answer is the answer of the ask.
+	Answer *gpt4batch.ChatResponse `json:"answer,omitempty"`
+	// Error is the error of the ask or item.
+	Error *gpt4batch.IErr `json:"error,omitempty"`
+	// Extra is the extra of the in.
+	Extra interface{} `json:"extra,omitempty"`
+	// Stats is the statistics of the run.
+	Stats *Stats `json:"stats,omitempty"`
+}
+
+// Stats is the statistics of a run.
+type Stats struct {
+	Total     uint64 `json:"total"`
+	Completed uint64 `json:"completed"`
+	Succeeded uint64 `json:"succeeded"`
+	Failed    uint64 `json:"failed"`
+	Skipped   uint64 `json:"skipped"`
+}
+
+// Timing sets the timings of the event from started to finished.
+func (e *Event) Timing(started, finished time.Time) *Event {
+	e.Started = started.UnixMilli()
+	e.Finished = finished.UnixMilli()
+	e.Elapsed = finished.Sub(started).Milliseconds()
+	return e
+}
+
+// Marshal encodes the event.
+func (e *Event) Marshal(encoding Encoding) ([]byte, error) {
+	switch encoding {
+	case EncodingJSON, "":
+		return json.Marshal(e)
+	case EncodingProtobuf:
+		return MarshalProto(e)
+	}
+	return nil, fmt.Errorf("unknown event encoding %q", encoding)
+}
+
+// ParseTypes returns the event types of names, every type if names is empty.
+func ParseTypes(names []string) (map[Type]bool, error) {
+	types := make(map[Type]bool, len(Types))
+	if len(names) == 0 {
+		for _, typ := range Types {
+			types[typ] = true
+		}
+		return types, nil
+	}
+
+	for _, name := range names {
+		typ := Type(name)
+		valid := false
+		for _, t := range Types {
+			valid = valid || t == typ
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		types[typ] = true
+	}
+	return types, nil
+}
+
+// Emitter publishes the events of a run to a sink. a nil Emitter discards
+// the events.
+type Emitter struct {
+	logger   gpt4batch.Logger
+	async    nsq.Async
+	topic    string
+	encoding Encoding
+	types    map[Type]bool
+	run      string
+	now      func() time.Time
+}
+
+// NewEmitter returns an Emitter publishing the events of types to topic of async.
+func NewEmitter(async nsq.Async, topic string, encoding Encoding, types map[Type]bool, logger gpt4batch.Logger) *Emitter {
+	return &Emitter{
+		logger:   logger.WithField("event", topic),
+		async:    async,
+		topic:    topic,
+		encoding: encoding,
+		types:    types,
+		run:      uuid.NewString(),
+		now:      time.Now,
+	}
+}
+
+// Run returns the id of the run.
+func (e *Emitter) Run() string {
+	if e == nil {
+		return ""
+	}
+	return e.run
+}
+
+// Emit fills the envelope of ev and publishes it. a failed publish is logged
+// and does not fail the run.
+func (e *Emitter) Emit(ctx context.Context, ev *Event) {
+	if e == nil || !e.types[ev.Type] {
+		return
+	}
+
+	ev.Version = Version
+	ev.ID = uuid.NewString()
+	ev.Time = e.now().UnixMilli()
+	ev.Run = e.run
+
+	body, err := ev.Marshal(e.encoding)
+	if err != nil {
+		e.logger.Warn("Event: failed to marshal: ", err)
+		return
+	}
+	if err := e.async.WriteBatch(ctx, e.topic, body); err != nil {
+		e.logger.Warn("Event: failed to write batch: ", err)
+	}
+}
+
+// Close closes the sink.
+func (e *Emitter) Close(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	return e.async.Close(ctx)
+}
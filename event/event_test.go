@@ -0,0 +1,106 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/log"
+)
+
+// memSink records the messages written to it.
+type memSink struct {
+	topics []string
+	msgs   [][]byte
+	err    error
+	closed bool
+}
+
+func (m *memSink) Connect(context.Context) error { return nil }
+
+func (m *memSink) WriteBatch(_ context.Context, topic string, msg []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.topics = append(m.topics, topic)
+	m.msgs = append(m.msgs, msg)
+	return nil
+}
+
+func (m *memSink) Close(context.Context) error {
+	m.closed = true
+	return nil
+}
+
+func TestParseTypes(t *testing.T) {
+	types, err := ParseTypes(nil)
+	assert.NoError(t, err)
+	assert.Len(t, types, len(Types))
+
+	types, err = ParseTypes([]string{"ask.completed", "run.finished"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[Type]bool{TypeAskCompleted: true, TypeRunFinished: true}, types)
+
+	_, err = ParseTypes([]string{"ask.started"})
+	assert.Error(t, err)
+}
+
+func TestEmitter(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		sink     = new(memSink)
+		types, _ = ParseTypes([]string{"item.completed", "run.finished"})
+		e        = NewEmitter(sink, "gpt4api", EncodingJSON, types, log.New(log.ErrorLevel))
+		started  = time.UnixMilli(1700000000000)
+	)
+	e.now = func() time.Time { return started.Add(3 * time.Second) }
+
+	e.Emit(ctx, &Event{Type: TypeItemStarted, InID: "1"})
+	e.Emit(ctx, (&Event{Type: TypeItemCompleted, InID: "1", Attempt: 2, Extra: map[string]interface{}{"tag": "a"}}).
+		Timing(started, started.Add(1500*time.Millisecond)))
+	sink.err = errors.New("down")
+	e.Emit(ctx, &Event{Type: TypeRunFinished, Stats: &Stats{Total: 1}})
+	assert.NoError(t, e.Close(ctx))
+
+	assert.Equal(t, []string{"gpt4api"}, sink.topics)
+	assert.True(t, sink.closed)
+
+	ev := new(Event)
+	assert.NoError(t, json.Unmarshal(sink.msgs[0], ev))
+	assert.Equal(t, Version, ev.Version)
+	assert.NotEmpty(t, ev.ID)
+	assert.Equal(t, e.Run(), ev.Run)
+	assert.Equal(t, TypeItemCompleted, ev.Type)
+	assert.Equal(t, int64(1700000003000), ev.Time)
+	assert.Equal(t, int64(1700000001500), ev.Finished)
+	assert.Equal(t, int64(1500), ev.Elapsed)
+	assert.Equal(t, 2, ev.Attempt)
+	assert.Equal(t, map[string]interface{}{"tag": "a"}, ev.Extra)
+}
+
+func TestEmitter_Nil(t *testing.T) {
+	var e *Emitter
+	e.Emit(context.Background(), &Event{Type: TypeRunFinished})
+	assert.Empty(t, e.Run())
+	assert.NoError(t, e.Close(context.Background()))
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package event
+
+import (
+	"encoding/json"
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"gitlab.com/gpt4batch"
+)
+
+// errMalformed is returned for a protobuf event that can not be decoded.
+var errMalformed = errors.New("malformed protobuf event")
+
+// MarshalProto encodes the event as the Event message of event.proto.
+func MarshalProto(e *Event) ([]byte, error) {
+	var b []byte
+	b = appendVarint(b, 1, uint64(e.Version))
+	b = appendString(b, 2, e.ID)
+	b = appendString(b, 3, string(e.Type))
+	b = appendVarint(b, 4, uint64(e.Time))
+	b = appendString(b, 5, e.Run)
+	b = appendString(b, 6, e.InID)
+	b = appendString(b, 7, e.AskID)
+	b = appendString(b, 8, e.Model)
+	b = appendString(b, 9, e.GizmoID)
+	b = appendVarint(b, 10, uint64(e.Attempt))
+	b = appendVarint(b, 11, uint64(e.Started))
+	b = appendVarint(b, 12, uint64(e.Finished))
+	b = appendVarint(b, 13, uint64(e.Elapsed))
+	b = appendString(b, 14, e.Ask)
+
+	if e.Answer != nil {
+		answer, err := json.Marshal(e.Answer)
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, 15, answer)
+	}
+
+	if ierr := e.Error; ierr != nil {
+		var m []byte
+		m = appendVarint(m, 1, uint64(ierr.Code))
+		m = appendString(m, 2, ierr.Message)
+		m = appendString(m, 3, string(ierr.Kind))
+		m = appendString(m, 4, ierr.AskID)
+		m = appendVarint(m, 5, uint64(ierr.Attempts))
+		m = appendVarint(m, 6, uint64(ierr.Timestamp))
+		b = appendMessage(b, 16, m)
+	}
+
+	if e.Extra != nil {
+		extra, err := json.Marshal(e.Extra)
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, 17, extra)
+	}
+
+	if s := e.Stats; s != nil {
+		var m []byte
+		m = appendVarint(m, 1, s.Total)
+		m = appendVarint(m, 2, s.Completed)
+		m = appendVarint(m, 3, s.Succeeded)
+		m = appendVarint(m, 4, s.Failed)
+		m = appendVarint(m, 5, s.Skipped)
+		b = appendMessage(b, 18, m)
+	}
+
+	for _, image := range e.Images {
+		b = appendMessage(b, 19, []byte(image))
+	}
+	for _, file := range e.Files {
+		b = appendMessage(b, 20, []byte(file))
+	}
+	b = appendString(b, 21, e.BranchID)
+	return b, nil
+}
+
+// UnmarshalProto decodes the Event message of event.proto. unknown fields are skipped.
+func UnmarshalProto(b []byte) (*Event, error) {
+	e := new(Event)
+	err := consume(b, func(num protowire.Number, v uint64, s []byte) error {
+		switch num {
+		case 1:
+			e.Version = int(v)
+		case 2:
+			e.ID = string(s)
+		case 3:
+			e.Type = Type(s)
+		case 4:
+			e.Time = int64(v)
+		case 5:
+			e.Run = string(s)
+		case 6:
+			e.InID = string(s)
+		case 7:
+			e.AskID = string(s)
+		case 8:
+			e.Model = string(s)
+		case 9:
+			e.GizmoID = string(s)
+		case 10:
+			e.Attempt = int(v)
+		case 11:
+			e.Started = int64(v)
+		case 12:
+			e.Finished = int64(v)
+		case 13:
+			e.Elapsed = int64(v)
+		case 14:
+			e.Ask = string(s)
+		case 15:
+			e.Answer = new(gpt4batch.ChatResponse)
+			return json.Unmarshal(s, e.Answer)
+		case 16:
+			e.Error = new(gpt4batch.IErr)
+			return consume(s, func(num protowire.Number, v uint64, s []byte) error {
+				switch num {
+				case 1:
+					e.Error.Code = int(v)
+				case 2:
+					e.Error.Message = string(s)
+				case 3:
+					e.Error.Kind = gpt4batch.ErrKind(s)
+				case 4:
+					e.Error.AskID = string(s)
+				case 5:
+					e.Error.Attempts = int(v)
+				case 6:
+					e.Error.Timestamp = int64(v)
+				}
+				return nil
+			})
+		case 17:
+			return json.Unmarshal(s, &e.Extra)
+		case 18:
+			e.Stats = new(Stats)
+			return consume(s, func(num protowire.Number, v uint64, _ []byte) error {
+				switch num {
+				case 1:
+					e.Stats.Total = v
+				case 2:
+					e.Stats.Completed = v
+				case 3:
+					e.Stats.Succeeded = v
+				case 4:
+					e.Stats.Failed = v
+				case 5:
+					e.Stats.Skipped = v
+				}
+				return nil
+			})
+		case 19:
+			e.Images = append(e.Images, string(s))
+		case 20:
+			e.Files = append(e.Files, string(s))
+		case 21:
+			e.BranchID = string(s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// consume calls f with the number and the varint or bytes value of each field of b.
+func consume(b []byte, f func(num protowire.Number, v uint64, s []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errMalformed
+		}
+		b = b[n:]
+
+		var (
+			v uint64
+			s []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			s, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errMalformed
+		}
+		b = b[n:]
+
+		if err := f(num, v, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendVarint appends the varint field num, omitted if it is 0 like in proto3.
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendString appends the string field num, omitted if it is empty.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendBytes appends the bytes field num, omitted if it is empty.
+func appendBytes(b []byte, num protowire.Number, s []byte) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, s)
+}
+
+// appendMessage appends the length-delimited field num, even if it is empty.
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package event
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"gitlab.com/gpt4batch"
+)
+
+func TestMarshalProto(t *testing.T) {
+	ev := &Event{
+		Version:  Version,
+		ID:       "e1",
+		Type:     TypeAskFailed,
+		Time:     1700000003000,
+		Run:      "r1",
+		InID:     "1",
+		AskID:    "1-2",
+		BranchID: "b1",
+		Model:    "gpt-4-gizmo",
+		GizmoID:  "g-1",
+		Attempt:  3,
+		Started:  1700000000000,
+		Finished: 1700000001500,
+		Elapsed:  1500,
+		Ask:      "hello",
+		Answer:   &gpt4batch.ChatResponse{MessageID: "m1", EndTurn: true, Contents: []interface{}{"hi"}},
+		Error: &gpt4batch.IErr{
+			Code:      429,
+			Message:   "too many requests",
+			Kind:      gpt4batch.ErrKindQuota,
+			AskID:     "1-2",
+			Attempts:  3,
+			Timestamp: 1700000001,
+		},
+		Extra:  map[string]interface{}{"tag": "a"},
+		Stats:  &Stats{Total: 10, Completed: 4, Succeeded: 3, Failed: 1},
+		Images: []string{"a.png", ""},
+		Files:  []string{"b.pdf"},
+	}
+
+	body, err := ev.Marshal(EncodingProtobuf)
+	assert.NoError(t, err)
+
+	// an unknown field added by a later version is skipped.
+	body = protowire.AppendTag(body, 99, protowire.BytesType)
+	body = protowire.AppendString(body, "later")
+
+	got, err := UnmarshalProto(body)
+	assert.NoError(t, err)
+	assert.Equal(t, ev, got)
+
+	_, err = UnmarshalProto([]byte{0x0a, 0x05, 'a'})
+	assert.Error(t, err)
+
+	_, err = ev.Marshal("xml")
+	assert.Error(t, err)
+}
+
+func TestMarshalProto_Empty(t *testing.T) {
+	body, err := MarshalProto(&Event{Type: TypeRunFinished, Stats: &Stats{}})
+	assert.NoError(t, err)
+
+	got, err := UnmarshalProto(body)
+	assert.NoError(t, err)
+	assert.Equal(t, &Event{Type: TypeRunFinished, Stats: &Stats{}}, got)
+}
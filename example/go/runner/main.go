@@ -0,0 +1,74 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/runner"
+)
+
+func main() {
+	in, err := os.Open("example.jsonl")
+	if err != nil {
+		panic(err)
+	}
+	defer in.Close()
+
+	out, err := os.Create("out.jsonl")
+	if err != nil {
+		panic(err)
+	}
+	defer out.Close()
+
+	cc := client.Chain(client.NewClient(), client.WithLogger(log.New(log.InfoLevel)))
+	r := runner.New(cc,
+		runner.WithURL("https://beta.gpt4api.plus/concurrent/all-tools"),
+		runner.WithUploadURL("https://beta.gpt4api.plus/concurrent/uploaded"),
+		runner.WithAccessToken("<YOUR_ACCESS_TOKEN>"),
+		runner.WithModel("gpt-4-gizmo", "<YOUR_GIZMO_ID>"),
+		runner.WithConcurrency(4),
+		runner.OnAnswer(func(ctx context.Context, a *runner.Answer) {
+			if a.Err == nil {
+				fmt.Println(a.In.ID, a.Ask.ID, a.Resp.Text())
+			}
+		}),
+		runner.OnItemDone(func(ctx context.Context, res *runner.Result) {
+			fmt.Println(res.In.ID, "done", res.Finished.Sub(res.Started), res.Err)
+		}),
+	)
+
+	// 逐行读取输入文件，完成的题写入输出文件
+	if err := r.Run(context.Background(), runner.Lines(in), runner.Writer(out)); err != nil {
+		panic(err)
+	}
+
+	stats := r.Stats()
+	fmt.Printf("<Stats>: complete=%d success=%d failed=%d\n", stats.CompleteTotal, stats.SuccessTotal, stats.FailedTotal)
+
+	// 也可以直接运行单个题
+	item := &gpt4batch.In{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "你是gpt3还是gpt-4"}}}
+	if err := r.Chat(context.Background(), item, 1); err != nil {
+		panic(err)
+	}
+	fmt.Println("<Answers>: ", item.Answers)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"gitlab.com/gpt4batch/webhook"
+)
+
+// 本地接收batchsvc的webhook通知并校验签名：
+// GPT4BATCH_WEBHOOK_SECRET=xxx go run ./example/go/webhook
+// gpt4batch batchsvc --webhook http://127.0.0.1:8080/ --webhook_secret xxx
+func main() {
+	secret := []byte(os.Getenv("GPT4BATCH_WEBHOOK_SECRET"))
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// 设置了密钥时拒绝签名不正确的请求
+		if len(secret) > 0 && !webhook.Verify(secret, r.Header.Get(webhook.TimestampHeader), body, r.Header.Get(webhook.SignatureHeader)) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		fmt.Println(r.Header.Get(webhook.TypeHeader), string(body))
+	})
+
+	if err := http.ListenAndServe("127.0.0.1:8080", nil); err != nil {
+		panic(err)
+	}
+}
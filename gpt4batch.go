@@ -18,7 +18,9 @@ package gpt4batch
 
 import (
 	"context"
+	"encoding/json"
 	"io"
+	"strings"
 )
 
 const (
@@ -84,6 +86,21 @@ type ChatResponse struct {
 	Downloads      []string      `json:"downloads,omitempty"`
 	// SpecDownloads is the spec downloads for chat service. [origin, local]
 	SpecDownloads SpecDownloads `json:"spec_downloads,omitempty"`
+	// JSON is the json extracted from the contents and validated against the json schema.
+	JSON interface{} `json:"json,omitempty"`
+	// Assertions is the assertions the response failed.
+	Assertions []string `json:"assertions,omitempty"`
+}
+
+// Text returns the text contents of the response joined by new lines.
+func (r *ChatResponse) Text() string {
+	texts := make([]string, 0, len(r.Contents))
+	for _, content := range r.Contents {
+		if text, ok := content.(string); ok {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n")
 }
 
 // SpecDownloads is the spec downloads for chat service.
@@ -227,6 +244,57 @@ type In struct {
 	Answers []interface{} `json:"answers"`
 	IErr    *IErr         `json:"iErr,omitempty"`
 	Extra   interface{}   `json:"extra,omitempty"`
+	// ConversationID is the existing conversation the asks continue. [optional]
+	ConversationID string `json:"conversation_id,omitempty"`
+	// ParentMessageID is the message of the conversation the first ask replies to. [optional]
+	ParentMessageID string `json:"parent_message_id,omitempty"`
+	// Branches fork from the last answer of the asks, which run once as a shared prefix. [optional]
+	Branches Branches `json:"branches,omitempty"`
+	// DependsOn is the ids of the items that must succeed before this item runs.
+	// their answers can be referenced in the ask contents with {{ answer "id" }}. [optional]
+	DependsOn []string `json:"depends_on,omitempty"`
+	// Schema is the json schema the last answer must match, overriding the schema of the run. [optional]
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+// Branches is the branches of an In.
+type Branches []*Branch
+
+// Branch is a conversation forking from the shared prefix of an In.
+type Branch struct {
+	ID      string        `json:"id"`
+	Asks    Asks          `json:"asks"`
+	Answers []interface{} `json:"answers"`
+	IErr    *IErr         `json:"iErr,omitempty"`
+}
+
+// ChatResponses returns the answers as chat responses.
+func (in *In) ChatResponses() ([]*ChatResponse, error) {
+	return ChatResponses(in.Answers)
+}
+
+// ChatResponses returns the answers as chat responses. Answers read from
+// an output file are decoded, answers of the current run are returned as is.
+func ChatResponses(answers []interface{}) ([]*ChatResponse, error) {
+	resps := make([]*ChatResponse, 0, len(answers))
+	for _, answer := range answers {
+		if resp, ok := answer.(*ChatResponse); ok {
+			resps = append(resps, resp)
+			continue
+		}
+
+		body, err := json.Marshal(answer)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := new(ChatResponse)
+		if err := json.Unmarshal(body, resp); err != nil {
+			return nil, err
+		}
+		resps = append(resps, resp)
+	}
+	return resps, nil
 }
 
 // Asks is the asks for the service.
@@ -240,8 +308,47 @@ type Ask struct {
 	Files   []string `json:"files,omitempty"`
 }
 
+// ErrKind is the class of an IErr.
+type ErrKind string
+
+const (
+	// ErrKindPending is the item has not been run yet.
+	ErrKindPending ErrKind = "pending"
+	// ErrKindUpload is uploading an image or file failed.
+	ErrKindUpload ErrKind = "upload"
+	// ErrKindChat is the chat failed, code is the upstream http status.
+	ErrKindChat ErrKind = "chat"
+	// ErrKindDecode is the upstream response could not be decoded.
+	ErrKindDecode ErrKind = "decode"
+	// ErrKindTimeout is the request timed out.
+	ErrKindTimeout ErrKind = "timeout"
+	// ErrKindCanceled is the run was canceled.
+	ErrKindCanceled ErrKind = "canceled"
+	// ErrKindAuth is the access token was rejected.
+	ErrKindAuth ErrKind = "auth"
+	// ErrKindQuota is the account was throttled or ran out of quota.
+	ErrKindQuota ErrKind = "quota"
+	// ErrKindValidation is the input or the answer is invalid.
+	ErrKindValidation ErrKind = "validation"
+	// ErrKindDependency is the item was skipped because a dependency failed.
+	ErrKindDependency ErrKind = "dependency"
+	// ErrKindHook is the before item hook failed.
+	ErrKindHook ErrKind = "hook"
+	// ErrKindSkipped is the item was skipped by the before item hook.
+	ErrKindSkipped ErrKind = "skipped"
+)
+
 // IErr is the error for the service.
 type IErr struct {
+	// Code is the upstream http status code, 0 if the request did not get a response.
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	// Kind is the class of the error.
+	Kind ErrKind `json:"kind,omitempty"`
+	// AskID is the id of the failing ask.
+	AskID string `json:"ask_id,omitempty"`
+	// Attempts is the number of times the item has been run.
+	Attempts int `json:"attempts,omitempty"`
+	// Timestamp is the unix time of the failure.
+	Timestamp int64 `json:"timestamp,omitempty"`
 }
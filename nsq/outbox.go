@@ -0,0 +1,426 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nsq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/gpt4batch"
+)
+
+const (
+	// minOutboxBackoff is the first delay before the outbox retries.
+	minOutboxBackoff = time.Second
+	// maxOutboxBackoff is the max delay between the retries of the outbox.
+	maxOutboxBackoff = time.Minute
+	// drainTimeout bounds the drain of Close when ctx has no deadline.
+	drainTimeout = 30 * time.Second
+)
+
+// OutboxStats is the statistics of an outbox.
+type OutboxStats struct {
+	// Published is the number of messages published.
+	Published uint64
+	// Queued is the number of messages queued in the outbox.
+	Queued uint64
+	// Retried is the number of queued messages published by a retry.
+	Retried uint64
+	// Pending is the number of messages waiting in the outbox.
+	Pending uint64
+}
+
+// OutboxReporter reports the statistics of an outbox.
+type OutboxReporter interface {
+	// OutboxStats returns the statistics of the outbox.
+	OutboxStats() OutboxStats
+}
+
+// record is a message waiting in the outbox.
+type record struct {
+	Topic string `json:"topic"`
+	Body  []byte `json:"body"`
+}
+
+// outbox is an Async that queues the messages it fails to publish in a local
+// file, and publishes them again in the background with backoff.
+type outbox struct {
+	logger gpt4batch.Logger
+	async  Async
+	file   string
+
+	// mu guards pending, the slots and the file.
+	mu      sync.Mutex
+	pending []*record
+	// the slots order the writes: next is the slot of the next write, head
+	// the oldest unresolved one and resolved the slots after head already
+	// resolved. a message is queued once head reaches its slot.
+	next     uint64
+	head     uint64
+	resolved map[uint64]bool
+	// queueing is the number of messages waiting for their slot to be queued.
+	queueing int
+	// turn is signaled whenever head moves.
+	turn *sync.Cond
+	// flushMu serializes the flushes so that a message is published once.
+	flushMu sync.Mutex
+
+	published uint64
+	queued    uint64
+	retried   uint64
+
+	// running reports whether the loop has been started.
+	running   int32
+	wake      chan struct{}
+	done      chan struct{}
+	exited    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewOutbox returns an Async publishing with async and queueing the failed
+// messages in file. the messages left by a previous run are published too.
+func NewOutbox(file string, async Async, logger gpt4batch.Logger) Async {
+	o := &outbox{
+		logger:   logger.WithField("nsq", "outbox"),
+		async:    async,
+		file:     file,
+		resolved: make(map[uint64]bool),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	o.turn = sync.NewCond(&o.mu)
+	return o
+}
+
+// Connect loads the queued messages and connects async.
+func (o *outbox) Connect(ctx context.Context) error {
+	if err := o.load(); err != nil {
+		return err
+	}
+	if err := o.async.Connect(ctx); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&o.running, 1)
+	go o.loop()
+	o.signal()
+	return nil
+}
+
+// WriteBatch publishes the message. the message is queued when the publish
+// fails or older messages are waiting, so that the order is kept. the
+// messages written concurrently are published concurrently, and queued in
+// the order they were written if they fail.
+func (o *outbox) WriteBatch(ctx context.Context, topic string, msg []byte) error {
+	if len(msg) == 0 {
+		return nil
+	}
+	r := &record{Topic: topic, Body: msg}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// the slot is resolved once the message is published or queued.
+	slot := o.next
+	o.next++
+	defer o.resolve(slot)
+
+	if len(o.pending) == 0 && o.queueing == 0 {
+		o.mu.Unlock()
+		err := o.async.WriteBatch(ctx, topic, msg)
+		o.mu.Lock()
+
+		if err == nil {
+			atomic.AddUint64(&o.published, 1)
+			return nil
+		}
+		o.logger.Warn("Queue the message that failed to publish: ", err)
+	}
+
+	// the messages written before this one are published or queued first.
+	o.queueing++
+	for o.head != slot {
+		o.turn.Wait()
+	}
+	o.queueing--
+	return o.enqueue(r)
+}
+
+// resolve marks the write of slot resolved. it must be called with mu held.
+func (o *outbox) resolve(slot uint64) {
+	o.resolved[slot] = true
+	for o.resolved[o.head] {
+		delete(o.resolved, o.head)
+		o.head++
+	}
+	o.turn.Broadcast()
+}
+
+// Close stops the retries, publishes the queued messages until ctx is done
+// and closes async. the messages still queued are kept in the file.
+func (o *outbox) Close(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, drainTimeout)
+		defer cancel()
+	}
+
+	o.closeOnce.Do(func() {
+		close(o.done)
+	})
+
+	if atomic.LoadInt32(&o.running) == 1 {
+		select {
+		case <-o.exited:
+		case <-ctx.Done():
+		}
+	}
+	o.drain(ctx)
+
+	stats := o.OutboxStats()
+	logg := o.logger.
+		WithField("published", stats.Published).
+		WithField("queued", stats.Queued).
+		WithField("retried", stats.Retried).
+		WithField("pending", stats.Pending)
+	if stats.Pending != 0 {
+		logg.WithField("file", o.file).Warn("Outbox Not Drained")
+	} else {
+		logg.Info("Outbox Drained")
+	}
+	return o.async.Close(ctx)
+}
+
+// OutboxStats implements OutboxReporter.
+func (o *outbox) OutboxStats() OutboxStats {
+	o.mu.Lock()
+	pending := len(o.pending)
+	o.mu.Unlock()
+
+	return OutboxStats{
+		Published: atomic.LoadUint64(&o.published),
+		Queued:    atomic.LoadUint64(&o.queued),
+		Retried:   atomic.LoadUint64(&o.retried),
+		Pending:   uint64(pending),
+	}
+}
+
+// loop publishes the queued messages with backoff until the outbox is closed.
+func (o *outbox) loop() {
+	defer close(o.exited)
+
+	var (
+		backoff = minOutboxBackoff
+		timer   = time.NewTimer(backoff)
+	)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-o.wake:
+		case <-timer.C:
+		}
+
+		if err := o.flush(context.Background()); err != nil {
+			o.logger.
+				WithField("backoff", backoff.String()).
+				Warn("Retry later: ", err)
+			timer.Reset(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = minOutboxBackoff
+	}
+}
+
+// drain publishes the queued messages with backoff until none is left or ctx is done.
+func (o *outbox) drain(ctx context.Context) {
+	for backoff := minOutboxBackoff; o.flush(ctx) != nil; backoff = nextBackoff(backoff) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// flush publishes the queued messages in order, and stops at the first failure.
+func (o *outbox) flush(ctx context.Context) error {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	o.mu.Lock()
+	batch := o.pending[:len(o.pending):len(o.pending)]
+	o.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var (
+		sent int
+		err  error
+	)
+	for _, r := range batch {
+		if err = o.async.WriteBatch(ctx, r.Topic, r.Body); err != nil {
+			break
+		}
+		sent++
+	}
+
+	if sent != 0 {
+		atomic.AddUint64(&o.published, uint64(sent))
+		atomic.AddUint64(&o.retried, uint64(sent))
+		o.logger.
+			WithField("retried", sent).
+			WithField("pending", len(batch)-sent).
+			Info("Outbox Published")
+
+		o.mu.Lock()
+		o.pending = o.pending[sent:]
+		if serr := o.save(); serr != nil && err == nil {
+			err = serr
+		}
+		o.mu.Unlock()
+	}
+	return err
+}
+
+// enqueue appends the record to the file and the pending records.
+// it must be called with mu held.
+func (o *outbox) enqueue(r *record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(o.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	o.pending = append(o.pending, r)
+	atomic.AddUint64(&o.queued, 1)
+	o.signal()
+	return nil
+}
+
+// load loads the records of the file.
+func (o *outbox) load() error {
+	file, err := os.Open(o.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		r := new(record)
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return err
+		}
+		o.pending = append(o.pending, r)
+	}
+	if len(o.pending) != 0 {
+		o.logger.
+			WithField("pending", len(o.pending)).
+			Info("Outbox Loaded")
+	}
+	return scanner.Err()
+}
+
+// save replaces the file with the pending records, and removes it once empty.
+// it must be called with mu held.
+func (o *outbox) save() error {
+	if len(o.pending) == 0 {
+		if err := os.Remove(o.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(o.file), filepath.Base(o.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, r := range o.pending {
+		line, err := json.Marshal(r)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err = writer.Write(append(line, '\n')); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), o.file)
+}
+
+// signal wakes the loop up.
+func (o *outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextBackoff returns the backoff after backoff.
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nsq
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/log"
+)
+
+// flakyAsync fails every publish while down.
+type flakyAsync struct {
+	mu   sync.Mutex
+	down bool
+	msgs []string
+}
+
+func (a *flakyAsync) Connect(ctx context.Context) error { return nil }
+
+func (a *flakyAsync) WriteBatch(ctx context.Context, topic string, msg []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.down {
+		return errors.New("nsqd is down")
+	}
+	a.msgs = append(a.msgs, topic+":"+string(msg))
+	return nil
+}
+
+func (a *flakyAsync) Close(ctx context.Context) error { return nil }
+
+func (a *flakyAsync) setDown(down bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.down = down
+}
+
+func (a *flakyAsync) published() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.msgs...)
+}
+
+func TestOutbox(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		file   = filepath.Join(t.TempDir(), "outbox.jsonl")
+		async  = &flakyAsync{}
+		logger = log.New(log.InfoLevel)
+	)
+
+	o := NewOutbox(file, async, logger)
+	assert.NoError(t, o.Connect(ctx))
+	assert.NoError(t, o.WriteBatch(ctx, "t", []byte("1")))
+
+	// the messages are queued while nsqd is down, and kept in order after it recovers.
+	async.setDown(true)
+	assert.NoError(t, o.WriteBatch(ctx, "t", []byte("2")))
+	async.setDown(false)
+	assert.NoError(t, o.WriteBatch(ctx, "t", []byte("3")))
+	_, err := os.Stat(file)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(async.published()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"t:1", "t:2", "t:3"}, async.published())
+	assert.Equal(t, OutboxStats{Published: 3, Queued: 2, Retried: 2}, o.(OutboxReporter).OutboxStats())
+
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, o.Close(ctx))
+}
+
+func TestOutbox_Close(t *testing.T) {
+	var (
+		file   = filepath.Join(t.TempDir(), "outbox.jsonl")
+		async  = &flakyAsync{down: true}
+		logger = log.New(log.InfoLevel)
+	)
+
+	// the messages that cannot be published before the deadline are kept in the file.
+	o := NewOutbox(file, async, logger)
+	assert.NoError(t, o.Connect(context.Background()))
+	assert.NoError(t, o.WriteBatch(context.Background(), "t", []byte("1")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, o.Close(ctx))
+	assert.Equal(t, uint64(1), o.(OutboxReporter).OutboxStats().Pending)
+
+	// the next run loads and publishes them.
+	async.setDown(false)
+	o = NewOutbox(file, async, logger)
+	assert.NoError(t, o.Connect(context.Background()))
+	assert.NoError(t, o.Close(context.Background()))
+	assert.Equal(t, []string{"t:1"}, async.published())
+	assert.Equal(t, uint64(1), o.(OutboxReporter).OutboxStats().Retried)
+}
+
+// blockAsync fails the publish of block once release is closed.
+type blockAsync struct {
+	*flakyAsync
+	block   string
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (a *blockAsync) WriteBatch(ctx context.Context, topic string, msg []byte) error {
+	blocked := false
+	if string(msg) == a.block {
+		a.once.Do(func() { blocked = true })
+	}
+	if blocked {
+		close(a.entered)
+		<-a.release
+		return errors.New("nsqd is down")
+	}
+	return a.flakyAsync.WriteBatch(ctx, topic, msg)
+}
+
+func TestOutbox_concurrent(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		file  = filepath.Join(t.TempDir(), "outbox.jsonl")
+		async = &blockAsync{
+			flakyAsync: &flakyAsync{down: true},
+			block:      "1",
+			entered:    make(chan struct{}),
+			release:    make(chan struct{}),
+		}
+		wg sync.WaitGroup
+	)
+
+	o := NewOutbox(file, async, log.New(log.InfoLevel))
+	assert.NoError(t, o.Connect(ctx))
+
+	// the message failing while an older one is in flight is queued after it.
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, o.WriteBatch(ctx, "t", []byte("1")))
+	}()
+	<-async.entered
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, o.WriteBatch(ctx, "t", []byte("2")))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, o.(OutboxReporter).OutboxStats().Pending)
+	close(async.release)
+	wg.Wait()
+	async.setDown(false)
+
+	assert.Eventually(t, func() bool {
+		return len(async.published()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"t:1", "t:2"}, async.published())
+	assert.NoError(t, o.Close(ctx))
+}
+
+func TestOutbox_batch(t *testing.T) {
+	conf := NewNSQConfig()
+	conf.BatchSize = 4
+	conf.BatchInterval = 5 * time.Second
+	conf.HealthCheckInterval = 0
+
+	var (
+		ctx      = context.Background()
+		w, nsqd  = newTestWriter(t, conf)
+		o        = NewOutbox(filepath.Join(t.TempDir(), "outbox.jsonl"), w, log.New(log.InfoLevel))
+		wg       sync.WaitGroup
+		started  = time.Now()
+		messages = 8
+	)
+	assert.NoError(t, o.Connect(ctx))
+
+	// the concurrent writes fill the batches of the writer instead of waiting for the interval.
+	for i := 0; i < messages; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, o.WriteBatch(ctx, "t", []byte(strconv.Itoa(i))))
+		}(i)
+	}
+	wg.Wait()
+	assert.Less(t, time.Since(started), conf.BatchInterval)
+	assert.Len(t, nsqd.published("127.0.0.1:4150"), messages)
+	assert.Equal(t, 2, nsqd.batches)
+	assert.NoError(t, o.Close(ctx))
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nsq
+
+import (
+	"context"
+	"errors"
+	"io"
+	llog "log"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+
+	"gitlab.com/gpt4batch"
+)
+
+// Message is a message consumed from NSQ.
+type Message struct {
+	// ID is the id of the message.
+	ID string
+	// Body is the body of the message.
+	Body []byte
+	// Attempts is the number of times the message has been delivered, starting at 1.
+	Attempts uint16
+}
+
+// Handler handles a message. the message is finished when it returns nil,
+// and requeued with backoff when it returns an error.
+type Handler func(ctx context.Context, msg *Message) error
+
+// Consumer consumes the messages of a topic channel.
+type Consumer interface {
+	// Consume connects to NSQ and handles the messages of the topic channel
+	// with concurrency handlers. it blocks until ctx is done.
+	Consume(ctx context.Context, topic, channel string, concurrency int, h Handler) error
+	// Close stops the consumer and blocks until the handlers in flight return.
+	Close(ctx context.Context) error
+}
+
+// IsValidTopicName reports whether name is a valid NSQ topic name.
+func IsValidTopicName(name string) bool {
+	return nsq.IsValidTopicName(name)
+}
+
+// IsValidChannelName reports whether name is a valid NSQ channel name.
+func IsValidChannelName(name string) bool {
+	return nsq.IsValidChannelName(name)
+}
+
+// nsqReader is an NSQ consumer.
+type nsqReader struct {
+	logger gpt4batch.Logger
+	conf   NSQConfig
+
+	mu       sync.Mutex
+	consumer *nsq.Consumer
+}
+
+// NewNSQReader creates a new NSQ consumer.
+func NewNSQReader(conf NSQConfig, logger gpt4batch.Logger) (Consumer, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return &nsqReader{
+		logger: logger.WithField("nsq", "consumer"),
+		conf:   conf,
+	}, nil
+}
+
+// Consume implements Consumer.
+func (n *nsqReader) Consume(ctx context.Context, topic, channel string, concurrency int, h Handler) error {
+	cfg, err := n.conf.newConfig()
+	if err != nil {
+		return err
+	}
+	// the handler decides when a message has been attempted too many times.
+	cfg.MaxAttempts = 0
+
+	consumer, err := nsq.NewConsumer(topic, channel, cfg)
+	if err != nil {
+		return err
+	}
+	consumer.SetLogger(
+		llog.New(io.Discard, "", llog.Flags()),
+		nsq.LogLevelError,
+	)
+	consumer.AddConcurrentHandlers(nsq.HandlerFunc(func(m *nsq.Message) error {
+		// an item may run longer than the message timeout. keep the message
+		// in flight until it is handled so that nsqd does not requeue it.
+		return touching(m, cfg.MsgTimeout/2, func() error {
+			return h(ctx, &Message{
+				ID:       string(m.ID[:]),
+				Body:     m.Body,
+				Attempts: m.Attempts,
+			})
+		})
+	}), concurrency)
+
+	n.mu.Lock()
+	if n.consumer != nil {
+		n.mu.Unlock()
+		consumer.Stop()
+		return errors.New("consumer is already consuming")
+	}
+	n.consumer = consumer
+	n.mu.Unlock()
+
+	// discover the nsqd of the topic with nsqlookupd if configured.
+	addresses := n.conf.Addresses
+	if len(n.conf.LookupdAddresses) != 0 {
+		addresses = n.conf.LookupdAddresses
+		err = consumer.ConnectToNSQLookupds(addresses)
+	} else {
+		err = consumer.ConnectToNSQDs(addresses)
+	}
+	if err != nil {
+		return err
+	}
+
+	n.logger.
+		WithField("topic", topic).
+		WithField("channel", channel).
+		Info("Consuming NSQ messages from address: ", addresses)
+
+	select {
+	case <-ctx.Done():
+	case <-consumer.StopChan:
+	}
+	return nil
+}
+
+// toucher resets the timeout of an in-flight message.
+type toucher interface {
+	Touch()
+}
+
+// touching runs fn and touches m every interval until fn returns. m is no
+// longer touched once touching returns.
+func touching(m toucher, interval time.Duration, fn func() error) error {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				m.Touch()
+			}
+		}
+	}()
+	return fn()
+}
+
+// Close implements Consumer.
+func (n *nsqReader) Close(ctx context.Context) error {
+	n.mu.Lock()
+	consumer := n.consumer
+	n.consumer = nil
+	n.mu.Unlock()
+
+	if consumer == nil {
+		return nil
+	}
+
+	consumer.Stop()
+	select {
+	case <-consumer.StopChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nsq
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countToucher counts the touches of a message.
+type countToucher struct {
+	touches int32
+}
+
+func (c *countToucher) Touch() { atomic.AddInt32(&c.touches, 1) }
+
+func Test_touching(t *testing.T) {
+	// the handler runs longer than the message timeout of 20ms.
+	const msgTimeout = 20 * time.Millisecond
+	m := new(countToucher)
+	assert.NoError(t, touching(m, msgTimeout/2, func() error {
+		time.Sleep(5 * msgTimeout)
+		return nil
+	}))
+	touches := atomic.LoadInt32(&m.touches)
+	assert.GreaterOrEqual(t, touches, int32(4))
+
+	// the message is no longer touched once it is handled.
+	time.Sleep(2 * msgTimeout)
+	assert.Equal(t, touches, atomic.LoadInt32(&m.touches))
+}
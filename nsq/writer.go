@@ -19,42 +19,188 @@ package nsq
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	"gitlab.com/gpt4batch"
+	"fmt"
 	"io"
 	llog "log"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/nsqio/go-nsq"
+
+	"gitlab.com/gpt4batch"
 )
 
+// errNotConnected is returned when a message is published before Connect.
+var errNotConnected = errors.New("not connected to target source or sink")
+
 // NSQConfig is the configuration for NSQ.
 type NSQConfig struct {
-	Enable      bool
-	Address     string
-	UserAgent   string
-	MaxInFlight int
-	Topic       string
+	Enable bool
+	// Addresses is the nsqd tcp addresses. messages are published to the first healthy one.
+	Addresses []string
+	// LookupdAddresses is the nsqlookupd http addresses the consumer discovers nsqd with.
+	LookupdAddresses []string
+	UserAgent        string
+	MaxInFlight      int
+	Topic            string
+	// Outbox is the file the messages that failed to publish are queued in.
+	Outbox string
+	// TLS enables tls to nsqd.
+	TLS bool
+	// TLSCAFile is the ca certificate file nsqd is verified with, the system pool if empty.
+	TLSCAFile string
+	// TLSCertFile is the client certificate file.
+	TLSCertFile string
+	// TLSKeyFile is the client key file.
+	TLSKeyFile string
+	// TLSSkipVerify skips the verification of the nsqd certificate.
+	TLSSkipVerify bool
+	// AuthSecret is the secret sent to nsqd with AUTH.
+	AuthSecret string
+	// BatchSize is the max messages of a topic sent in one MultiPublish. 1 disables batching.
+	BatchSize int
+	// BatchInterval is the max time a message waits for its batch to fill.
+	BatchInterval time.Duration
+	// HealthCheckInterval is the interval the nsqd connections are pinged and
+	// reconnected at. 0 disables the health checks.
+	HealthCheckInterval time.Duration
 }
 
 // NewNSQConfig creates a new NSQ configuration.
 func NewNSQConfig() NSQConfig {
 	return NSQConfig{
-		Enable:      true,
-		Address:     "127.0.0.1:4150",
-		UserAgent:   "",
-		MaxInFlight: 64,
-		Topic:       "gpt4api",
+		Enable:              true,
+		Addresses:           []string{"127.0.0.1:4150"},
+		UserAgent:           "",
+		MaxInFlight:         64,
+		Topic:               "gpt4api",
+		BatchSize:           1,
+		BatchInterval:       100 * time.Millisecond,
+		HealthCheckInterval: 30 * time.Second,
 	}
 }
 
 // Validate validates the NSQ configuration.
 func (c NSQConfig) Validate() error {
-	if govalidator.IsNull(c.Address) {
+	if len(c.Addresses) == 0 {
 		return errors.New("nsq address is required")
 	}
-	return nil
+	for _, addr := range append(c.Addresses[:len(c.Addresses):len(c.Addresses)], c.LookupdAddresses...) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("nsq address %q is invalid: %w", addr, err)
+		}
+	}
+
+	if !IsValidTopicName(c.Topic) {
+		return fmt.Errorf("nsq topic %q is invalid", c.Topic)
+	}
+
+	if c.MaxInFlight <= 0 {
+		return errors.New("nsq max in flight must be greater than 0")
+	}
+
+	if c.BatchSize <= 0 {
+		return errors.New("nsq batch size must be greater than 0")
+	}
+	if c.BatchSize > 1 && c.BatchInterval <= 0 {
+		return errors.New("nsq batch interval must be greater than 0")
+	}
+
+	if c.HealthCheckInterval < 0 {
+		return errors.New("nsq health check interval must not be negative")
+	}
+
+	if !c.TLS && (c.TLSCAFile != "" || c.TLSCertFile != "" || c.TLSKeyFile != "" || c.TLSSkipVerify) {
+		return errors.New("nsq tls options require tls")
+	}
+	if govalidator.IsNull(c.TLSCertFile) != govalidator.IsNull(c.TLSKeyFile) {
+		return errors.New("nsq tls cert and key must be set together")
+	}
+
+	_, err := c.newConfig()
+	return err
+}
+
+// newConfig returns the go-nsq config of the configuration.
+func (c NSQConfig) newConfig() (*nsq.Config, error) {
+	cfg := nsq.NewConfig()
+	cfg.UserAgent = c.UserAgent
+	cfg.MaxInFlight = c.MaxInFlight
+	cfg.AuthSecret = c.AuthSecret
+
+	if c.TLS {
+		tlsConf := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: c.TLSSkipVerify,
+		}
+
+		if c.TLSCAFile != "" {
+			ca, err := os.ReadFile(c.TLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("nsq tls ca %s has no certificate", c.TLSCAFile)
+			}
+			tlsConf.RootCAs = pool
+		}
+
+		if c.TLSCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConf.Certificates = []tls.Certificate{cert}
+		}
+
+		cfg.TlsV1 = true
+		cfg.TlsConfig = tlsConf
+	}
+	return cfg, nil
+}
+
+// publisher publishes messages to an nsqd.
+type publisher interface {
+	Publish(topic string, body []byte) error
+	MultiPublish(topic string, body [][]byte) error
+	Ping() error
+	Stop()
+}
+
+// newProducer returns a publisher connected to the nsqd at addr.
+func newProducer(addr string, cfg *nsq.Config) (publisher, error) {
+	producer, err := nsq.NewProducer(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	producer.SetLogger(
+		llog.New(io.Discard, "", llog.Flags()),
+		nsq.LogLevelError,
+	)
+	return producer, nil
+}
+
+// node is the producer of an nsqd address.
+type node struct {
+	addr     string
+	producer publisher
+	// healthy reports whether the last ping or publish succeeded.
+	healthy int32
+}
+
+// batch is the messages of a topic sent in one MultiPublish.
+type batch struct {
+	bodies [][]byte
+	err    error
+	done   chan struct{}
 }
 
 // NSQWriter is an NSQ writer.
@@ -62,75 +208,260 @@ type nsqWriter struct {
 	logger gpt4batch.Logger
 	conf   NSQConfig
 
-	tlsConf  *tls.Config
-	connMut  sync.RWMutex
-	producer *nsq.Producer
+	// newProducer creates the producers.
+	newProducer func(addr string, cfg *nsq.Config) (publisher, error)
+	cfg         *nsq.Config
+
+	connMut sync.RWMutex
+	nodes   []*node
+
+	batchMut sync.Mutex
+	batches  map[string]*batch
+
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 // NewNSQWriter creates a new NSQ writer.
 func NewNSQWriter(conf NSQConfig, logger gpt4batch.Logger) (Async, error) {
+	cfg, err := conf.newConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	n := nsqWriter{
-		logger: logger.WithField("nsq", "svc"),
-		conf:   conf,
+		logger:      logger.WithField("nsq", "svc"),
+		conf:        conf,
+		newProducer: newProducer,
+		cfg:         cfg,
+		batches:     make(map[string]*batch),
 	}
 	return &n, nil
 }
 
-// Connect connects to NSQ.
+// Connect connects to every nsqd. it fails if none of them is reachable.
 func (n *nsqWriter) Connect(ctx context.Context) error {
 	n.connMut.Lock()
 	defer n.connMut.Unlock()
 
-	cfg := nsq.NewConfig()
-	cfg.UserAgent = n.conf.UserAgent
-	if n.tlsConf != nil {
-		cfg.TlsV1 = true
-		cfg.TlsConfig = n.tlsConf
-	}
+	var (
+		nodes   = make([]*node, 0, len(n.conf.Addresses))
+		healthy int
+		lastErr error
+	)
+	for _, addr := range n.conf.Addresses {
+		producer, err := n.newProducer(addr, n.cfg)
+		if err != nil {
+			for _, nd := range nodes {
+				nd.producer.Stop()
+			}
+			return err
+		}
 
-	producer, err := nsq.NewProducer(n.conf.Address, cfg)
-	if err != nil {
-		return err
+		nd := &node{addr: addr, producer: producer}
+		if err := producer.Ping(); err != nil {
+			lastErr = err
+			n.logger.WithField("address", addr).Warn("Unhealthy: ", err)
+		} else {
+			nd.healthy = 1
+			healthy++
+		}
+		nodes = append(nodes, nd)
 	}
 
-	producer.SetLogger(
-		llog.New(io.Discard, "", llog.Flags()),
-		nsq.LogLevelError,
-	)
+	if healthy == 0 {
+		for _, nd := range nodes {
+			nd.producer.Stop()
+		}
+		return lastErr
+	}
+	n.nodes = nodes
 
-	if err := producer.Ping(); err != nil {
-		return err
+	if n.conf.HealthCheckInterval > 0 {
+		n.done = make(chan struct{})
+		n.wg.Add(1)
+		go n.healthCheck()
 	}
-	n.producer = producer
 
-	n.logger.Info("Sending NSQ messages to address: ", n.conf.Address)
+	n.logger.Info("Sending NSQ messages to address: ", n.conf.Addresses)
 	return nil
 }
 
-// WriteBatch writes a message to NSQ.
+// WriteBatch writes a message to NSQ. with batching, it blocks until the
+// batch of the message has been published.
 func (n *nsqWriter) WriteBatch(ctx context.Context, topic string, msg []byte) error {
+	if len(msg) == 0 {
+		return nil
+	}
+
+	if n.conf.BatchSize <= 1 {
+		return n.publish(topic, [][]byte{msg})
+	}
+
+	n.batchMut.Lock()
+	b, ok := n.batches[topic]
+	if !ok {
+		b = &batch{done: make(chan struct{})}
+		n.batches[topic] = b
+		time.AfterFunc(n.conf.BatchInterval, func() {
+			n.flush(topic, b)
+		})
+	}
+	b.bodies = append(b.bodies, msg)
+	full := len(b.bodies) >= n.conf.BatchSize
+	n.batchMut.Unlock()
+
+	if full {
+		n.flush(topic, b)
+	}
+	<-b.done
+	return b.err
+}
+
+// flush publishes the batch of the topic unless it has been published already.
+func (n *nsqWriter) flush(topic string, b *batch) {
+	n.batchMut.Lock()
+	if n.batches[topic] != b {
+		n.batchMut.Unlock()
+		return
+	}
+	delete(n.batches, topic)
+	n.batchMut.Unlock()
+
+	b.err = n.publish(topic, b.bodies)
+	close(b.done)
+}
+
+// publish publishes the messages to the healthy nsqd first, failing over to
+// the others in order.
+func (n *nsqWriter) publish(topic string, bodies [][]byte) error {
 	n.connMut.RLock()
-	prod := n.producer
+	nodes := n.nodes
 	n.connMut.RUnlock()
 
-	if prod == nil {
-		return errors.New("not connected to target source or sink")
+	if nodes == nil {
+		return errNotConnected
 	}
 
-	if len(msg) == 0 {
-		return nil
+	ordered := make([]*node, 0, len(nodes))
+	for _, nd := range nodes {
+		if atomic.LoadInt32(&nd.healthy) == 1 {
+			ordered = append(ordered, nd)
+		}
+	}
+	for _, nd := range nodes {
+		if atomic.LoadInt32(&nd.healthy) == 0 {
+			ordered = append(ordered, nd)
+		}
+	}
+
+	var lastErr error
+	for _, nd := range ordered {
+		n.connMut.RLock()
+		producer := nd.producer
+		n.connMut.RUnlock()
+
+		var err error
+		if len(bodies) == 1 {
+			err = producer.Publish(topic, bodies[0])
+		} else {
+			err = producer.MultiPublish(topic, bodies)
+		}
+		if err == nil {
+			atomic.StoreInt32(&nd.healthy, 1)
+			return nil
+		}
+
+		if atomic.SwapInt32(&nd.healthy, 0) == 1 {
+			n.logger.WithField("address", nd.addr).Warn("Unhealthy: ", err)
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// healthCheck pings every nsqd at the health check interval and reconnects the unhealthy ones.
+func (n *nsqWriter) healthCheck() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.conf.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.connMut.RLock()
+		nodes := n.nodes
+		n.connMut.RUnlock()
+
+		for _, nd := range nodes {
+			n.check(nd)
+		}
+	}
+}
+
+// check pings the nsqd of the node, and replaces its producer if the ping fails.
+func (n *nsqWriter) check(nd *node) {
+	n.connMut.RLock()
+	producer := nd.producer
+	n.connMut.RUnlock()
+
+	err := producer.Ping()
+	if err != nil {
+		// reconnect with a new producer, the old one may be stuck on a dead connection.
+		if fresh, nerr := n.newProducer(nd.addr, n.cfg); nerr == nil {
+			if err = fresh.Ping(); err == nil {
+				n.connMut.Lock()
+				nd.producer = fresh
+				n.connMut.Unlock()
+				producer.Stop()
+			} else {
+				fresh.Stop()
+			}
+		}
+	}
+
+	logg := n.logger.WithField("address", nd.addr)
+	if err != nil {
+		if atomic.SwapInt32(&nd.healthy, 0) == 1 {
+			logg.Warn("Unhealthy: ", err)
+		}
+		return
+	}
+	if atomic.SwapInt32(&nd.healthy, 1) == 0 {
+		logg.Info("Reconnected")
 	}
-	return prod.Publish(topic, msg)
 }
 
 // Close closes the NSQ writer.
 func (n *nsqWriter) Close(context.Context) error {
+	// publish the batches waiting to fill.
+	n.batchMut.Lock()
+	pending := make(map[string]*batch, len(n.batches))
+	for topic, b := range n.batches {
+		pending[topic] = b
+	}
+	n.batchMut.Unlock()
+	for topic, b := range pending {
+		n.flush(topic, b)
+	}
+
+	if n.done != nil {
+		close(n.done)
+		n.wg.Wait()
+		n.done = nil
+	}
+
 	n.connMut.Lock()
 	defer n.connMut.Unlock()
 
-	if n.producer != nil {
-		n.producer.Stop()
-		n.producer = nil
+	for _, nd := range n.nodes {
+		nd.producer.Stop()
 	}
+	n.nodes = nil
 	return nil
 }
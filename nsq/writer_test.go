@@ -0,0 +1,218 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nsq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/log"
+)
+
+func TestNSQConfig_Validate(t *testing.T) {
+	assert.NoError(t, NewNSQConfig().Validate())
+
+	tests := []struct {
+		name   string
+		modify func(c *NSQConfig)
+	}{
+		{"no address", func(c *NSQConfig) { c.Addresses = nil }},
+		{"invalid address", func(c *NSQConfig) { c.Addresses = []string{"127.0.0.1"} }},
+		{"invalid lookupd", func(c *NSQConfig) { c.LookupdAddresses = []string{"lookupd"} }},
+		{"invalid topic", func(c *NSQConfig) { c.Topic = "a b" }},
+		{"batch size", func(c *NSQConfig) { c.BatchSize = 0 }},
+		{"batch interval", func(c *NSQConfig) { c.BatchSize, c.BatchInterval = 10, 0 }},
+		{"tls options without tls", func(c *NSQConfig) { c.TLSCAFile = "ca.pem" }},
+		{"cert without key", func(c *NSQConfig) { c.TLS, c.TLSCertFile = true, "cert.pem" }},
+		{"missing ca", func(c *NSQConfig) { c.TLS, c.TLSCAFile = true, "missing.pem" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewNSQConfig()
+			tt.modify(&c)
+			assert.Error(t, c.Validate())
+		})
+	}
+}
+
+// fakeNSQD records the messages published to an address.
+type fakeNSQD struct {
+	mu      sync.Mutex
+	down    map[string]bool
+	msgs    map[string][]string
+	batches int
+	created int
+}
+
+func (f *fakeNSQD) setDown(addr string, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down[addr] = down
+}
+
+func (f *fakeNSQD) published(addr string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.msgs[addr]...)
+}
+
+func (f *fakeNSQD) newProducer(addr string, cfg *nsq.Config) (publisher, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created++
+	return &fakeProducer{nsqd: f, addr: addr}, nil
+}
+
+type fakeProducer struct {
+	nsqd *fakeNSQD
+	addr string
+}
+
+func (p *fakeProducer) Publish(topic string, body []byte) error {
+	return p.MultiPublish(topic, [][]byte{body})
+}
+
+func (p *fakeProducer) MultiPublish(topic string, bodies [][]byte) error {
+	p.nsqd.mu.Lock()
+	defer p.nsqd.mu.Unlock()
+	if p.nsqd.down[p.addr] {
+		return errors.New("connection refused")
+	}
+	if len(bodies) > 1 {
+		p.nsqd.batches++
+	}
+	for _, body := range bodies {
+		p.nsqd.msgs[p.addr] = append(p.nsqd.msgs[p.addr], topic+":"+string(body))
+	}
+	return nil
+}
+
+func (p *fakeProducer) Ping() error {
+	p.nsqd.mu.Lock()
+	defer p.nsqd.mu.Unlock()
+	if p.nsqd.down[p.addr] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (p *fakeProducer) Stop() {}
+
+func newTestWriter(t *testing.T, conf NSQConfig) (*nsqWriter, *fakeNSQD) {
+	async, err := NewNSQWriter(conf, log.New(log.InfoLevel))
+	assert.NoError(t, err)
+
+	nsqd := &fakeNSQD{down: make(map[string]bool), msgs: make(map[string][]string)}
+	w := async.(*nsqWriter)
+	w.newProducer = nsqd.newProducer
+	return w, nsqd
+}
+
+func Test_nsqWriter_failover(t *testing.T) {
+	conf := NewNSQConfig()
+	conf.Addresses = []string{"a:4150", "b:4150"}
+	conf.HealthCheckInterval = 0
+
+	ctx := context.Background()
+	w, nsqd := newTestWriter(t, conf)
+	assert.ErrorIs(t, w.WriteBatch(ctx, "t", []byte("0")), errNotConnected)
+
+	// the writer connects while one nsqd is down, and fails over between them.
+	nsqd.setDown("a:4150", true)
+	assert.NoError(t, w.Connect(ctx))
+	assert.NoError(t, w.WriteBatch(ctx, "t", []byte("1")))
+	nsqd.setDown("a:4150", false)
+	nsqd.setDown("b:4150", true)
+	assert.NoError(t, w.WriteBatch(ctx, "t", []byte("2")))
+	assert.Equal(t, []string{"t:1"}, nsqd.published("b:4150"))
+	assert.Equal(t, []string{"t:2"}, nsqd.published("a:4150"))
+
+	nsqd.setDown("a:4150", true)
+	assert.Error(t, w.WriteBatch(ctx, "t", []byte("3")))
+	assert.NoError(t, w.Close(ctx))
+
+	// the writer fails to connect when every nsqd is down.
+	w, nsqd = newTestWriter(t, conf)
+	nsqd.setDown("a:4150", true)
+	nsqd.setDown("b:4150", true)
+	assert.Error(t, w.Connect(ctx))
+}
+
+func Test_nsqWriter_batch(t *testing.T) {
+	conf := NewNSQConfig()
+	conf.BatchSize = 3
+	conf.BatchInterval = 200 * time.Millisecond
+	conf.HealthCheckInterval = 0
+
+	ctx := context.Background()
+	w, nsqd := newTestWriter(t, conf)
+	assert.NoError(t, w.Connect(ctx))
+
+	// a full batch is published at once, a partial one after the interval.
+	var wg sync.WaitGroup
+	for _, msg := range []string{"1", "2", "3", "4"} {
+		wg.Add(1)
+		go func(msg string) {
+			defer wg.Done()
+			assert.NoError(t, w.WriteBatch(ctx, "t", []byte(msg)))
+		}(msg)
+	}
+	wg.Wait()
+	assert.Len(t, nsqd.published("127.0.0.1:4150"), 4)
+	assert.Equal(t, 1, nsqd.batches)
+
+	// the batch error is returned to every writer of the batch.
+	nsqd.setDown("127.0.0.1:4150", true)
+	assert.Error(t, w.WriteBatch(ctx, "t", []byte("5")))
+	assert.NoError(t, w.Close(ctx))
+}
+
+func Test_nsqWriter_healthCheck(t *testing.T) {
+	conf := NewNSQConfig()
+	conf.HealthCheckInterval = 10 * time.Millisecond
+
+	ctx := context.Background()
+	w, nsqd := newTestWriter(t, conf)
+	assert.NoError(t, w.Connect(ctx))
+
+	// the node is marked unhealthy and reconnected once nsqd is back.
+	nsqd.setDown("127.0.0.1:4150", true)
+	assert.Eventually(t, func() bool {
+		w.connMut.RLock()
+		defer w.connMut.RUnlock()
+		return atomic.LoadInt32(&w.nodes[0].healthy) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	nsqd.setDown("127.0.0.1:4150", false)
+	assert.Eventually(t, func() bool {
+		w.connMut.RLock()
+		defer w.connMut.RUnlock()
+		return atomic.LoadInt32(&w.nodes[0].healthy) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	nsqd.mu.Lock()
+	assert.Greater(t, nsqd.created, 1)
+	nsqd.mu.Unlock()
+	assert.NoError(t, w.Close(ctx))
+}
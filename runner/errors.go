@@ -0,0 +1,112 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"time"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+var (
+	// ErrAnswerRequired is returned when an item produced no answer.
+	ErrAnswerRequired = errors.New("chat answer is required")
+	// ErrBudgetExhausted is returned by the clients when a request would exceed
+	// a budget cap. the item is left pending instead of failed.
+	ErrBudgetExhausted = errors.New("budget exhausted")
+)
+
+// AskError is an error of an ask.
+type AskError struct {
+	// AskID is the id of the failing ask.
+	AskID string
+	// Kind is the class of the step that failed. [upload, chat]
+	Kind gpt4batch.ErrKind
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *AskError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *AskError) Unwrap() error {
+	return e.Err
+}
+
+// NewIErr classifies err into an IErr of the item's attempts run.
+func NewIErr(err error, attempts int) *gpt4batch.IErr {
+	ierr := &gpt4batch.IErr{
+		Message:   err.Error(),
+		Kind:      gpt4batch.ErrKindChat,
+		Attempts:  attempts,
+		Timestamp: time.Now().Unix(),
+	}
+
+	var ae *AskError
+	if errors.As(err, &ae) {
+		ierr.AskID = ae.AskID
+		ierr.Kind = ae.Kind
+	}
+
+	var (
+		se *client.StatusError
+		ne net.Error
+		pe *fs.PathError
+		je *json.SyntaxError
+		te *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &se):
+		ierr.Code = se.StatusCode
+		switch se.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			ierr.Kind = gpt4batch.ErrKindAuth
+		case http.StatusPaymentRequired, http.StatusTooManyRequests:
+			ierr.Kind = gpt4batch.ErrKindQuota
+		case http.StatusBadRequest, http.StatusUnprocessableEntity:
+			ierr.Kind = gpt4batch.ErrKindValidation
+		}
+	case errors.Is(err, ErrBudgetExhausted):
+		ierr.Kind = gpt4batch.ErrKindPending
+	case errors.Is(err, context.Canceled):
+		ierr.Kind = gpt4batch.ErrKindCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		ierr.Kind = gpt4batch.ErrKindTimeout
+	case errors.As(err, &je), errors.As(err, &te):
+		ierr.Kind = gpt4batch.ErrKindDecode
+	case errors.As(err, &pe), errors.Is(err, ErrAnswerRequired):
+		ierr.Kind = gpt4batch.ErrKindValidation
+	}
+	return ierr
+}
+
+// Attempts returns the number of times the item has been run.
+func Attempts(in *gpt4batch.In) int {
+	if in.IErr == nil {
+		return 0
+	}
+	return in.IErr.Attempts
+}
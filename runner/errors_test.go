@@ -0,0 +1,61 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+func Test_NewIErr(t *testing.T) {
+	_, pathErr := os.Open("not-exists.png")
+	syntaxErr := json.Unmarshal([]byte("{"), &struct{}{})
+
+	tests := []struct {
+		name string
+		err  error
+		kind gpt4batch.ErrKind
+		code int
+	}{
+		{"chat status", &AskError{AskID: "1", Kind: gpt4batch.ErrKindChat, Err: &client.StatusError{StatusCode: http.StatusBadGateway}}, gpt4batch.ErrKindChat, http.StatusBadGateway},
+		{"upload status", &AskError{AskID: "1", Kind: gpt4batch.ErrKindUpload, Err: &client.StatusError{StatusCode: http.StatusInternalServerError}}, gpt4batch.ErrKindUpload, http.StatusInternalServerError},
+		{"auth", &AskError{AskID: "1", Kind: gpt4batch.ErrKindChat, Err: &client.StatusError{StatusCode: http.StatusUnauthorized}}, gpt4batch.ErrKindAuth, http.StatusUnauthorized},
+		{"quota", &AskError{AskID: "1", Kind: gpt4batch.ErrKindChat, Err: &client.StatusError{StatusCode: http.StatusTooManyRequests}}, gpt4batch.ErrKindQuota, http.StatusTooManyRequests},
+		{"timeout", &AskError{AskID: "1", Kind: gpt4batch.ErrKindChat, Err: context.DeadlineExceeded}, gpt4batch.ErrKindTimeout, 0},
+		{"canceled", &AskError{AskID: "1", Kind: gpt4batch.ErrKindChat, Err: fmt.Errorf("service canceled: %w", context.Canceled)}, gpt4batch.ErrKindCanceled, 0},
+		{"decode", &AskError{AskID: "1", Kind: gpt4batch.ErrKindChat, Err: syntaxErr}, gpt4batch.ErrKindDecode, 0},
+		{"missing file", &AskError{AskID: "1", Kind: gpt4batch.ErrKindUpload, Err: pathErr}, gpt4batch.ErrKindValidation, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ierr := NewIErr(tt.err, 2)
+			assert.Equal(t, tt.kind, ierr.Kind)
+			assert.Equal(t, tt.code, ierr.Code)
+			assert.Equal(t, "1", ierr.AskID)
+			assert.Equal(t, 2, ierr.Attempts)
+			assert.NotZero(t, ierr.Timestamp)
+		})
+	}
+}
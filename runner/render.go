@@ -0,0 +1,75 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"gitlab.com/gpt4batch"
+)
+
+// render renders the ask content with the answers of the dependencies of the item.
+func (r *Runner) render(in *gpt4batch.In, ask *gpt4batch.Ask) (string, error) {
+	if len(in.DependsOn) == 0 {
+		return ask.Content, nil
+	}
+
+	deps := make(map[string]*gpt4batch.In, len(in.DependsOn))
+	if r.lookup != nil {
+		for _, dep := range in.DependsOn {
+			if item, ok := r.lookup(dep); ok {
+				deps[dep] = item
+			}
+		}
+	}
+
+	tmpl, err := template.New(ask.ID).Funcs(template.FuncMap{
+		// answer returns the text of the answer of a dependency, the last answer
+		// unless the index of the ask is given.
+		"answer": func(id string, idx ...int) (string, error) {
+			dep, ok := deps[id]
+			if !ok {
+				return "", fmt.Errorf("%s is not a dependency of %s", id, in.ID)
+			}
+
+			resps, err := dep.ChatResponses()
+			if err != nil {
+				return "", err
+			}
+
+			i := len(resps) - 1
+			if len(idx) != 0 {
+				i = idx[0]
+			}
+			if i < 0 || i >= len(resps) {
+				return "", fmt.Errorf("%s has no answer %d", id, i)
+			}
+			return resps[i].Text(), nil
+		},
+	}).Parse(ask.Content)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
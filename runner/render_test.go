@@ -0,0 +1,48 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+func Test_Runner_render(t *testing.T) {
+	outline := &gpt4batch.In{ID: "outline", Answers: []interface{}{
+		&gpt4batch.ChatResponse{Contents: []interface{}{"first"}},
+		map[string]interface{}{"contents": []interface{}{"1. intro", "2. body"}},
+	}}
+	item := &gpt4batch.In{ID: "expand", DependsOn: []string{"outline"}}
+	r := New(client.NewNoop(), WithLookup(func(id string) (*gpt4batch.In, bool) {
+		return outline, id == outline.ID
+	}))
+
+	content, err := r.render(item, &gpt4batch.Ask{ID: "a0", Content: `expand: {{ answer "outline" }} after {{ answer "outline" 0 }}`})
+	assert.NoError(t, err)
+	assert.Equal(t, "expand: 1. intro\n2. body after first", content)
+
+	_, err = r.render(item, &gpt4batch.Ask{ID: "a0", Content: `{{ answer "other" }}`})
+	assert.Error(t, err)
+
+	// items without dependencies are sent as is.
+	content, err = r.render(outline, &gpt4batch.Ask{ID: "a0", Content: `{{ not a template`})
+	assert.NoError(t, err)
+	assert.Equal(t, "{{ not a template", content)
+}
@@ -0,0 +1,767 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package runner runs the items of a batch: each item is a conversation of
+// asks, optionally forked into branches, whose answers are validated and
+// appended to the item. batchsvc is built on it and it can be embedded in
+// other Go services.
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+	"gitlab.com/gpt4batch/log"
+)
+
+// Runner runs items with a client.
+type Runner struct {
+	// cc is the client the requests are sent with.
+	cc gpt4batch.Client
+	// logger is the runner logger.
+	logger gpt4batch.Logger
+	// stats is the counters of the items run.
+	stats *Stats
+	// concurrency is the maximum number of items and branches run concurrently.
+	concurrency int
+	// limiter limits the items run concurrently.
+	limiter Limiter
+	// breaker is the circuit breaker of cc, nil if it has none.
+	breaker client.CircuitBreaker
+
+	// url is the url of the chat service.
+	url string
+	// uploadURL is the url of the upload service.
+	uploadURL string
+	// model is the model of the chats.
+	model string
+	// gizmoID is the gizmo id of the chats.
+	gizmoID string
+	// accessToken is the access token of the requests.
+	accessToken string
+	// downloadDir is the dir the files of the answers are downloaded to.
+	downloadDir string
+	// downloadPrefix is the prefix of the downloaded files.
+	downloadPrefix string
+	// historyAndTrainingDisabled disables the chat history.
+	historyAndTrainingDisabled bool
+	// baseDir is the dir the images and files of the asks are relative to.
+	baseDir string
+
+	// resume continues a failed conversation after its persisted answers.
+	resume bool
+	// schema is the json schema the last answer must match, nil if disabled.
+	schema *jsonschema.Schema
+	// reasks is the number of times an answer with invalid json is asked again.
+	reasks int
+	// check checks each answer, nil if disabled.
+	check func(ask *gpt4batch.Ask, resp *gpt4batch.ChatResponse) error
+	// lookup returns the item of an id for the dependencies, nil if disabled.
+	lookup func(id string) (*gpt4batch.In, bool)
+
+	onItemStart []func(ctx context.Context, in *gpt4batch.In, attempt int)
+	onAskStart  []func(ctx context.Context, in *gpt4batch.In, ask *gpt4batch.Ask)
+	onAnswer    []func(ctx context.Context, a *Answer)
+	onItemDone  []func(ctx context.Context, r *Result)
+}
+
+// Answer is the outcome of an ask.
+type Answer struct {
+	// In is the item of the ask.
+	In *gpt4batch.In
+	// Ask is the ask.
+	Ask *gpt4batch.Ask
+	// Branch is the id of the branch of the ask, empty for the asks of the item.
+	Branch string
+	// Attempt is the attempt of the item, starting at 1.
+	Attempt int
+	// Content is the content sent, rendered with the answers of the dependencies.
+	Content string
+	// Started is when the ask started.
+	Started time.Time
+	// Finished is when the ask finished.
+	Finished time.Time
+	// Resp is the answer, nil if the ask failed before it was answered.
+	Resp *gpt4batch.ChatResponse
+	// Err is the error of the ask, nil if it succeeded.
+	Err error
+}
+
+// Result is the outcome of an item.
+type Result struct {
+	// In is the item.
+	In *gpt4batch.In
+	// Attempt is the attempt of the item, starting at 1.
+	Attempt int
+	// Started is when the item started.
+	Started time.Time
+	// Finished is when the item finished.
+	Finished time.Time
+	// Err is the error of the item, nil if it succeeded.
+	Err error
+}
+
+// Option configures a Runner.
+type Option func(*Runner)
+
+// WithLogger sets the logger of the runner.
+func WithLogger(logger gpt4batch.Logger) Option {
+	return func(r *Runner) { r.logger = logger }
+}
+
+// WithStats sets the stats the items are counted in.
+func WithStats(stats *Stats) Option {
+	return func(r *Runner) { r.stats = stats }
+}
+
+// WithConcurrency sets the maximum number of items run concurrently, and of
+// branches run concurrently within an item. 0 means no limit.
+func WithConcurrency(n int) Option {
+	return func(r *Runner) { r.concurrency = n }
+}
+
+// WithLimiter sets the limiter of the items run concurrently instead of WithConcurrency.
+func WithLimiter(l Limiter) Option {
+	return func(r *Runner) { r.limiter = l }
+}
+
+// WithURL sets the url of the chat service.
+func WithURL(url string) Option {
+	return func(r *Runner) { r.url = url }
+}
+
+// WithUploadURL sets the url of the upload service.
+func WithUploadURL(url string) Option {
+	return func(r *Runner) { r.uploadURL = url }
+}
+
+// WithModel sets the model and the gizmo id of the chats.
+func WithModel(model, gizmoID string) Option {
+	return func(r *Runner) {
+		r.model = model
+		r.gizmoID = gizmoID
+	}
+}
+
+// WithAccessToken sets the access token of the requests.
+func WithAccessToken(token string) Option {
+	return func(r *Runner) { r.accessToken = token }
+}
+
+// WithDownload sets the dir and the file prefix the files of the answers are downloaded with.
+func WithDownload(dir, prefix string) Option {
+	return func(r *Runner) {
+		r.downloadDir = dir
+		r.downloadPrefix = prefix
+	}
+}
+
+// WithHistoryAndTrainingDisabled disables the chat history.
+func WithHistoryAndTrainingDisabled(disabled bool) Option {
+	return func(r *Runner) { r.historyAndTrainingDisabled = disabled }
+}
+
+// WithBaseDir sets the dir the images and files of the asks are relative to.
+func WithBaseDir(dir string) Option {
+	return func(r *Runner) { r.baseDir = dir }
+}
+
+// WithResume continues the conversation of a failed item after its persisted answers.
+func WithResume(resume bool) Option {
+	return func(r *Runner) { r.resume = resume }
+}
+
+// WithSchema sets the json schema the last answer of each conversation must
+// match, unless the item has its own. an answer with invalid json is asked
+// again up to reasks times.
+func WithSchema(schema *jsonschema.Schema, reasks int) Option {
+	return func(r *Runner) {
+		r.schema = schema
+		r.reasks = reasks
+	}
+}
+
+// WithCheck sets the check of each answer. the ask fails with the error it returns.
+func WithCheck(check func(ask *gpt4batch.Ask, resp *gpt4batch.ChatResponse) error) Option {
+	return func(r *Runner) { r.check = check }
+}
+
+// WithLookup sets the lookup of the items the asks of an item depend on.
+func WithLookup(lookup func(id string) (*gpt4batch.In, bool)) Option {
+	return func(r *Runner) { r.lookup = lookup }
+}
+
+// OnItemStart adds a callback called before each item run by Run.
+func OnItemStart(fn func(ctx context.Context, in *gpt4batch.In, attempt int)) Option {
+	return func(r *Runner) { r.onItemStart = append(r.onItemStart, fn) }
+}
+
+// OnAskStart adds a callback called before each ask is sent.
+func OnAskStart(fn func(ctx context.Context, in *gpt4batch.In, ask *gpt4batch.Ask)) Option {
+	return func(r *Runner) { r.onAskStart = append(r.onAskStart, fn) }
+}
+
+// OnAnswer adds a callback called once each ask is answered or failed.
+func OnAnswer(fn func(ctx context.Context, a *Answer)) Option {
+	return func(r *Runner) { r.onAnswer = append(r.onAnswer, fn) }
+}
+
+// OnItemDone adds a callback called once each item run by Run succeeded or failed.
+func OnItemDone(fn func(ctx context.Context, r *Result)) Option {
+	return func(r *Runner) { r.onItemDone = append(r.onItemDone, fn) }
+}
+
+// New returns a Runner sending the requests with cc.
+func New(cc gpt4batch.Client, opts ...Option) *Runner {
+	r := &Runner{
+		cc:     cc,
+		logger: log.New(log.InfoLevel),
+		stats:  new(Stats),
+	}
+	client.As(cc, &r.breaker)
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.limiter == nil {
+		wg := NewSizedWaitGroup(r.concurrency)
+		r.limiter = &wg
+		r.stats.SetConcurrency(uint64(wg.Size))
+	}
+	return r
+}
+
+// Stats returns a snapshot of the counters of the items run.
+func (r *Runner) Stats() Stats {
+	return r.stats.Snapshot()
+}
+
+// Run runs the items of source concurrently until source is exhausted or
+// ctx is done, and puts each item in sink once it succeeded or failed. the
+// answers and the error of the item are set on it. Put is never called
+// concurrently.
+//
+// an item interrupted by the cancellation of ctx, or failing with
+// ErrBudgetExhausted, is left pending: its error is set but it is neither
+// counted nor put in sink.
+//
+// Run returns the first error of source or sink, nil once source returns io.EOF.
+func (r *Runner) Run(ctx context.Context, source Source, sink Sink) error {
+	var (
+		mu    sync.Mutex
+		first error
+	)
+	// fail records the first error of source or sink.
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if first == nil {
+			first = err
+		}
+	}
+	// failed reports whether an error has been recorded.
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return first != nil
+	}
+
+	for !failed() {
+		in, err := source.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fail(err)
+			break
+		}
+
+		if err := r.limiter.AddWithContext(ctx); err != nil {
+			fail(err)
+			break
+		}
+		go func(in *gpt4batch.In) {
+			defer r.limiter.Done()
+			if !r.run(ctx, in) {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err := sink.Put(ctx, in); err != nil && first == nil {
+				first = err
+			}
+		}(in)
+	}
+	r.limiter.Wait()
+	return first
+}
+
+// run runs the item and reports whether it is done.
+func (r *Runner) run(ctx context.Context, in *gpt4batch.In) bool {
+	// attempt is the number of times the item has been run, including previous runs.
+	attempt := Attempts(in) + 1
+	started := time.Now()
+	for _, fn := range r.onItemStart {
+		fn(ctx, in, attempt)
+	}
+
+	err := r.Chat(ctx, in, attempt)
+
+	if err != nil {
+		in.IErr = NewIErr(err, attempt)
+		// the item is left pending with its partial answers.
+		if ctx.Err() != nil || errors.Is(err, ErrBudgetExhausted) {
+			return false
+		}
+		r.stats.IncrFailedCount()
+	} else {
+		r.stats.IncrSuccessCount()
+	}
+	r.stats.IncrCompleteCount()
+
+	res := &Result{In: in, Attempt: attempt, Started: started, Finished: time.Now(), Err: err}
+	for _, fn := range r.onItemDone {
+		fn(ctx, res)
+	}
+	return true
+}
+
+// attemptKey is the context key of the attempt of the item being run.
+type attemptKey struct{}
+
+// attemptOf returns the attempt of the item being run, 1 if ctx carries none.
+func attemptOf(ctx context.Context) int {
+	if attempt, ok := ctx.Value(attemptKey{}).(int); ok {
+		return attempt
+	}
+	return 1
+}
+
+// branchKey is the context key of the id of the branch being run.
+type branchKey struct{}
+
+// branchOf returns the id of the branch being run, empty if ctx carries none.
+func branchOf(ctx context.Context) string {
+	branch, _ := ctx.Value(branchKey{}).(string)
+	return branch
+}
+
+// conversation is the state of a conversation.
+type conversation struct {
+	// conversationID is the conversation id.
+	conversationID string
+	// parentMessageID is the parent message id.
+	parentMessageID string
+	// answers is the answers.
+	answers []interface{}
+}
+
+// resume returns the conversation continuing after the persisted answers of
+// a failed conversation, nil if it has to start from scratch. at most max
+// answers are resumed.
+func resume(answers []interface{}, max int) *conversation {
+	if len(answers) == 0 || len(answers) > max {
+		return nil
+	}
+
+	resps, err := gpt4batch.ChatResponses(answers)
+	if err != nil {
+		return nil
+	}
+
+	// the conversation can only continue from a persisted message.
+	last := resps[len(resps)-1]
+	if last.ConversationID == "" || last.MessageID == "" {
+		return nil
+	}
+	return &conversation{
+		conversationID:  last.ConversationID,
+		parentMessageID: last.MessageID,
+		answers:         answers[:len(answers):len(answers)],
+	}
+}
+
+// Chat runs the attempt of the item: it asks the asks of the item and of its
+// branches and appends the answers. the error of the item is cleared once it
+// succeeded, it is left to the caller otherwise.
+func (r *Runner) Chat(ctx context.Context, in *gpt4batch.In, attempt int) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("service canceled: %w", ctx.Err())
+	}
+
+	ctx = context.WithValue(ctx, attemptKey{}, attempt)
+
+	// continue the conversation of a previous run if the item carries one.
+	conv := &conversation{
+		conversationID:  in.ConversationID,
+		parentMessageID: in.ParentMessageID,
+	}
+
+	// in resume mode the conversation continues after the answers persisted
+	// by a previous run. a shared prefix is complete once all its asks are answered.
+	if r.resume && in.IErr != nil {
+		max := len(in.Asks) - 1
+		if len(in.Branches) != 0 {
+			max = len(in.Asks)
+		}
+
+		if c := resume(in.Answers, max); c != nil {
+			conv = c
+			r.logger.
+				WithField("id", in.ID).
+				WithField("from", len(c.answers)).
+				WithField("conversation_id", c.conversationID).
+				Info("Resume")
+		}
+	}
+	in.Answers = conv.answers
+
+	persist := func(answers []interface{}) {
+		in.Answers = answers
+	}
+	if err := r.converse(ctx, in, in.Asks[len(conv.answers):], conv, persist); err != nil {
+		return err
+	}
+
+	// branches fork from the last message of the shared prefix.
+	if len(in.Branches) != 0 {
+		if err := r.branch(ctx, in, conv); err != nil {
+			return err
+		}
+	} else if len(conv.answers) == 0 {
+		return ErrAnswerRequired
+	} else if err := r.validate(ctx, in, in.Asks, conv, persist); err != nil {
+		return err
+	}
+
+	in.IErr = nil
+
+	r.logger.
+		WithField("id", in.ID).
+		WithField("complete", r.stats.GetCompleteTotal()).
+		WithField("success", r.stats.GetSuccessTotal()).
+		WithField("failed", r.stats.GetFailedTotal()).
+		Info("OK")
+	return nil
+}
+
+// branch runs the branches of the item concurrently, each continuing the prefix conversation.
+// it returns the error of the first failed branch.
+func (r *Runner) branch(ctx context.Context, in *gpt4batch.In, prefix *conversation) error {
+	var (
+		wg    = NewSizedWaitGroup(r.concurrency)
+		mu    sync.Mutex
+		first error
+	)
+
+	for _, b := range in.Branches {
+		conv := &conversation{
+			conversationID:  prefix.conversationID,
+			parentMessageID: prefix.parentMessageID,
+		}
+
+		// in resume mode the successful branches are kept and the failed ones
+		// continue after their persisted answers.
+		if r.resume && in.IErr != nil {
+			if b.IErr == nil && len(b.Answers) != 0 && len(b.Answers) == len(b.Asks) {
+				continue
+			}
+			if b.IErr != nil {
+				if c := resume(b.Answers, len(b.Asks)-1); c != nil {
+					conv = c
+				}
+			}
+		}
+
+		wg.Add()
+		go func(b *gpt4batch.Branch, conv *conversation) {
+			defer wg.Done()
+
+			tries := 1
+			if b.IErr != nil {
+				tries = b.IErr.Attempts + 1
+			}
+
+			ctx := context.WithValue(ctx, branchKey{}, b.ID)
+			persist := func(answers []interface{}) {
+				b.Answers = answers
+			}
+			b.Answers = conv.answers
+			err := r.converse(ctx, in, b.Asks[len(conv.answers):], conv, persist)
+			if err == nil && len(conv.answers) == 0 {
+				err = ErrAnswerRequired
+			}
+			if err == nil {
+				err = r.validate(ctx, in, b.Asks, conv, persist)
+			}
+			if err != nil {
+				b.IErr = NewIErr(err, tries)
+
+				mu.Lock()
+				if first == nil {
+					first = fmt.Errorf("branch %s: %w", b.ID, err)
+				}
+				mu.Unlock()
+				return
+			}
+			b.IErr = nil
+		}(b, conv)
+	}
+	wg.Wait()
+	return first
+}
+
+// upload uploads the file of req. a request refused by an open circuit is
+// sent again once the circuit accepts requests.
+func (r *Runner) upload(ctx context.Context, req *gpt4batch.UploadRequest) (*gpt4batch.UploadResponse, error) {
+	for {
+		resp, err := r.cc.Upload(ctx, req)
+		if !r.waitCircuit(ctx, req.UploadURL, err) {
+			return resp, err
+		}
+	}
+}
+
+// chat sends req. a request refused by an open circuit is sent again once
+// the circuit accepts requests, so the conversation goes on where it stopped.
+func (r *Runner) chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	for {
+		resp, err := r.cc.Chat(ctx, req)
+		if !r.waitCircuit(ctx, req.URL, err) {
+			return resp, err
+		}
+	}
+}
+
+// waitCircuit reports whether err is a refusal of the open circuit of url
+// and the circuit accepts requests again.
+func (r *Runner) waitCircuit(ctx context.Context, url string, err error) bool {
+	if r.breaker == nil || !errors.Is(err, client.ErrCircuitOpen) {
+		return false
+	}
+	return r.breaker.Wait(ctx, url) == nil
+}
+
+// converse asks the asks in the conversation one after another. persist is
+// called with the answers after each answered ask.
+func (r *Runner) converse(ctx context.Context, in *gpt4batch.In, asks gpt4batch.Asks, conv *conversation, persist func([]interface{})) error {
+	var (
+		// attachments is the attachments.
+		attachments gpt4batch.Attachments
+		// parts is the parts.
+		parts gpt4batch.Parts
+	)
+
+	for _, ask := range asks {
+		var (
+			started = time.Now()
+			// content is the ask content rendered with the answers of the dependencies.
+			content = ask.Content
+		)
+		// fail reports the failure of the ask and returns err.
+		fail := func(err error) error {
+			r.answer(ctx, in, ask, content, started, nil, err)
+			return err
+		}
+
+		for _, fn := range r.onAskStart {
+			fn(ctx, in, ask)
+		}
+
+		r.logger.
+			WithField("id", in.ID).
+			WithField("pid", ask.ID).
+			WithField("complete", r.stats.GetCompleteTotal()).
+			WithField("success", r.stats.GetSuccessTotal()).
+			WithField("failed", r.stats.GetFailedTotal()).
+			WithField("concurrency", r.stats.GetConcurrency()).
+			Info()
+
+		// tmpConversationID is the temporary conversation id.
+		// if the conversation id is not null, use the conversation id.
+		var tmpConversationID string
+
+		// conversationID is the conversation id. if the conversation id is not null, use the conversation id.
+		// if the conversation id is null, use the temporary conversation id.
+		if conv.conversationID != "" {
+			tmpConversationID = conv.conversationID
+		}
+
+		// Images is the images. if the images is not null, upload the images.
+		// if the images is null, do nothing.
+		if len(ask.Images) != 0 {
+			for _, image := range ask.Images {
+				// resp is the response. if the response is not null, upload the image.
+				// if the response is null, do nothing.
+				resp, err := r.upload(ctx, &gpt4batch.UploadRequest{
+					Source: &gpt4batch.Source{
+						ID:          in.ID,            // in.ID is the id of the batch.
+						URL:         r.uploadURL,      // r.uploadURL is the url of the server.
+						UploadURL:   r.uploadURL,      // r.uploadURL is the upload url of the server.
+						Name:        "UploadImage",    // "Upload" is the name of the upload.
+						Pid:         ask.ID,           // ask.ID is the id of the ask.
+						Prefix:      r.downloadPrefix, // Prefix  is the download file prefix.
+						AccessToken: r.accessToken,    // r.accessToken is the access token of the server.
+						Dir:         r.downloadDir,    // r.downloadDir is the download dir of the server.
+					},
+					ConversationId: tmpConversationID,
+					UploadPath:     filepath.Join(r.baseDir, image),
+					UploadType:     gpt4batch.Multimodal,
+				})
+				if err != nil {
+					return fail(&AskError{AskID: ask.ID, Kind: gpt4batch.ErrKindUpload, Err: err})
+				}
+
+				// parts is the parts. if the parts is not null, append the parts.
+				// if the parts is null, do nothing.
+				parts = append(parts, &gpt4batch.Part{
+					Name:         resp.Part.Name,
+					AssetPointer: resp.Part.AssetPointer,
+					SizeBytes:    resp.Part.SizeBytes,
+					MimeType:     resp.Part.MimeType,
+					Width:        resp.Part.Width,
+					Height:       resp.Part.Height,
+				})
+
+				tmpConversationID = resp.ConversationId
+			}
+		}
+
+		// Files is the files. if the files is not null, upload the files.
+		if len(ask.Files) != 0 {
+			for _, file := range ask.Files {
+				// resp is the response. if the response is not null, upload the file.
+				// if the response is null, do nothing.
+				resp, err := r.upload(ctx, &gpt4batch.UploadRequest{
+					Source: &gpt4batch.Source{
+						ID:          in.ID,            // in.ID is the id of the batch.
+						URL:         r.uploadURL,      // r.uploadURL is the url of the server.
+						UploadURL:   r.uploadURL,      // r.uploadURL is the upload url of the server.
+						Name:        "UploadFile",     // "Upload" is the name of the upload.
+						Pid:         ask.ID,           // ask.ID is the id of the ask.
+						Prefix:      r.downloadPrefix, // Prefix  is the download file prefix.
+						AccessToken: r.accessToken,    // r.accessToken is the access token of the server.
+						Dir:         r.downloadDir,    // r.downloadDir is the download dir of the server.
+					},
+					ConversationId: tmpConversationID,
+					UploadPath:     filepath.Join(r.baseDir, file),
+					UploadType:     gpt4batch.MyFiles,
+				})
+				if err != nil {
+					return fail(&AskError{AskID: ask.ID, Kind: gpt4batch.ErrKindUpload, Err: err})
+				}
+
+				// parts is the parts. if the parts is not null, append the parts.
+				// if the parts is null, do nothing.
+				attachments = append(attachments, &gpt4batch.Attachment{
+					Id:            resp.Attachment.Id,
+					Name:          resp.Attachment.Name,
+					Size:          resp.Attachment.Size,
+					FileTokenSize: resp.Attachment.FileTokenSize,
+					MimeType:      resp.Attachment.MimeType,
+					Width:         resp.Attachment.Width,
+					Height:        resp.Attachment.Height,
+				})
+
+				tmpConversationID = resp.ConversationId
+			}
+		}
+
+		rendered, err := r.render(in, ask)
+		if err != nil {
+			return fail(&AskError{AskID: ask.ID, Kind: gpt4batch.ErrKindValidation, Err: err})
+		}
+		content = rendered
+
+		// Chat sends a message to the server and returns the response.
+		// if the response is not null, append the response.
+		resp, err := r.chat(ctx, &gpt4batch.ChatRequest{
+			Source: &gpt4batch.Source{
+				ID:          in.ID,            // in.ID is the id of the batch.
+				URL:         r.url,            // r.url is the url of the server.
+				Name:        "Chat",           // "Chat" is the name of the chat.
+				Pid:         ask.ID,           // ask.ID is the id of the ask.
+				Prefix:      r.downloadPrefix, // Prefix  is the download file prefix.
+				AccessToken: r.accessToken,    // r.accessToken is the access token of the server.
+				Dir:         r.downloadDir,    // r.downloadDir is the download dir of the server.
+			},
+			GizmoId:                    r.gizmoID,
+			Message:                    content,
+			ParentMessageID:            conv.parentMessageID,
+			ConversationID:             tmpConversationID,
+			Stream:                     false,
+			Model:                      r.model,
+			Attachments:                attachments,
+			Parts:                      parts,
+			HistoryAndTrainingDisabled: r.historyAndTrainingDisabled,
+		})
+		if err != nil {
+			return fail(&AskError{AskID: ask.ID, Kind: gpt4batch.ErrKindChat, Err: err})
+		}
+
+		// the ask fails if the answer does not pass the check. the answer is
+		// not persisted so that a resumed conversation asks it again.
+		if r.check != nil {
+			if err := r.check(ask, resp); err != nil {
+				r.answer(ctx, in, ask, content, started, resp, err)
+				return err
+			}
+		}
+
+		// answers is the answers. if the answers is not null, append the answers.
+		// if the answers is null, do nothing.
+		conv.answers = append(conv.answers, resp)
+		conv.parentMessageID = resp.MessageID
+		conv.conversationID = resp.ConversationID
+
+		// persist the partial answers so that a failed conversation can be resumed.
+		persist(conv.answers)
+		r.answer(ctx, in, ask, content, started, resp, nil)
+	}
+	return nil
+}
+
+// answer reports the outcome of an ask answered with resp or failed with err.
+func (r *Runner) answer(ctx context.Context, in *gpt4batch.In, ask *gpt4batch.Ask, content string, started time.Time, resp *gpt4batch.ChatResponse, err error) {
+	if len(r.onAnswer) == 0 {
+		return
+	}
+
+	a := &Answer{
+		In:       in,
+		Ask:      ask,
+		Branch:   branchOf(ctx),
+		Attempt:  attemptOf(ctx),
+		Content:  content,
+		Started:  started,
+		Finished: time.Now(),
+		Resp:     resp,
+		Err:      err,
+	}
+	for _, fn := range r.onAnswer {
+		fn(ctx, a)
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+// recordClient is a client that records the chat requests and answers each one
+// in the conversation "c" with the message id "m<n>".
+type recordClient struct {
+	gpt4batch.Client
+
+	mu   sync.Mutex
+	reqs []*gpt4batch.ChatRequest
+}
+
+func (c *recordClient) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reqs = append(c.reqs, req)
+	return &gpt4batch.ChatResponse{
+		MessageID:      fmt.Sprintf("m%d", len(c.reqs)),
+		ConversationID: "c",
+		EndTurn:        true,
+		Contents:       []interface{}{req.Message},
+	}, nil
+}
+
+func Test_Runner_Chat_resume(t *testing.T) {
+	newItem := func() *gpt4batch.In {
+		return &gpt4batch.In{
+			ID:   "1",
+			Asks: gpt4batch.Asks{{ID: "a0", Content: "q0"}, {ID: "a1", Content: "q1"}, {ID: "a2", Content: "q2"}},
+			Answers: []interface{}{map[string]interface{}{
+				"message_id":      "prev",
+				"conversation_id": "conv",
+				"contents":        []interface{}{"q0"},
+			}},
+			IErr: &gpt4batch.IErr{Kind: gpt4batch.ErrKindChat, AskID: "a1"},
+		}
+	}
+
+	// resume continues the conversation from the first unanswered ask.
+	cc := &recordClient{Client: client.NewNoop()}
+	item := newItem()
+	assert.NoError(t, New(cc, WithResume(true)).Chat(context.Background(), item, 1))
+	assert.Len(t, cc.reqs, 2)
+	assert.Equal(t, "q1", cc.reqs[0].Message)
+	assert.Equal(t, "conv", cc.reqs[0].ConversationID)
+	assert.Equal(t, "prev", cc.reqs[0].ParentMessageID)
+	assert.Equal(t, "m1", cc.reqs[1].ParentMessageID)
+	assert.Len(t, item.Answers, 3)
+	assert.Nil(t, item.IErr)
+
+	// without resume the conversation starts from scratch.
+	cc = &recordClient{Client: client.NewNoop()}
+	item = newItem()
+	assert.NoError(t, New(cc).Chat(context.Background(), item, 1))
+	assert.Len(t, cc.reqs, 3)
+	assert.Empty(t, cc.reqs[0].ConversationID)
+	assert.Len(t, item.Answers, 3)
+}
+
+func Test_Runner_Chat_resume_check(t *testing.T) {
+	errCheck := errors.New("check failed")
+	failed := false
+	// check fails the first answer of the middle ask.
+	check := func(ask *gpt4batch.Ask, resp *gpt4batch.ChatResponse) error {
+		if ask.ID == "a1" && !failed {
+			failed = true
+			return errCheck
+		}
+		return nil
+	}
+
+	cc := &recordClient{Client: client.NewNoop()}
+	r := New(cc, WithResume(true), WithCheck(check))
+	item := &gpt4batch.In{
+		ID:   "1",
+		Asks: gpt4batch.Asks{{ID: "a0", Content: "q0"}, {ID: "a1", Content: "q1"}, {ID: "a2", Content: "q2"}},
+	}
+	err := r.Chat(context.Background(), item, 1)
+	assert.ErrorIs(t, err, errCheck)
+	// the failing answer is not persisted.
+	assert.Len(t, item.Answers, 1)
+	item.IErr = NewIErr(err, 1)
+
+	// the resumed conversation asks the failed ask again.
+	cc.reqs = nil
+	assert.NoError(t, r.Chat(context.Background(), item, 2))
+	assert.Len(t, cc.reqs, 2)
+	assert.Equal(t, "q1", cc.reqs[0].Message)
+	assert.Equal(t, "m1", cc.reqs[0].ParentMessageID)
+	assert.Len(t, item.Answers, 3)
+	assert.Nil(t, item.IErr)
+}
+
+func Test_Runner_Chat_continue(t *testing.T) {
+	cc := &recordClient{Client: client.NewNoop()}
+	item := &gpt4batch.In{
+		ID:              "1",
+		Asks:            gpt4batch.Asks{{ID: "a0", Content: "q0"}},
+		ConversationID:  "conv",
+		ParentMessageID: "prev",
+	}
+	assert.NoError(t, New(cc).Chat(context.Background(), item, 1))
+	assert.Equal(t, "conv", cc.reqs[0].ConversationID)
+	assert.Equal(t, "prev", cc.reqs[0].ParentMessageID)
+}
+
+// openClient refuses the first chat of refuse as if its circuit was open.
+type openClient struct {
+	*recordClient
+	refuse string
+	waits  int
+}
+
+func (c *openClient) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	if req.Message == c.refuse && c.waits == 0 {
+		return nil, client.ErrCircuitOpen
+	}
+	return c.recordClient.Chat(ctx, req)
+}
+
+func (c *openClient) Wait(ctx context.Context, url string) error {
+	c.waits++
+	return nil
+}
+
+func Test_Runner_Chat_circuitOpen(t *testing.T) {
+	cc := &openClient{recordClient: &recordClient{Client: client.NewNoop()}, refuse: "q1"}
+	item := &gpt4batch.In{
+		ID:   "1",
+		Asks: gpt4batch.Asks{{ID: "a0", Content: "q0"}, {ID: "a1", Content: "q1"}},
+	}
+
+	// the refused ask is sent again once the circuit recovers, in the same conversation.
+	assert.NoError(t, New(cc).Chat(context.Background(), item, 1))
+	assert.Equal(t, 1, cc.waits)
+	assert.Len(t, cc.reqs, 2)
+	assert.Equal(t, "q0", cc.reqs[0].Message)
+	assert.Equal(t, "q1", cc.reqs[1].Message)
+	assert.Equal(t, "m1", cc.reqs[1].ParentMessageID)
+	assert.Len(t, item.Answers, 2)
+}
+
+func Test_Runner_Chat_branches(t *testing.T) {
+	cc := &recordClient{Client: client.NewNoop()}
+	item := &gpt4batch.In{
+		ID:   "1",
+		Asks: gpt4batch.Asks{{ID: "a0", Content: "prefix"}},
+		Branches: gpt4batch.Branches{
+			{ID: "b0", Asks: gpt4batch.Asks{{ID: "b0a0", Content: "q0"}}},
+			{ID: "b1", Asks: gpt4batch.Asks{{ID: "b1a0", Content: "q1"}, {ID: "b1a1", Content: "q2"}}},
+		},
+	}
+	var (
+		mu       sync.Mutex
+		branches = make(map[string]string)
+	)
+	onAnswer := OnAnswer(func(ctx context.Context, a *Answer) {
+		mu.Lock()
+		defer mu.Unlock()
+		branches[a.Ask.ID] = a.Branch
+	})
+	assert.NoError(t, New(cc, WithConcurrency(2), onAnswer).Chat(context.Background(), item, 1))
+
+	// the prefix runs once and each branch forks from its answer.
+	assert.Len(t, cc.reqs, 4)
+	assert.Equal(t, "prefix", cc.reqs[0].Message)
+	forks := 0
+	for _, req := range cc.reqs[1:] {
+		if req.ParentMessageID == "m1" {
+			forks++
+		}
+	}
+	assert.Equal(t, 2, forks)
+	assert.Len(t, item.Answers, 1)
+	assert.Len(t, item.Branches[0].Answers, 1)
+	assert.Len(t, item.Branches[1].Answers, 2)
+	assert.Nil(t, item.Branches[1].IErr)
+	assert.Equal(t, map[string]string{"a0": "", "b0a0": "b0", "b1a0": "b1", "b1a1": "b1"}, branches)
+}
+
+// failClient fails the chats of the messages in fails with their error.
+type failClient struct {
+	*recordClient
+	fails map[string]error
+}
+
+func (c failClient) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	if err, ok := c.fails[req.Message]; ok {
+		return nil, err
+	}
+	return c.recordClient.Chat(ctx, req)
+}
+
+func Test_Runner_Run(t *testing.T) {
+	lines := strings.Join([]string{
+		`{"id": "1", "asks": [{"id": "a0", "content": "q0"}, {"id": "a1", "content": "q1"}]}`,
+		`{"id": "2", "asks": [{"id": "a0", "content": "boom"}]}`,
+		`{"id": "3", "asks": [{"id": "a0", "content": "broke"}]}`,
+		``,
+		`{"id": "4", "asks": [{"id": "a0", "content": "q2"}]}`,
+	}, "\n")
+	cc := failClient{
+		recordClient: &recordClient{Client: client.NewNoop()},
+		fails: map[string]error{
+			"boom":  errors.New("boom"),
+			"broke": fmt.Errorf("%w: max chats", ErrBudgetExhausted),
+		},
+	}
+
+	var (
+		mu      sync.Mutex
+		started []string
+		answers []string
+		done    []string
+		out     bytes.Buffer
+	)
+	r := New(cc,
+		WithConcurrency(2),
+		OnItemStart(func(ctx context.Context, in *gpt4batch.In, attempt int) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, 1, attempt)
+			started = append(started, in.ID)
+		}),
+		OnAnswer(func(ctx context.Context, a *Answer) {
+			mu.Lock()
+			defer mu.Unlock()
+			answers = append(answers, fmt.Sprintf("%s/%s:%v", a.In.ID, a.Ask.ID, a.Err))
+		}),
+		OnItemDone(func(ctx context.Context, res *Result) {
+			mu.Lock()
+			defer mu.Unlock()
+			done = append(done, fmt.Sprintf("%s:%v", res.In.ID, res.Err))
+		}),
+	)
+	assert.NoError(t, r.Run(context.Background(), Lines(strings.NewReader(lines)), Writer(&out)))
+
+	assert.ElementsMatch(t, []string{"1", "2", "3", "4"}, started)
+	assert.ElementsMatch(t, []string{"1/a0:<nil>", "1/a1:<nil>", "2/a0:boom", "3/a0:budget exhausted: max chats", "4/a0:<nil>"}, answers)
+	// the item out of budget is left pending.
+	assert.ElementsMatch(t, []string{"1:<nil>", "2:boom", "4:<nil>"}, done)
+	assert.Equal(t, Stats{CompleteTotal: 3, SuccessTotal: 2, FailedTotal: 1, Concurrency: 2}, r.Stats())
+
+	// the items done are written with their answers and errors.
+	got := make(map[string]*gpt4batch.In)
+	source := Lines(&out)
+	for {
+		in, err := source.Next(context.Background())
+		if err != nil {
+			break
+		}
+		got[in.ID] = in
+	}
+	assert.Len(t, got, 3)
+	assert.Len(t, got["1"].Answers, 2)
+	assert.Nil(t, got["1"].IErr)
+	assert.Equal(t, gpt4batch.ErrKindChat, got["2"].IErr.Kind)
+	assert.Equal(t, 1, got["2"].IErr.Attempts)
+
+	// the error of the sink stops the run.
+	err := New(cc).Run(context.Background(), Items(gpt4batch.Ins{{ID: "5", Asks: gpt4batch.Asks{{ID: "a0", Content: "q"}}}}), SinkFunc(func(ctx context.Context, in *gpt4batch.In) error {
+		return errors.New("disk full")
+	}))
+	assert.EqualError(t, err, "disk full")
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	"gitlab.com/gpt4batch"
+)
+
+// errNoJSON is returned when an answer has no json.
+var errNoJSON = errors.New("no json found in the answer")
+
+// fencedJSON matches a fenced code block of a markdown answer.
+var fencedJSON = regexp.MustCompile("(?s)```(?:json|JSON)?[ \t]*\n?(.*?)```")
+
+// compileRawSchema compiles the inline json schema of an item.
+func compileRawSchema(id string, raw json.RawMessage) (*jsonschema.Schema, error) {
+	url := "item://" + id + ".json"
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(url)
+}
+
+// extractJSON returns the first json value of the text: the first fenced
+// code block holding json, otherwise the first json object or array.
+func extractJSON(text string) (interface{}, error) {
+	for _, match := range fencedJSON.FindAllStringSubmatch(text, -1) {
+		if v, err := decodeJSON(strings.TrimSpace(match[1])); err == nil {
+			return v, nil
+		}
+	}
+
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] != '{' && text[idx] != '[' {
+			continue
+		}
+		if v, err := decodeJSON(text[idx:]); err == nil {
+			return v, nil
+		}
+	}
+	return nil, errNoJSON
+}
+
+// decodeJSON decodes the json value at the start of text.
+func decodeJSON(text string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// validate extracts the json of the last answer of the conversation and validates
+// it against the json schema of the item or the run. an invalid answer is asked
+// again in the same conversation with the validation errors, up to reasks times.
+func (r *Runner) validate(ctx context.Context, in *gpt4batch.In, asks gpt4batch.Asks, conv *conversation, persist func([]interface{})) error {
+	schema := r.schema
+	if len(in.Schema) != 0 {
+		sch, err := compileRawSchema(in.ID, in.Schema)
+		if err != nil {
+			return &AskError{Kind: gpt4batch.ErrKindValidation, Err: fmt.Errorf("schema: %w", err)}
+		}
+		schema = sch
+	}
+	if schema == nil || len(conv.answers) == 0 || len(asks) == 0 {
+		return nil
+	}
+
+	var (
+		last = len(conv.answers) - 1
+		ask  = asks[len(asks)-1]
+	)
+	resps, err := gpt4batch.ChatResponses(conv.answers[last:])
+	if err != nil {
+		return &AskError{AskID: ask.ID, Kind: gpt4batch.ErrKindDecode, Err: err}
+	}
+	resp := resps[0]
+
+	var (
+		// content and started are those of the last re-ask.
+		content string
+		started time.Time
+	)
+	for reasks := 0; ; reasks++ {
+		v, err := extractJSON(resp.Text())
+		if err == nil {
+			err = schema.Validate(v)
+		}
+		if err == nil {
+			resp.JSON = v
+			conv.answers[last] = resp
+			persist(conv.answers)
+			// the corrected answer is reported like the answer of the ask.
+			if reasks != 0 {
+				r.answer(ctx, in, ask, content, started, resp, nil)
+			}
+			return nil
+		}
+
+		if reasks >= r.reasks {
+			err = &AskError{AskID: ask.ID, Kind: gpt4batch.ErrKindValidation, Err: fmt.Errorf("answer json: %w", err)}
+			r.answer(ctx, in, ask, content, started, resp, err)
+			return err
+		}
+
+		r.logger.
+			WithField("id", in.ID).
+			WithField("pid", ask.ID).
+			WithField("reask", reasks+1).
+			Warn(fmt.Sprintf("Invalid json: %s", err))
+
+		// ask again in the same conversation. the corrected answer replaces the invalid one.
+		content, started = reaskMessage(err), time.Now()
+		resp, err = r.chat(ctx, &gpt4batch.ChatRequest{
+			Source: &gpt4batch.Source{
+				ID:          in.ID,            // in.ID is the id of the batch.
+				URL:         r.url,            // r.url is the url of the server.
+				Name:        "Reask",          // "Reask" is the name of the json re-ask.
+				Pid:         ask.ID,           // ask.ID is the id of the ask.
+				Prefix:      r.downloadPrefix, // Prefix  is the download file prefix.
+				AccessToken: r.accessToken,    // r.accessToken is the access token of the server.
+				Dir:         r.downloadDir,    // r.downloadDir is the download dir of the server.
+			},
+			GizmoId:                    r.gizmoID,
+			Message:                    content,
+			ParentMessageID:            conv.parentMessageID,
+			ConversationID:             conv.conversationID,
+			Stream:                     false,
+			Model:                      r.model,
+			HistoryAndTrainingDisabled: r.historyAndTrainingDisabled,
+		})
+		if err != nil {
+			err = &AskError{AskID: ask.ID, Kind: gpt4batch.ErrKindChat, Err: err}
+			r.answer(ctx, in, ask, content, started, nil, err)
+			return err
+		}
+
+		// the corrected answer must pass the check like any other answer.
+		if r.check != nil {
+			if err := r.check(ask, resp); err != nil {
+				r.answer(ctx, in, ask, content, started, resp, err)
+				return err
+			}
+		}
+
+		conv.answers[last] = resp
+		conv.parentMessageID = resp.MessageID
+		conv.conversationID = resp.ConversationID
+		persist(conv.answers)
+	}
+}
+
+// reaskMessage returns the message asking to correct the json of the answer.
+func reaskMessage(err error) string {
+	return fmt.Sprintf("The JSON in your previous answer is invalid:\n%s\nPlease reply with the corrected JSON only.", err)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/client"
+)
+
+func Test_extractJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"fenced", "Here:\n```json\n{\"a\": 1}\n```\nbye", `{"a":1}`},
+		{"inline", `the result is {"a": [1, 2]} as requested`, `{"a":[1,2]}`},
+		{"array", `[1, 2] and {"a": 1}`, `[1,2]`},
+		{"skip invalid", `{oops} then {"a": true}`, `{"a":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := extractJSON(tt.text)
+			assert.NoError(t, err)
+			got, _ := json.Marshal(v)
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+
+	_, err := extractJSON("no json here")
+	assert.ErrorIs(t, err, errNoJSON)
+}
+
+// scriptClient is a client that answers the chat requests with the scripted replies in order.
+type scriptClient struct {
+	gpt4batch.Client
+	replies []string
+	reqs    []*gpt4batch.ChatRequest
+	waits   int
+}
+
+func (c *scriptClient) Chat(ctx context.Context, req *gpt4batch.ChatRequest) (*gpt4batch.ChatResponse, error) {
+	c.reqs = append(c.reqs, req)
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	// the reply "open" refuses the request as if its circuit was open.
+	if reply == "open" {
+		return nil, client.ErrCircuitOpen
+	}
+	return &gpt4batch.ChatResponse{MessageID: reply, ConversationID: "c", Contents: []interface{}{reply}}, nil
+}
+
+func (c *scriptClient) Wait(ctx context.Context, url string) error {
+	c.waits++
+	return nil
+}
+
+func Test_Runner_validate(t *testing.T) {
+	schema := json.RawMessage(`{"type": "object", "required": ["name"]}`)
+
+	// the invalid answer is asked again and replaced by the corrected one.
+	cc := &scriptClient{Client: client.NewNoop(), replies: []string{`{"nam": 1}`, `{"name": "x"}`}}
+	item := &gpt4batch.In{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "json please"}}, Schema: schema}
+	r := New(cc, WithSchema(nil, 1))
+	assert.NoError(t, r.Chat(context.Background(), item, 1))
+	assert.Len(t, cc.reqs, 2)
+	assert.Equal(t, `{"nam": 1}`, cc.reqs[1].ParentMessageID)
+	assert.Len(t, item.Answers, 1)
+	assert.Equal(t, map[string]interface{}{"name": "x"}, item.Answers[0].(*gpt4batch.ChatResponse).JSON)
+
+	// the item fails once the re-asks are used up.
+	cc = &scriptClient{Client: client.NewNoop(), replies: []string{`no json`}}
+	item = &gpt4batch.In{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "json please"}}, Schema: schema}
+	err := New(cc).Chat(context.Background(), item, 1)
+	assert.ErrorIs(t, err, errNoJSON)
+	assert.Equal(t, gpt4batch.ErrKindValidation, NewIErr(err, 1).Kind)
+}
+
+func Test_Runner_validate_reask(t *testing.T) {
+	schema := json.RawMessage(`{"type": "object", "required": ["name"]}`)
+	var answers []*Answer
+	onAnswer := OnAnswer(func(ctx context.Context, a *Answer) {
+		answers = append(answers, a)
+	})
+
+	// the re-ask refused by an open circuit is sent again, and the corrected answer is reported.
+	cc := &scriptClient{Client: client.NewNoop(), replies: []string{`{"nam": 1}`, "open", `{"name": "x"}`}}
+	item := &gpt4batch.In{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "json please"}}, Schema: schema}
+	assert.NoError(t, New(cc, WithSchema(nil, 1), onAnswer).Chat(context.Background(), item, 1))
+	assert.Equal(t, 1, cc.waits)
+	if assert.Len(t, answers, 2) {
+		assert.Equal(t, "json please", answers[0].Content)
+		assert.Contains(t, answers[1].Content, "The JSON in your previous answer is invalid")
+		assert.Equal(t, map[string]interface{}{"name": "x"}, answers[1].Resp.JSON)
+		assert.NoError(t, answers[1].Err)
+	}
+
+	// the corrected answer must pass the check.
+	errCheck := errors.New("check failed")
+	check := func(ask *gpt4batch.Ask, resp *gpt4batch.ChatResponse) error {
+		if resp.Text() == `{"name": "y"}` {
+			return errCheck
+		}
+		return nil
+	}
+	answers = nil
+	cc = &scriptClient{Client: client.NewNoop(), replies: []string{`{"nam": 1}`, `{"name": "y"}`}}
+	item = &gpt4batch.In{ID: "1", Asks: gpt4batch.Asks{{ID: "a0", Content: "json please"}}, Schema: schema}
+	assert.ErrorIs(t, New(cc, WithSchema(nil, 1), WithCheck(check), onAnswer).Chat(context.Background(), item, 1), errCheck)
+	if assert.Len(t, answers, 2) {
+		assert.ErrorIs(t, answers[1].Err, errCheck)
+	}
+}
@@ -18,7 +18,7 @@ limitations under the License.
 // same API as the Golang sync.WaitGroup but adds a limit of
 // the amount of goroutines started concurrently.
 
-package batchsvc
+package runner
 
 import (
 	"context"
@@ -26,6 +26,18 @@ import (
 	"sync"
 )
 
+// Limiter limits the amount of goroutines started concurrently.
+type Limiter interface {
+	// Add increments the internal WaitGroup counter.
+	Add()
+	// AddWithContext increments the internal WaitGroup counter or returns an error if the context is canceled.
+	AddWithContext(ctx context.Context) error
+	// Done decrements the internal WaitGroup counter.
+	Done()
+	// Wait blocks until the internal WaitGroup counter is zero.
+	Wait()
+}
+
 type SizedWaitGroup struct {
 	Size int
 
@@ -33,10 +45,10 @@ type SizedWaitGroup struct {
 	wg      sync.WaitGroup
 }
 
-// New creates a SizedWaitGroup.
+// NewSizedWaitGroup creates a SizedWaitGroup.
 // The limit parameter is the maximum amount of
 // goroutines which can be started concurrently.
-func New(limit int) SizedWaitGroup {
+func NewSizedWaitGroup(limit int) SizedWaitGroup {
 	size := math.MaxInt32 // 2^32 - 1
 	if limit > 0 {
 		size = limit
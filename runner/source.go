@@ -0,0 +1,107 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"gitlab.com/gpt4batch"
+)
+
+// Source is an iterator of the items to run.
+type Source interface {
+	// Next returns the next item, io.EOF once there are no more items.
+	Next(ctx context.Context) (*gpt4batch.In, error)
+}
+
+// SourceFunc adapts a function to a Source.
+type SourceFunc func(ctx context.Context) (*gpt4batch.In, error)
+
+// Next implements Source.
+func (f SourceFunc) Next(ctx context.Context) (*gpt4batch.In, error) {
+	return f(ctx)
+}
+
+// Items returns the Source of the items.
+func Items(ins gpt4batch.Ins) Source {
+	return SourceFunc(func(ctx context.Context) (*gpt4batch.In, error) {
+		if len(ins) == 0 {
+			return nil, io.EOF
+		}
+		in := ins[0]
+		ins = ins[1:]
+		return in, nil
+	})
+}
+
+// Lines returns the Source of the items read from r, one json object per line
+// like the input files of batchsvc.
+func Lines(r io.Reader) Source {
+	reader := bufio.NewReader(r)
+	return SourceFunc(func(ctx context.Context) (*gpt4batch.In, error) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) != 0 {
+				in := new(gpt4batch.In)
+				if err := json.Unmarshal(line, in); err != nil {
+					return nil, err
+				}
+				return in, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	})
+}
+
+// Sink receives the items once they are done.
+type Sink interface {
+	// Put receives the item.
+	Put(ctx context.Context, in *gpt4batch.In) error
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(ctx context.Context, in *gpt4batch.In) error
+
+// Put implements Sink.
+func (f SinkFunc) Put(ctx context.Context, in *gpt4batch.In) error {
+	return f(ctx, in)
+}
+
+// Writer returns the Sink writing the items to w, one json object per line
+// like the output files of batchsvc.
+func Writer(w io.Writer) Sink {
+	cfg := jsoniter.Config{
+		EscapeHTML: false,
+	}.Froze()
+
+	return SinkFunc(func(ctx context.Context, in *gpt4batch.In) error {
+		body, err := cfg.Marshal(in)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(body, '\n'))
+		return err
+	})
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+// rotatedLayout is the time layout of the rotated files.
+const rotatedLayout = "20060102T150405.000"
+
+func init() {
+	Register("file", newFile)
+}
+
+// rollingFile is the open file of a topic.
+type rollingFile struct {
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// fileSink appends the messages of a topic to dir/topic.jsonl, which is
+// rotated to dir/topic-time.jsonl when it is too large or too old.
+type fileSink struct {
+	logger gpt4batch.Logger
+	dir    string
+	// maxSize is the max bytes of a file, 0 disables the rotation by size.
+	maxSize int64
+	// maxAge is the max age of a file, 0 disables the rotation by age.
+	maxAge time.Duration
+	// maxBackups is the number of rotated files kept, 0 keeps every file.
+	maxBackups int
+	now        func() time.Time
+
+	mu    sync.Mutex
+	files map[string]*rollingFile
+}
+
+// newFile returns the rolling file sink of
+// file:///var/lib/gpt4batch?max_size=104857600&max_age=24h&max_backups=7.
+func newFile(u *url.URL, logger gpt4batch.Logger) (nsq.Async, error) {
+	dir := u.Path
+	if u.Opaque != "" {
+		dir = u.Opaque
+	} else if u.Host != "" {
+		dir = u.Host + u.Path
+	}
+	if dir == "" {
+		return nil, errors.New("file directory is required")
+	}
+
+	q := &query{values: u.Query()}
+	s := &fileSink{
+		logger:     logger,
+		dir:        filepath.FromSlash(dir),
+		maxSize:    int64(q.int("max_size", 100<<20)),
+		maxAge:     q.duration("max_age", 0),
+		maxBackups: q.int("max_backups", 0),
+		now:        time.Now,
+		files:      make(map[string]*rollingFile),
+	}
+	if q.err != nil {
+		return nil, q.err
+	}
+	if s.maxSize < 0 || s.maxAge < 0 || s.maxBackups < 0 {
+		return nil, errors.New("file max_size, max_age and max_backups must not be negative")
+	}
+	return s, nil
+}
+
+// Connect creates the directory.
+func (s *fileSink) Connect(context.Context) error {
+	return os.MkdirAll(s.dir, 0755)
+}
+
+// WriteBatch appends msg as a line to the file of topic.
+func (s *fileSink) WriteBatch(_ context.Context, topic string, msg []byte) error {
+	if topic == "" || topic != filepath.Base(topic) || strings.HasPrefix(topic, ".") {
+		return fmt.Errorf("file: invalid topic %q", topic)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := s.open(topic)
+	if err != nil {
+		return err
+	}
+
+	line := append(msg[:len(msg):len(msg)], '\n')
+	if f.size > 0 && ((s.maxSize > 0 && f.size+int64(len(line)) > s.maxSize) ||
+		(s.maxAge > 0 && s.now().Sub(f.opened) >= s.maxAge)) {
+		if f, err = s.rotate(topic); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// Close syncs and closes the files.
+func (s *fileSink) Close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for topic, f := range s.files {
+		errs = append(errs, f.file.Sync(), f.file.Close())
+		delete(s.files, topic)
+	}
+	return errors.Join(errs...)
+}
+
+// path returns the file of topic.
+func (s *fileSink) path(topic string) string {
+	return filepath.Join(s.dir, topic+".jsonl")
+}
+
+// open returns the open file of topic.
+func (s *fileSink) open(topic string) (*rollingFile, error) {
+	if f, ok := s.files[topic]; ok {
+		return f, nil
+	}
+
+	file, err := os.OpenFile(s.path(topic), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	f := &rollingFile{file: file, size: info.Size(), opened: s.now()}
+	s.files[topic] = f
+	return f, nil
+}
+
+// rotate renames the file of topic, removes the oldest rotated files and
+// opens a new file.
+func (s *fileSink) rotate(topic string) (*rollingFile, error) {
+	f := s.files[topic]
+	delete(s.files, topic)
+	if err := f.file.Close(); err != nil {
+		return nil, err
+	}
+
+	rotated := filepath.Join(s.dir, topic+"-"+s.now().Format(rotatedLayout)+".jsonl")
+	if err := os.Rename(s.path(topic), rotated); err != nil {
+		return nil, err
+	}
+	s.logger.WithField("file", rotated).Info("Rotate File")
+
+	if s.maxBackups > 0 {
+		backups, err := filepath.Glob(filepath.Join(s.dir, topic+"-"+strings.Repeat("[0-9]", 8)+"T*.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(backups)
+		for len(backups) > s.maxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				return nil, err
+			}
+			backups = backups[1:]
+		}
+	}
+	return s.open(topic)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/log"
+)
+
+func newTestFile(t *testing.T, query string) (*fileSink, *time.Time) {
+	u, err := url.Parse("file://" + filepath.ToSlash(t.TempDir()) + "?" + query)
+	assert.NoError(t, err)
+	async, err := newFile(u, log.New(log.ErrorLevel))
+	assert.NoError(t, err)
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := async.(*fileSink)
+	s.now = func() time.Time { return now }
+	assert.NoError(t, s.Connect(context.Background()))
+	return s, &now
+}
+
+func rotated(t *testing.T, dir, topic string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, topic+"-*.jsonl"))
+	assert.NoError(t, err)
+	return files
+}
+
+func TestFileSink_RotateBySize(t *testing.T) {
+	s, now := newTestFile(t, "max_size=8&max_backups=2")
+	ctx := context.Background()
+
+	for _, msg := range []string{"aaa", "bbb", "ccc", "ddd", "eee", "fff", "ggg"} {
+		assert.NoError(t, s.WriteBatch(ctx, "results", []byte(msg)))
+		*now = now.Add(time.Second)
+	}
+	assert.NoError(t, s.Close(ctx))
+
+	body, err := os.ReadFile(filepath.Join(s.dir, "results.jsonl"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ggg\n", string(body))
+
+	files := rotated(t, s.dir, "results")
+	assert.Len(t, files, 2)
+	body, err = os.ReadFile(files[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "eee\nfff\n", string(body))
+}
+
+func TestFileSink_RotateByAge(t *testing.T) {
+	s, now := newTestFile(t, "max_age=1h")
+	ctx := context.Background()
+
+	assert.NoError(t, s.WriteBatch(ctx, "results", []byte("a")))
+	*now = now.Add(30 * time.Minute)
+	assert.NoError(t, s.WriteBatch(ctx, "results", []byte("b")))
+	assert.Empty(t, rotated(t, s.dir, "results"))
+
+	*now = now.Add(30 * time.Minute)
+	assert.NoError(t, s.WriteBatch(ctx, "results", []byte("c")))
+	assert.NoError(t, s.WriteBatch(ctx, "events", []byte("d")))
+	assert.NoError(t, s.Close(ctx))
+
+	assert.Equal(t, []string{filepath.Join(s.dir, "results-20240102T040405.000.jsonl")}, rotated(t, s.dir, "results"))
+	body, err := os.ReadFile(filepath.Join(s.dir, "events.jsonl"))
+	assert.NoError(t, err)
+	assert.Equal(t, "d\n", string(body))
+}
+
+func TestFileSink_Append(t *testing.T) {
+	s, _ := newTestFile(t, "")
+	ctx := context.Background()
+
+	assert.NoError(t, s.WriteBatch(ctx, "results", []byte("a")))
+	assert.NoError(t, s.Close(ctx))
+	assert.NoError(t, s.WriteBatch(ctx, "results", []byte("b")))
+	assert.NoError(t, s.Close(ctx))
+
+	body, err := os.ReadFile(filepath.Join(s.dir, "results.jsonl"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(body))
+
+	for _, topic := range []string{"", "../results", "a/b", ".hidden"} {
+		assert.Error(t, s.WriteBatch(ctx, topic, []byte("c")), topic)
+	}
+}
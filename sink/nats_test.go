@@ -0,0 +1,114 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/log"
+)
+
+// fakeNATS is an in-process nats server speaking enough of the protocol to
+// accept a connection and record the published messages.
+type fakeNATS struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	msgs map[string][]string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	f := &fakeNATS{ln: ln, msgs: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return f
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case "PUB":
+			var size int
+			fmt.Sscan(fields[len(fields)-1], &size)
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.msgs[fields[1]] = append(f.msgs[fields[1]], string(payload[:size]))
+			f.mu.Unlock()
+		}
+	}
+}
+
+func (f *fakeNATS) published(subject string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.msgs[subject]...)
+}
+
+func TestNATSSink(t *testing.T) {
+	srv := newFakeNATS(t)
+	ctx := context.Background()
+
+	async, err := Open("nats://"+srv.ln.Addr().String(), log.New(log.ErrorLevel))
+	assert.NoError(t, err)
+	assert.Error(t, async.WriteBatch(ctx, "results", []byte("early")))
+	assert.NoError(t, async.Connect(ctx))
+
+	// the flush waits for the server to receive the message.
+	assert.NoError(t, async.WriteBatch(ctx, "results", []byte(`{"id":"1"}`)))
+	assert.Equal(t, []string{`{"id":"1"}`}, srv.published("results"))
+
+	assert.NoError(t, async.WriteBatch(ctx, "results", []byte(`{"id":"2"}`)))
+	assert.NoError(t, async.Close(ctx))
+	assert.Equal(t, []string{`{"id":"1"}`, `{"id":"2"}`}, srv.published("results"))
+}
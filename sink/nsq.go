@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"net/url"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+func init() {
+	Register("nsq", newNSQ)
+}
+
+// newNSQ returns the NSQ sink of nsq://host:4150,host:4150?batch_size=10.
+// the parameters are the ones of the --nsq_* flags of the producer.
+func newNSQ(u *url.URL, logger gpt4batch.Logger) (nsq.Async, error) {
+	var (
+		conf = nsq.NewNSQConfig()
+		q    = &query{values: u.Query()}
+	)
+
+	if addrs := hosts(u); len(addrs) != 0 {
+		conf.Addresses = addrs
+	}
+	conf.UserAgent = q.str("user_agent", conf.UserAgent)
+	conf.TLS = q.bool("tls", conf.TLS)
+	conf.TLSCAFile = q.str("tls_ca", conf.TLSCAFile)
+	conf.TLSCertFile = q.str("tls_cert", conf.TLSCertFile)
+	conf.TLSKeyFile = q.str("tls_key", conf.TLSKeyFile)
+	conf.TLSSkipVerify = q.bool("tls_skip_verify", conf.TLSSkipVerify)
+	conf.AuthSecret = q.str("auth_secret", conf.AuthSecret)
+	conf.BatchSize = q.int("batch_size", conf.BatchSize)
+	conf.BatchInterval = q.duration("batch_interval", conf.BatchInterval)
+	conf.HealthCheckInterval = q.duration("health_interval", conf.HealthCheckInterval)
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return nsq.NewNSQWriter(conf, logger)
+}
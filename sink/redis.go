@@ -0,0 +1,100 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/redis/go-redis/v9"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+func init() {
+	Register("redis", newRedis)
+	Register("rediss", newRedis)
+}
+
+// redisSink appends the messages to the redis stream of their topic.
+type redisSink struct {
+	logger gpt4batch.Logger
+	client *redis.Client
+	// field is the stream entry field holding the message.
+	field string
+	// maxLen trims the stream to about maxLen entries, 0 keeps every entry.
+	maxLen int64
+}
+
+// newRedis returns the redis streams sink of
+// redis://:password@host:6379/0?maxlen=100000&field=body.
+// the other parameters are the ones of the redis client.
+func newRedis(u *url.URL, logger gpt4batch.Logger) (nsq.Async, error) {
+	var (
+		values = u.Query()
+		q      = &query{values: values}
+		field  = q.str("field", "body")
+		maxLen = q.int("maxlen", 0)
+	)
+	if q.err != nil {
+		return nil, q.err
+	}
+	if maxLen < 0 {
+		return nil, fmt.Errorf("redis maxlen %d must not be negative", maxLen)
+	}
+
+	values.Del("field")
+	values.Del("maxlen")
+	uri := *u
+	uri.RawQuery = values.Encode()
+
+	opts, err := redis.ParseURL(uri.String())
+	if err != nil {
+		return nil, err
+	}
+	return &redisSink{
+		logger: logger,
+		client: redis.NewClient(opts),
+		field:  field,
+		maxLen: int64(maxLen),
+	}, nil
+}
+
+// Connect pings redis.
+func (r *redisSink) Connect(ctx context.Context) error {
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	return nil
+}
+
+// WriteBatch appends msg to the stream topic.
+func (r *redisSink) WriteBatch(ctx context.Context, topic string, msg []byte) error {
+	return r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: topic,
+		MaxLen: r.maxLen,
+		Approx: r.maxLen > 0,
+		Values: []interface{}{r.field, msg},
+	}).Err()
+}
+
+// Close closes the connections.
+func (r *redisSink) Close(context.Context) error {
+	return r.client.Close()
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/log"
+)
+
+func TestRedisSink(t *testing.T) {
+	srv := miniredis.RunT(t)
+	ctx := context.Background()
+
+	async, err := Open("redis://"+srv.Addr()+"/0?maxlen=100&field=message", log.New(log.ErrorLevel))
+	assert.NoError(t, err)
+	assert.NoError(t, async.Connect(ctx))
+
+	assert.NoError(t, async.WriteBatch(ctx, "results", []byte(`{"id":"1"}`)))
+	assert.NoError(t, async.WriteBatch(ctx, "results", []byte(`{"id":"2"}`)))
+	assert.NoError(t, async.Close(ctx))
+
+	entries, err := srv.Stream("results")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, []string{"message", `{"id":"1"}`}, entries[0].Values)
+		assert.Equal(t, []string{"message", `{"id":"2"}`}, entries[1].Values)
+	}
+}
+
+func TestRedisSink_ConnectFailed(t *testing.T) {
+	srv := miniredis.RunT(t)
+	addr := srv.Addr()
+	srv.Close()
+
+	async, err := Open("redis://"+addr, log.New(log.ErrorLevel))
+	assert.NoError(t, err)
+	assert.Error(t, async.Connect(context.Background()))
+}
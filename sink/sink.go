@@ -0,0 +1,232 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sink publishes the results to the message brokers, webhooks and
+// files selected by a URI, e.g. kafka://127.0.0.1:9092.
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+// Factory creates the sink of a URI. it must not connect, Connect does.
+type Factory func(u *url.URL, logger gpt4batch.Logger) (nsq.Async, error)
+
+// defaultBatchTimeout is the max time a message waits for its batch to fill.
+const defaultBatchTimeout = 100 * time.Millisecond
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a sink available for the URIs of scheme.
+func Register(scheme string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[strings.ToLower(scheme)] = factory
+}
+
+// Schemes returns the registered schemes.
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open returns the sink of uri. the query parameter topic, supported by every
+// sink, replaces the topic the messages are published to.
+func Open(uri string, logger gpt4batch.Logger) (nsq.Async, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.RLock()
+	factory, ok := factories[strings.ToLower(u.Scheme)]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("sink %q: unknown scheme %q, supported: %s", uri, u.Scheme, strings.Join(Schemes(), ","))
+	}
+
+	query := u.Query()
+	topic := query.Get("topic")
+	query.Del("topic")
+	u.RawQuery = query.Encode()
+
+	async, err := factory(u, logger.WithField("sink", u.Scheme))
+	if err != nil {
+		return nil, fmt.Errorf("sink %q: %w", uri, err)
+	}
+	if topic != "" {
+		async = &fixedTopic{Async: async, topic: topic}
+	}
+	return async, nil
+}
+
+// Validate checks that uri is a valid sink without connecting to it.
+func Validate(uri string) error {
+	_, err := Open(uri, log.New(log.ErrorLevel))
+	return err
+}
+
+// fixedTopic publishes every message to the same topic.
+type fixedTopic struct {
+	nsq.Async
+	topic string
+}
+
+// WriteBatch publishes msg to the fixed topic.
+func (f *fixedTopic) WriteBatch(ctx context.Context, _ string, msg []byte) error {
+	return f.Async.WriteBatch(ctx, f.topic, msg)
+}
+
+// multi publishes every message to all of its sinks.
+type multi []nsq.Async
+
+// NewMulti returns an Async publishing to all of sinks.
+func NewMulti(sinks ...nsq.Async) nsq.Async {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return multi(sinks)
+}
+
+// Connect connects every sink. the connected sinks are closed when one fails.
+func (m multi) Connect(ctx context.Context) error {
+	for i, async := range m {
+		if err := async.Connect(ctx); err != nil {
+			_ = m[:i].Close(ctx)
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBatch publishes msg to every sink, so that a failing sink does not
+// keep the message from the others.
+func (m multi) WriteBatch(ctx context.Context, topic string, msg []byte) error {
+	var errs []error
+	for _, async := range m {
+		if err := async.WriteBatch(ctx, topic, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink.
+func (m multi) Close(ctx context.Context) error {
+	var errs []error
+	for _, async := range m {
+		if err := async.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hosts returns the comma separated hosts of u.
+func hosts(u *url.URL) []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(u.Host, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// query reads the typed parameters of a URI.
+type query struct {
+	values url.Values
+	err    error
+}
+
+// str returns the parameter key, def if it is not set.
+func (q *query) str(key, def string) string {
+	if v := q.values.Get(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// int returns the integer parameter key, def if it is not set.
+func (q *query) int(key string, def int) int {
+	v := q.values.Get(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		q.fail(key, v)
+		return def
+	}
+	return n
+}
+
+// bool returns the boolean parameter key, def if it is not set.
+func (q *query) bool(key string, def bool) bool {
+	v := q.values.Get(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		q.fail(key, v)
+		return def
+	}
+	return b
+}
+
+// duration returns the duration parameter key, def if it is not set.
+func (q *query) duration(key string, def time.Duration) time.Duration {
+	v := q.values.Get(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		q.fail(key, v)
+		return def
+	}
+	return d
+}
+
+// fail records the first invalid parameter.
+func (q *query) fail(key, value string) {
+	if q.err == nil {
+		q.err = fmt.Errorf("invalid %s %q", key, value)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/nsq"
+)
+
+// TopicHeader is the header the webhook sink sends the topic of a message in.
+const TopicHeader = "X-Gpt4batch-Topic"
+
+func init() {
+	Register("http", newWebhook)
+	Register("https", newWebhook)
+}
+
+// webhookSink posts every message to a url.
+type webhookSink struct {
+	logger gpt4batch.Logger
+	url    string
+	client *resty.Client
+}
+
+// newWebhook returns the webhook sink posting to the url. the query is kept
+// and sent to the webhook.
+func newWebhook(u *url.URL, logger gpt4batch.Logger) (nsq.Async, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("webhook host is required")
+	}
+
+	client := resty.New().
+		SetTimeout(30 * time.Second).
+		SetRetryCount(2).
+		SetRetryWaitTime(time.Second).
+		AddRetryCondition(func(resp *resty.Response, err error) bool {
+			return err != nil || resp.StatusCode() == http.StatusTooManyRequests || resp.StatusCode() >= http.StatusInternalServerError
+		})
+	return &webhookSink{logger: logger, url: u.String(), client: client}, nil
+}
+
+// Connect does nothing, the webhook is called for every message.
+func (w *webhookSink) Connect(context.Context) error {
+	return nil
+}
+
+// WriteBatch posts msg with its topic in the TopicHeader header.
+func (w *webhookSink) WriteBatch(ctx context.Context, topic string, msg []byte) error {
+	resp, err := w.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader(TopicHeader, topic).
+		SetBody(msg).
+		Post(w.url)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() < http.StatusOK || resp.StatusCode() >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook: %s", resp.Status())
+	}
+	return nil
+}
+
+// Close closes the idle connections.
+func (w *webhookSink) Close(context.Context) error {
+	w.client.GetClient().CloseIdleConnections()
+	return nil
+}
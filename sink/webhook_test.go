@@ -0,0 +1,63 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/log"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch string(body) {
+		case "flaky":
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		case "bad":
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		assert.Equal(t, "results", r.Header.Get(TopicHeader))
+		assert.Equal(t, "1", r.URL.Query().Get("token"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	async, err := Open(srv.URL+"/hook?token=1", log.New(log.ErrorLevel))
+	assert.NoError(t, err)
+	assert.NoError(t, async.Connect(ctx))
+
+	assert.NoError(t, async.WriteBatch(ctx, "results", []byte("ok")))
+	assert.NoError(t, async.WriteBatch(ctx, "results", []byte("flaky")))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Error(t, async.WriteBatch(ctx, "results", []byte("bad")))
+	assert.NoError(t, async.Close(ctx))
+}
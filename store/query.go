@@ -0,0 +1,113 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Table is the result of a query.
+type Table struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// Query runs the query q and returns its rows.
+func (s *Store) Query(ctx context.Context, q string, args ...interface{}) (*Table, error) {
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Table{Columns: columns, Rows: make([][]interface{}, 0)}
+	for rows.Next() {
+		row := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t, rows.Err()
+}
+
+// LastRun returns the id of the run started last, empty if there is none.
+func (s *Store) LastRun(ctx context.Context) (string, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM runs ORDER BY started DESC LIMIT 1`).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+// Runs returns the runs, the last started first.
+func (s *Store) Runs(ctx context.Context, limit int) (*Table, error) {
+	return s.Query(ctx, `
+		SELECT id, model, gizmo_id,
+			datetime(started / 1000, 'unixepoch', 'localtime') AS started,
+			(finished - started) / 1000 AS seconds,
+			total, completed, succeeded, failed
+		FROM runs ORDER BY runs.started DESC LIMIT ?`, limit)
+}
+
+// Failures returns the failed items of run grouped by error kind and code,
+// the most frequent first. every run is counted if run is empty.
+func (s *Store) Failures(ctx context.Context, run string) (*Table, error) {
+	return s.Query(ctx, `
+		SELECT error_kind AS kind, error_code AS code, COUNT(*) AS items, MAX(error_message) AS message
+		FROM items
+		WHERE status = 'failed' AND (?1 = '' OR run_id = ?1)
+		GROUP BY error_kind, error_code
+		ORDER BY items DESC, kind, code`, run)
+}
+
+// Slowest returns the slowest answered asks of run, every run if run is empty.
+func (s *Store) Slowest(ctx context.Context, run string, limit int) (*Table, error) {
+	return s.Query(ctx, `
+		SELECT run_id, item_id, id AS ask_id, attempt, elapsed, substr(content, 1, 60) AS ask
+		FROM asks
+		WHERE status = 'succeeded' AND (?1 = '' OR run_id = ?1)
+		ORDER BY elapsed DESC LIMIT ?2`, run, limit)
+}
+
+// Search returns the answers of run containing text, every run if run is empty.
+func (s *Store) Search(ctx context.Context, run, text string, limit int) (*Table, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+	return s.Query(ctx, `
+		SELECT run_id, item_id, ask_id, attempt, substr(content, 1, 120) AS answer
+		FROM answers
+		WHERE content LIKE '%' || ?2 || '%' ESCAPE '\' AND (?1 = '' OR run_id = ?1)
+		ORDER BY run_id, item_id, ask_id, attempt LIMIT ?3`, run, escaped, limit)
+}
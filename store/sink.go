@@ -0,0 +1,110 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
+	"gitlab.com/gpt4batch/nsq"
+	"gitlab.com/gpt4batch/sink"
+)
+
+func init() {
+	sink.Register("sqlite", newSink)
+}
+
+// storeSink records the published events in a store.
+type storeSink struct {
+	logger gpt4batch.Logger
+	path   string
+
+	mu    sync.Mutex
+	store *Store
+}
+
+// newSink returns the sink of sqlite:///var/lib/gpt4batch/results.db.
+// a relative path is written sqlite://./results.db or sqlite:results.db.
+func newSink(u *url.URL, logger gpt4batch.Logger) (nsq.Async, error) {
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	} else if u.Host != "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, errors.New("sqlite path is required")
+	}
+	return &storeSink{logger: logger, path: filepath.FromSlash(path)}, nil
+}
+
+// Connect opens the store.
+func (s *storeSink) Connect(context.Context) error {
+	store, err := Open(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.store = store
+	s.mu.Unlock()
+	return nil
+}
+
+// WriteBatch records the event of msg, encoded as JSON or protobuf.
+func (s *storeSink) WriteBatch(ctx context.Context, _ string, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store == nil {
+		return errors.New("sqlite: not connected")
+	}
+
+	var (
+		ev  = new(event.Event)
+		err error
+	)
+	if len(msg) != 0 && msg[0] == '{' {
+		err = json.Unmarshal(msg, ev)
+	} else {
+		ev, err = event.UnmarshalProto(msg)
+	}
+	if err != nil {
+		// a malformed message can never be recorded. drop it.
+		s.logger.Warn("SQLite: drop malformed event: ", err)
+		return nil
+	}
+	return s.store.Record(ctx, ev)
+}
+
+// Close closes the store.
+func (s *storeSink) Close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store == nil {
+		return nil
+	}
+
+	err := s.store.Close()
+	s.store = nil
+	return err
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/event"
+	"gitlab.com/gpt4batch/log"
+	"gitlab.com/gpt4batch/sink"
+)
+
+func TestSink(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "results.db")
+	)
+	async, err := sink.Open("sqlite://"+filepath.ToSlash(path), log.New(log.ErrorLevel))
+	assert.NoError(t, err)
+	assert.NoError(t, async.Connect(ctx))
+
+	body, err := (&event.Event{Type: event.TypeItemStarted, Run: "r1", InID: "1", Attempt: 1}).Marshal(event.EncodingJSON)
+	assert.NoError(t, err)
+	assert.NoError(t, async.WriteBatch(ctx, "gpt4api", body))
+
+	body, err = (&event.Event{Type: event.TypeItemCompleted, Run: "r1", InID: "1", Attempt: 1}).Marshal(event.EncodingProtobuf)
+	assert.NoError(t, err)
+	assert.NoError(t, async.WriteBatch(ctx, "gpt4api", body))
+
+	// a malformed event is dropped.
+	assert.NoError(t, async.WriteBatch(ctx, "gpt4api", []byte("{")))
+	assert.NoError(t, async.Close(ctx))
+
+	s, err := OpenReadOnly(path)
+	assert.NoError(t, err)
+	defer s.Close()
+	rows, err := s.Query(ctx, `SELECT run_id, id, status FROM items`)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"r1", "1", "succeeded"}}, rows.Rows)
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package store keeps the events of the runs in a SQLite database with
+// normalized tables, so that the history of the runs can be queried.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
+)
+
+// schema is the tables of the store. the times are unix milliseconds.
+const schema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id        TEXT PRIMARY KEY,
+	model     TEXT,
+	gizmo_id  TEXT,
+	started   INTEGER,
+	finished  INTEGER,
+	total     INTEGER,
+	completed INTEGER,
+	succeeded INTEGER,
+	failed    INTEGER
+);
+CREATE TABLE IF NOT EXISTS items (
+	run_id        TEXT NOT NULL REFERENCES runs(id),
+	id            TEXT NOT NULL,
+	attempt       INTEGER,
+	status        TEXT,
+	started       INTEGER,
+	finished      INTEGER,
+	elapsed       INTEGER,
+	error_code    INTEGER,
+	error_kind    TEXT,
+	error_message TEXT,
+	error_ask_id  TEXT,
+	extra         TEXT,
+	PRIMARY KEY (run_id, id)
+);
+CREATE TABLE IF NOT EXISTS asks (
+	run_id        TEXT NOT NULL,
+	item_id       TEXT NOT NULL,
+	branch_id     TEXT NOT NULL DEFAULT '',
+	id            TEXT NOT NULL,
+	attempt       INTEGER NOT NULL,
+	status        TEXT,
+	content       TEXT,
+	started       INTEGER,
+	finished      INTEGER,
+	elapsed       INTEGER,
+	error_code    INTEGER,
+	error_kind    TEXT,
+	error_message TEXT,
+	PRIMARY KEY (run_id, item_id, branch_id, id, attempt),
+	FOREIGN KEY (run_id, item_id) REFERENCES items(run_id, id)
+);
+CREATE TABLE IF NOT EXISTS answers (
+	run_id          TEXT NOT NULL,
+	item_id         TEXT NOT NULL,
+	branch_id       TEXT NOT NULL DEFAULT '',
+	ask_id          TEXT NOT NULL,
+	attempt         INTEGER NOT NULL,
+	message_id      TEXT,
+	conversation_id TEXT,
+	end_turn        INTEGER,
+	content         TEXT,
+	json            TEXT,
+	assertions      TEXT,
+	PRIMARY KEY (run_id, item_id, branch_id, ask_id, attempt),
+	FOREIGN KEY (run_id, item_id, branch_id, ask_id, attempt) REFERENCES asks(run_id, item_id, branch_id, id, attempt)
+);
+CREATE TABLE IF NOT EXISTS attachments (
+	run_id    TEXT NOT NULL,
+	item_id   TEXT NOT NULL,
+	branch_id TEXT NOT NULL DEFAULT '',
+	ask_id    TEXT NOT NULL,
+	attempt   INTEGER NOT NULL,
+	type      TEXT NOT NULL,
+	path      TEXT NOT NULL,
+	FOREIGN KEY (run_id, item_id, branch_id, ask_id, attempt) REFERENCES asks(run_id, item_id, branch_id, id, attempt)
+);
+CREATE TABLE IF NOT EXISTS downloads (
+	run_id    TEXT NOT NULL,
+	item_id   TEXT NOT NULL,
+	branch_id TEXT NOT NULL DEFAULT '',
+	ask_id    TEXT NOT NULL,
+	attempt   INTEGER NOT NULL,
+	origin    TEXT NOT NULL,
+	local     TEXT,
+	FOREIGN KEY (run_id, item_id, branch_id, ask_id, attempt) REFERENCES asks(run_id, item_id, branch_id, id, attempt)
+);
+CREATE INDEX IF NOT EXISTS items_status ON items(status);
+CREATE INDEX IF NOT EXISTS asks_elapsed ON asks(elapsed);
+CREATE INDEX IF NOT EXISTS attachments_ask ON attachments(run_id, item_id, branch_id, ask_id, attempt);
+CREATE INDEX IF NOT EXISTS downloads_ask ON downloads(run_id, item_id, branch_id, ask_id, attempt);
+`
+
+// Store is a SQLite database of runs.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens the database at path, creating it and its tables if needed.
+func Open(path string) (*Store, error) {
+	return open(path, "rwc")
+}
+
+// OpenReadOnly opens the existing database at path for queries.
+func OpenReadOnly(path string) (*Store, error) {
+	return open(path, "ro")
+}
+
+// open opens the database at path in mode.
+func open(path, mode string) (*Store, error) {
+	dsn := (&url.URL{
+		Scheme: "file",
+		Opaque: url.PathEscape(path),
+		RawQuery: url.Values{
+			"mode":    {mode},
+			"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)", "foreign_keys(1)"},
+		}.Encode(),
+	}).String()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes the writes of the run.
+	db.SetMaxOpenConns(1)
+
+	if mode != "ro" {
+		if _, err := db.Exec(schema); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	} else if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Record stores the event.
+func (s *Store) Record(ctx context.Context, ev *event.Event) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the run is created by its first event.
+	if _, err := tx.ExecContext(ctx,
+		`INSERT OR IGNORE INTO runs (id, model, gizmo_id, started) VALUES (?, ?, ?, ?)`,
+		ev.Run, ev.Model, ev.GizmoID, ev.Time); err != nil {
+		return err
+	}
+
+	switch ev.Type {
+	case event.TypeItemStarted, event.TypeItemCompleted:
+		err = recordItem(ctx, tx, ev)
+	case event.TypeAskCompleted, event.TypeAskFailed:
+		if err = ensureItem(ctx, tx, ev); err == nil {
+			err = recordAsk(ctx, tx, ev)
+		}
+	case event.TypeRunFinished:
+		err = recordRun(ctx, tx, ev)
+	}
+	if err != nil {
+		return fmt.Errorf("record %s: %w", ev.Type, err)
+	}
+	return tx.Commit()
+}
+
+// status is the status of an item or an ask.
+const (
+	statusRunning   = "running"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+)
+
+// recordRun stores the statistics of a finished run.
+func recordRun(ctx context.Context, tx *sql.Tx, ev *event.Event) error {
+	stats := ev.Stats
+	if stats == nil {
+		stats = new(event.Stats)
+	}
+	_, err := tx.ExecContext(ctx,
+		`UPDATE runs SET finished = ?, total = ?, completed = ?, succeeded = ?, failed = ? WHERE id = ?`,
+		ev.Time, stats.Total, stats.Completed, stats.Succeeded, stats.Failed, ev.Run)
+	return err
+}
+
+// ensureItem creates the item of an ask event if its item.started event was not recorded.
+func ensureItem(ctx context.Context, tx *sql.Tx, ev *event.Event) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT OR IGNORE INTO items (run_id, id, attempt, status, started, extra) VALUES (?, ?, ?, ?, ?, ?)`,
+		ev.Run, ev.InID, ev.Attempt, statusRunning, ev.Started, jsonText(ev.Extra))
+	return err
+}
+
+// recordItem stores the start or the end of an item.
+func recordItem(ctx context.Context, tx *sql.Tx, ev *event.Event) error {
+	if ev.Type == event.TypeItemStarted {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO items (run_id, id, attempt, status, started, extra) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (run_id, id) DO UPDATE SET
+				attempt = excluded.attempt, status = excluded.status, started = excluded.started,
+				finished = NULL, elapsed = NULL, error_code = NULL, error_kind = NULL,
+				error_message = NULL, error_ask_id = NULL, extra = excluded.extra`,
+			ev.Run, ev.InID, ev.Attempt, statusRunning, ev.Time, jsonText(ev.Extra))
+		return err
+	}
+
+	var (
+		status = statusSucceeded
+		ierr   = ev.Error
+	)
+	if ierr != nil {
+		status = statusFailed
+	} else {
+		ierr = new(gpt4batch.IErr)
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO items (run_id, id, attempt, status, started, finished, elapsed,
+			error_code, error_kind, error_message, error_ask_id, extra)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (run_id, id) DO UPDATE SET
+			attempt = excluded.attempt, status = excluded.status,
+			started = COALESCE(excluded.started, items.started), finished = excluded.finished,
+			elapsed = excluded.elapsed, error_code = excluded.error_code, error_kind = excluded.error_kind,
+			error_message = excluded.error_message, error_ask_id = excluded.error_ask_id,
+			extra = COALESCE(excluded.extra, items.extra)`,
+		ev.Run, ev.InID, ev.Attempt, status, nullInt(ev.Started), ev.Time, ev.Elapsed,
+		nullInt(int64(ierr.Code)), nullString(string(ierr.Kind)), nullString(ierr.Message), nullString(ierr.AskID),
+		jsonText(ev.Extra))
+	return err
+}
+
+// recordAsk stores an answered or failed ask with its answer, attachments and downloads.
+func recordAsk(ctx context.Context, tx *sql.Tx, ev *event.Event) error {
+	key := []interface{}{ev.Run, ev.InID, ev.BranchID, ev.AskID, ev.Attempt}
+
+	// an ask recorded again replaces its previous record.
+	for _, table := range []string{"answers", "attachments", "downloads"} {
+		if _, err := tx.ExecContext(ctx,
+			`DELETE FROM `+table+` WHERE run_id = ? AND item_id = ? AND branch_id = ? AND ask_id = ? AND attempt = ?`, key...); err != nil {
+			return err
+		}
+	}
+
+	var (
+		status = statusSucceeded
+		ierr   = ev.Error
+	)
+	if ierr != nil {
+		status = statusFailed
+	} else {
+		ierr = new(gpt4batch.IErr)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT OR REPLACE INTO asks (run_id, item_id, branch_id, id, attempt, status, content, started, finished, elapsed,
+			error_code, error_kind, error_message)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		append(key, status, ev.Ask, ev.Started, ev.Finished, ev.Elapsed,
+			nullInt(int64(ierr.Code)), nullString(string(ierr.Kind)), nullString(ierr.Message))...); err != nil {
+		return err
+	}
+
+	for _, attachments := range []struct {
+		typ   string
+		paths []string
+	}{{"image", ev.Images}, {"file", ev.Files}} {
+		for _, path := range attachments.paths {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO attachments (run_id, item_id, branch_id, ask_id, attempt, type, path) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				append(key, attachments.typ, path)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	resp := ev.Answer
+	if resp == nil {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO answers (run_id, item_id, branch_id, ask_id, attempt, message_id, conversation_id, end_turn, content, json, assertions)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		append(key, resp.MessageID, resp.ConversationID, resp.EndTurn, resp.Text(),
+			jsonText(resp.JSON), jsonText(resp.Assertions))...); err != nil {
+		return err
+	}
+
+	// the downloads of the answer, with their local file once downloaded.
+	locals := make(map[string]string, len(resp.SpecDownloads))
+	origins := resp.Downloads[:len(resp.Downloads):len(resp.Downloads)]
+	for _, d := range resp.SpecDownloads {
+		if !contains(origins, d.Origin) {
+			origins = append(origins, d.Origin)
+		}
+		locals[d.Origin] = d.Local
+	}
+	for _, origin := range origins {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO downloads (run_id, item_id, branch_id, ask_id, attempt, origin, local) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			append(key, origin, nullString(locals[origin]))...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contains reports whether s contains v.
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonText returns the JSON of v, NULL if v is empty.
+func jsonText(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case []string:
+		if len(t) == 0 {
+			return nil
+		}
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return string(body)
+}
+
+// nullInt returns NULL for 0.
+func nullInt(v int64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+// nullString returns NULL for an empty string.
+func nullString(v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
+)
+
+// record records the events of two runs.
+func record(t *testing.T, s *Store) {
+	ctx := context.Background()
+	events := []*event.Event{
+		// run r1: item 1 succeeds, item 2 fails its second ask, item 3 is skipped.
+		{Type: event.TypeItemStarted, Run: "r1", Time: 1000, InID: "1", Attempt: 1, Model: "gpt-4", Extra: map[string]interface{}{"tag": "a"}},
+		{Type: event.TypeAskCompleted, Run: "r1", Time: 3000, InID: "1", AskID: "1-0", Attempt: 1, Ask: "draw a cat",
+			Started: 1000, Finished: 3000, Elapsed: 2000, Images: []string{"cat.png"},
+			Answer: &gpt4batch.ChatResponse{MessageID: "m1", ConversationID: "c1", EndTurn: true, Contents: []interface{}{"here is a cat"},
+				Downloads:     []string{"https://files/cat.png"},
+				SpecDownloads: gpt4batch.SpecDownloads{{Origin: "https://files/cat.png", Local: "downloads/cat.png"}}}},
+		{Type: event.TypeItemCompleted, Run: "r1", Time: 3000, InID: "1", Attempt: 1, Started: 1000, Finished: 3000, Elapsed: 2000},
+		{Type: event.TypeItemStarted, Run: "r1", Time: 1000, InID: "2", Attempt: 1},
+		{Type: event.TypeAskCompleted, Run: "r1", Time: 1500, InID: "2", AskID: "2-0", Attempt: 1, Ask: "hi",
+			Started: 1000, Finished: 1500, Elapsed: 500, Answer: &gpt4batch.ChatResponse{Contents: []interface{}{"100% sure"}}},
+		{Type: event.TypeAskFailed, Run: "r1", Time: 1600, InID: "2", AskID: "2-1", Attempt: 1, Ask: "and?",
+			Error: &gpt4batch.IErr{Code: 429, Kind: gpt4batch.ErrKindQuota, Message: "too many requests"}},
+		{Type: event.TypeItemCompleted, Run: "r1", Time: 1600, InID: "2", Attempt: 1,
+			Error: &gpt4batch.IErr{Code: 429, Kind: gpt4batch.ErrKindQuota, Message: "too many requests", AskID: "2-1"}},
+		{Type: event.TypeItemCompleted, Run: "r1", Time: 1700, InID: "3",
+			Error: &gpt4batch.IErr{Kind: gpt4batch.ErrKindDependency, Message: "dependency 2 failed"}},
+		{Type: event.TypeRunFinished, Run: "r1", Time: 4000, Stats: &event.Stats{Total: 3, Completed: 3, Succeeded: 1, Failed: 2}},
+		// run r2 reruns item 2, which succeeds.
+		{Type: event.TypeItemStarted, Run: "r2", Time: 5000, InID: "2", Attempt: 2},
+		{Type: event.TypeAskCompleted, Run: "r2", Time: 9000, InID: "2", AskID: "2-1", Attempt: 2, Ask: "and?",
+			Started: 5000, Finished: 9000, Elapsed: 4000, Answer: &gpt4batch.ChatResponse{Contents: []interface{}{"a_b"}}},
+		{Type: event.TypeItemCompleted, Run: "r2", Time: 9000, InID: "2", Attempt: 2, Started: 5000, Finished: 9000, Elapsed: 4000},
+	}
+	for _, ev := range events {
+		assert.NoError(t, s.Record(ctx, ev))
+	}
+}
+
+func TestStore(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "results.db")
+	)
+	s, err := Open(path)
+	assert.NoError(t, err)
+	record(t, s)
+	assert.NoError(t, s.Close())
+
+	// the queries only read the database.
+	s, err = OpenReadOnly(path)
+	assert.NoError(t, err)
+	defer s.Close()
+	_, err = s.Query(ctx, `DELETE FROM runs`)
+	assert.Error(t, err)
+
+	run, err := s.LastRun(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "r2", run)
+
+	runs, err := s.Runs(ctx, 10)
+	assert.NoError(t, err)
+	assert.Len(t, runs.Rows, 2)
+	assert.Equal(t, []interface{}{"r1", "gpt-4", "", "1970-01-01 00:00:01", int64(3), int64(3), int64(3), int64(1), int64(2)},
+		localize(runs.Rows[1], 3, "1970-01-01 00:00:01"))
+
+	failures, err := s.Failures(ctx, "r1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kind", "code", "items", "message"}, failures.Columns)
+	assert.Equal(t, [][]interface{}{
+		{"dependency", nil, int64(1), "dependency 2 failed"},
+		{"quota", int64(429), int64(1), "too many requests"},
+	}, failures.Rows)
+	failures, err = s.Failures(ctx, "r2")
+	assert.NoError(t, err)
+	assert.Empty(t, failures.Rows)
+
+	slowest, err := s.Slowest(ctx, "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]interface{}{
+		{"r2", "2", "2-1", int64(2), int64(4000), "and?"},
+		{"r1", "1", "1-0", int64(1), int64(2000), "draw a cat"},
+	}, slowest.Rows)
+
+	found, err := s.Search(ctx, "", "100%", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"r1", "2", "2-0", int64(1), "100% sure"}}, found.Rows)
+	found, err = s.Search(ctx, "", "_", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"r2", "2", "2-1", int64(2), "a_b"}}, found.Rows)
+
+	rows, err := s.Query(ctx, `
+		SELECT a.type, a.path, d.origin, d.local FROM attachments a
+		JOIN downloads d USING (run_id, item_id, ask_id, attempt)`)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{"image", "cat.png", "https://files/cat.png", "downloads/cat.png"}}, rows.Rows)
+
+	rows, err = s.Query(ctx, `SELECT status, attempt, error_ask_id, extra FROM items WHERE run_id = 'r1' ORDER BY id`)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]interface{}{
+		{"succeeded", int64(1), nil, `{"tag":"a"}`},
+		{"failed", int64(1), "2-1", nil},
+		{"failed", int64(0), nil, nil},
+	}, rows.Rows)
+}
+
+func TestStore_RecordAgain(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(filepath.Join(t.TempDir(), "results.db"))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	ev := &event.Event{Type: event.TypeAskCompleted, Run: "r1", InID: "1", AskID: "1-0", Attempt: 1,
+		Files: []string{"a.pdf"}, Answer: &gpt4batch.ChatResponse{Contents: []interface{}{"a"}, Downloads: []string{"https://f/1"}}}
+	assert.NoError(t, s.Record(ctx, ev))
+	assert.NoError(t, s.Record(ctx, ev))
+
+	rows, err := s.Query(ctx, `SELECT
+		(SELECT COUNT(*) FROM items), (SELECT COUNT(*) FROM asks), (SELECT COUNT(*) FROM answers),
+		(SELECT COUNT(*) FROM attachments), (SELECT COUNT(*) FROM downloads)`)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(1), int64(1), int64(1), int64(1), int64(1)}, rows.Rows[0])
+}
+
+func TestStore_branches(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(filepath.Join(t.TempDir(), "results.db"))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	// the branches may share an ask id, their asks and answers are kept apart.
+	for _, branch := range []string{"b1", "b2"} {
+		assert.NoError(t, s.Record(ctx, &event.Event{Type: event.TypeAskCompleted, Run: "r1", InID: "1", BranchID: branch,
+			AskID: "q", Attempt: 1, Files: []string{branch + ".pdf"},
+			Answer: &gpt4batch.ChatResponse{Contents: []interface{}{"answer of " + branch}, Downloads: []string{"https://f/" + branch}}}))
+	}
+
+	rows, err := s.Query(ctx, `
+		SELECT a.branch_id, a.content, t.path, d.origin FROM answers a
+		JOIN attachments t USING (run_id, item_id, branch_id, ask_id, attempt)
+		JOIN downloads d USING (run_id, item_id, branch_id, ask_id, attempt)
+		ORDER BY a.branch_id`)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]interface{}{
+		{"b1", "answer of b1", "b1.pdf", "https://f/b1"},
+		{"b2", "answer of b2", "b2.pdf", "https://f/b2"},
+	}, rows.Rows)
+
+	rows, err = s.Query(ctx, `SELECT COUNT(*) FROM asks`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), rows.Rows[0][0])
+}
+
+// localize replaces the local time column idx of row with utc, so that the
+// test does not depend on the time zone.
+func localize(row []interface{}, idx int, utc string) []interface{} {
+	row = append([]interface{}(nil), row...)
+	if row[idx] != nil {
+		row[idx] = utc
+	}
+	return row
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook posts the notifications of a run to webhooks. every request
+// is signed with HMAC-SHA256 so that the receivers can check where it comes from.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
+
+	"gitlab.com/gpt4batch"
+	"gitlab.com/gpt4batch/event"
+)
+
+// Version is the version of the notification schema. it changes when a field
+// is removed or its meaning changes, not when a field is added.
+const Version = 1
+
+// The headers of the requests.
+const (
+	// TypeHeader is the header of the type of the notification.
+	TypeHeader = "X-Gpt4batch-Event"
+	// DeliveryHeader is the header of the id of the notification, the same for every retry.
+	DeliveryHeader = "X-Gpt4batch-Delivery"
+	// TimestampHeader is the header of the unix time in seconds the request is signed at.
+	TimestampHeader = "X-Gpt4batch-Timestamp"
+	// SignatureHeader is the header of the signature of the request, see Sign.
+	SignatureHeader = "X-Gpt4batch-Signature"
+)
+
+// Type is the type of a notification.
+type Type string
+
+const (
+	// TypeRunStarted is the run started.
+	TypeRunStarted Type = "run.started"
+	// TypeRunProgress is the run is in progress, sent periodically.
+	TypeRunProgress Type = "run.progress"
+	// TypeRunFinished is the run finished and the output is written.
+	TypeRunFinished Type = "run.finished"
+	// TypeRunFailed is the run stopped on a fatal error, Error is set.
+	TypeRunFailed Type = "run.failed"
+)
+
+// Types is every notification type.
+var Types = []Type{TypeRunStarted, TypeRunProgress, TypeRunFinished, TypeRunFailed}
+
+// Notification is a notification of a run.
+type Notification struct {
+	// Version is the version of the schema.
+	Version int `json:"version"`
+	// ID is the unique id of the notification.
+	ID   string `json:"id"`
+	Type Type   `json:"type"`
+	// Time is the unix time in milliseconds the notification is sent at.
+	Time int64 `json:"time"`
+	// Run is the id of the run the notification belongs to.
+	Run     string `json:"run"`
+	Model   string `json:"model,omitempty"`
+	GizmoID string `json:"gizmo_id,omitempty"`
+	// In is the input file of the run.
+	In string `json:"in,omitempty"`
+	// Out is the output file of the run.
+	Out string `json:"out,omitempty"`
+	// Started is the unix time in milliseconds the run started at.
+	Started int64 `json:"started"`
+	// Elapsed is the duration of the run in milliseconds.
+	Elapsed int64 `json:"elapsed"`
+	// Stats is the statistics of the run.
+	Stats *event.Stats `json:"stats,omitempty"`
+	// Error is the fatal error of the run.
+	Error string `json:"error,omitempty"`
+}
+
+// ParseTypes returns the notification types of names, every type if names is empty.
+func ParseTypes(names []string) (map[Type]bool, error) {
+	types := make(map[Type]bool, len(Types))
+	if len(names) == 0 {
+		for _, typ := range Types {
+			types[typ] = true
+		}
+		return types, nil
+	}
+
+	for _, name := range names {
+		typ := Type(name)
+		valid := false
+		for _, t := range Types {
+			valid = valid || t == typ
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown webhook event %q", name)
+		}
+		types[typ] = true
+	}
+	return types, nil
+}
+
+// ParseTemplate parses the template file the payloads are rendered with. the
+// template is executed with the Notification, and the json function encodes
+// a value as JSON, e.g. {"text": {{ json .Type }}}.
+func ParseTemplate(filename string) (*template.Template, error) {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filename).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).
+		Parse(string(text))
+}
+
+// Sign returns the signature of body sent at timestamp: "sha256=" followed by
+// the hex HMAC-SHA256 of timestamp, a dot and body, keyed with secret.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the signature of body sent at timestamp.
+func Verify(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Config is the configuration of a Notifier.
+type Config struct {
+	// URLs is the webhooks every notification is posted to.
+	URLs []string
+	// Secret is the key the requests are signed with, no signature if empty.
+	Secret string
+	// Template renders the payloads, the Notification as JSON if nil.
+	Template *template.Template
+	// Types is the notification types posted.
+	Types map[Type]bool
+	// Retries is the number of times a failed request is retried.
+	Retries int
+	// Timeout is the timeout of each request.
+	Timeout time.Duration
+}
+
+// Notifier posts the notifications of a run to the webhooks. a nil Notifier
+// discards the notifications.
+type Notifier struct {
+	logger  gpt4batch.Logger
+	config  Config
+	client  *resty.Client
+	run     string
+	started time.Time
+	now     func() time.Time
+}
+
+// NewNotifier returns a Notifier of a run starting now.
+func NewNotifier(config Config, logger gpt4batch.Logger) *Notifier {
+	client := resty.New().
+		SetTimeout(config.Timeout).
+		SetRetryCount(config.Retries).
+		SetRetryWaitTime(time.Second).
+		SetRetryMaxWaitTime(30 * time.Second).
+		AddRetryCondition(func(resp *resty.Response, err error) bool {
+			return err != nil || resp.StatusCode() == http.StatusTooManyRequests || resp.StatusCode() >= http.StatusInternalServerError
+		})
+	n := &Notifier{
+		logger:  logger.WithField("webhook", "notify"),
+		config:  config,
+		client:  client,
+		run:     uuid.NewString(),
+		started: time.Now(),
+		now:     time.Now,
+	}
+	if config.Secret != "" {
+		client.OnBeforeRequest(n.sign)
+	}
+	return n
+}
+
+// Run returns the id of the run.
+func (n *Notifier) Run() string {
+	if n == nil {
+		return ""
+	}
+	return n.run
+}
+
+// Notify fills the envelope of no and posts it to every webhook. it returns
+// the errors of the webhooks that still fail after the retries.
+func (n *Notifier) Notify(ctx context.Context, no *Notification) error {
+	if n == nil || !n.config.Types[no.Type] {
+		return nil
+	}
+
+	now := n.now()
+	no.Version = Version
+	no.ID = uuid.NewString()
+	no.Time = now.UnixMilli()
+	no.Run = n.run
+	no.Started = n.started.UnixMilli()
+	no.Elapsed = now.Sub(n.started).Milliseconds()
+
+	body, err := n.render(no)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, url := range n.config.URLs {
+		if err := n.post(ctx, url, no, body); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", url, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// render returns the payload of no.
+func (n *Notifier) render(no *Notification) ([]byte, error) {
+	if n.config.Template == nil {
+		return json.Marshal(no)
+	}
+
+	var buf bytes.Buffer
+	if err := n.config.Template.Execute(&buf, no); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("webhook template %s: the payload of %s is not valid JSON", n.config.Template.Name(), no.Type)
+	}
+	return buf.Bytes(), nil
+}
+
+// post posts body to url.
+func (n *Notifier) post(ctx context.Context, url string, no *Notification, body []byte) error {
+	req := n.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader(TypeHeader, string(no.Type)).
+		SetHeader(DeliveryHeader, no.ID).
+		SetBody(body)
+
+	resp, err := req.Post(url)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() < http.StatusOK || resp.StatusCode() >= http.StatusMultipleChoices {
+		return errors.New(resp.Status())
+	}
+	return nil
+}
+
+// sign signs req. it runs before every attempt, so that a retried request
+// carries a fresh timestamp.
+func (n *Notifier) sign(_ *resty.Client, req *resty.Request) error {
+	body, ok := req.Body.([]byte)
+	if !ok {
+		return nil
+	}
+	timestamp := strconv.FormatInt(n.now().Unix(), 10)
+	req.SetHeader(TimestampHeader, timestamp).
+		SetHeader(SignatureHeader, Sign([]byte(n.config.Secret), timestamp, body))
+	return nil
+}
+
+// Close closes the idle connections.
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.client.GetClient().CloseIdleConnections()
+}
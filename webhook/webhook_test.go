@@ -0,0 +1,161 @@
+/*
+Copyright 2024 The gpt4batch Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"gitlab.com/gpt4batch/event"
+	"gitlab.com/gpt4batch/log"
+)
+
+// receiver is a webhook recording the requests it accepts. it answers the
+// first fails requests with a 502.
+type receiver struct {
+	mu    sync.Mutex
+	fails int
+	reqs  []*http.Request
+	body  [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fails > 0 {
+		r.fails--
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	r.reqs = append(r.reqs, req)
+	r.body = append(r.body, body)
+}
+
+func TestSign(t *testing.T) {
+	sig := Sign([]byte("secret"), "1700000000", []byte(`{}`))
+	assert.Equal(t, "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163", sig)
+	assert.True(t, Verify([]byte("secret"), "1700000000", []byte(`{}`), sig))
+	assert.False(t, Verify([]byte("secret"), "1700000001", []byte(`{}`), sig))
+	assert.False(t, Verify([]byte("other"), "1700000000", []byte(`{}`), sig))
+}
+
+func TestNotifier(t *testing.T) {
+	rcv := &receiver{fails: 1}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	types, _ := ParseTypes([]string{"run.finished"})
+	n := NewNotifier(Config{URLs: []string{srv.URL}, Secret: "secret", Types: types, Retries: 2, Timeout: time.Second}, log.New(log.ErrorLevel))
+
+	// the notifications of the other types are not posted.
+	assert.NoError(t, n.Notify(context.Background(), &Notification{Type: TypeRunStarted}))
+	assert.Empty(t, rcv.reqs)
+
+	// the failed request is retried.
+	stats := &event.Stats{Total: 2, Completed: 2, Succeeded: 1, Failed: 1}
+	assert.NoError(t, n.Notify(context.Background(), &Notification{Type: TypeRunFinished, Out: "out.jsonl", Stats: stats}))
+	if assert.Len(t, rcv.reqs, 1) {
+		req, body := rcv.reqs[0], rcv.body[0]
+		assert.Equal(t, "run.finished", req.Header.Get(TypeHeader))
+		assert.True(t, Verify([]byte("secret"), req.Header.Get(TimestampHeader), body, req.Header.Get(SignatureHeader)))
+
+		var no Notification
+		assert.NoError(t, json.Unmarshal(body, &no))
+		assert.Equal(t, Version, no.Version)
+		assert.Equal(t, req.Header.Get(DeliveryHeader), no.ID)
+		assert.Equal(t, n.Run(), no.Run)
+		assert.Equal(t, "out.jsonl", no.Out)
+		assert.Equal(t, stats, no.Stats)
+	}
+
+	// the error is returned once the retries are exhausted.
+	rcv.fails = 3
+	assert.Error(t, n.Notify(context.Background(), &Notification{Type: TypeRunFinished}))
+
+	var nilNotifier *Notifier
+	assert.NoError(t, nilNotifier.Notify(context.Background(), &Notification{Type: TypeRunFinished}))
+}
+
+func TestNotifier_retrySigned(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		timestamps []string
+		verified   []bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(req.Body)
+		timestamps = append(timestamps, req.Header.Get(TimestampHeader))
+		verified = append(verified, Verify([]byte("secret"), req.Header.Get(TimestampHeader), body, req.Header.Get(SignatureHeader)))
+		if len(timestamps) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	types, _ := ParseTypes(nil)
+	n := NewNotifier(Config{URLs: []string{srv.URL}, Secret: "secret", Types: types, Retries: 1, Timeout: time.Second}, log.New(log.ErrorLevel))
+	clock := time.Unix(1700000000, 0)
+	n.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+
+	// the retry is signed again with a fresh timestamp.
+	assert.NoError(t, n.Notify(context.Background(), &Notification{Type: TypeRunFinished}))
+	if assert.Len(t, timestamps, 2) {
+		assert.NotEqual(t, timestamps[0], timestamps[1])
+		assert.Equal(t, []bool{true, true}, verified)
+	}
+}
+
+func TestNotifier_template(t *testing.T) {
+	rcv := new(receiver)
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	filename := filepath.Join(t.TempDir(), "slack.tmpl")
+	assert.NoError(t, os.WriteFile(filename, []byte(`{"text": {{ json (printf "%s %d/%d" .Type .Stats.Completed .Stats.Total) }}}`), 0o644))
+	tmpl, err := ParseTemplate(filename)
+	assert.NoError(t, err)
+
+	types, _ := ParseTypes(nil)
+	n := NewNotifier(Config{URLs: []string{srv.URL}, Template: tmpl, Types: types, Timeout: time.Second}, log.New(log.ErrorLevel))
+	assert.NoError(t, n.Notify(context.Background(), &Notification{Type: TypeRunProgress, Stats: &event.Stats{Total: 4, Completed: 1}}))
+	if assert.Len(t, rcv.body, 1) {
+		assert.JSONEq(t, `{"text": "run.progress 1/4"}`, string(rcv.body[0]))
+		assert.Empty(t, rcv.reqs[0].Header.Get(SignatureHeader))
+	}
+
+	// the payloads must be valid JSON.
+	assert.NoError(t, os.WriteFile(filename, []byte(`{"text": {{ .Type }}}`), 0o644))
+	n.config.Template, err = ParseTemplate(filename)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, n.Notify(context.Background(), &Notification{Type: TypeRunFailed}), "not valid JSON")
+}